@@ -0,0 +1,46 @@
+//go:build benchmark
+
+package smt
+
+import (
+	"testing"
+
+	"github.com/pokt-network/smt"
+)
+
+func BenchmarkSparseMerkleSumTrie_SingleLeaf(b *testing.B) {
+	testCases := []struct {
+		desc     string
+		trieSize int
+		fn       func(*smt.SMST, uint64) error
+	}{
+		{
+			desc:     "Get (Single Leaf)",
+			trieSize: 1,
+			fn:       getSMST,
+		},
+		{
+			desc:     "Get (Prefilled: 2)",
+			trieSize: 2,
+			fn:       getSMST,
+		},
+		{
+			desc:     "Prove (Single Leaf)",
+			trieSize: 1,
+			fn:       proSMST,
+		},
+		{
+			desc:     "Prove (Prefilled: 2)",
+			trieSize: 2,
+			fn:       proSMST,
+		},
+	}
+
+	for _, tc := range testCases {
+		b.ResetTimer()
+		b.Run(tc.desc, func(b *testing.B) {
+			trie := setupSMST(b, tc.trieSize)
+			benchmarkSMST(b, trie, false, tc.fn)
+		})
+	}
+}
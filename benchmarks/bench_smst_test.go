@@ -3,12 +3,14 @@
 package smt
 
 import (
+	"crypto/sha256"
 	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/pokt-network/smt"
+	"github.com/pokt-network/smt/kvstore/simplemap"
 )
 
 func BenchmarkSparseMerkleSumTrie_Fill(b *testing.B) {
@@ -341,3 +343,40 @@ func BenchmarkSparseMerkleSumTrie_Delete(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkSparseMerkleSumTrie_GetMany(b *testing.B) {
+	numKeys := 1000
+	nodes := simplemap.NewSimpleMap()
+	trie := smt.NewSparseMerkleSumTrie(nodes, sha256.New())
+	keys := make([][]byte, numKeys)
+	for i := range keys {
+		keys[i] = []byte(strconv.Itoa(i))
+		require.NoError(b, trie.Update(keys[i], keys[i], uint64(i)))
+	}
+	require.NoError(b, trie.Commit())
+	root := trie.Root()
+
+	// A freshly imported trie is used for every iteration so that all nodes
+	// are loaded from the node store
+	b.Run("Get (Keys: 1000)", func(b *testing.B) {
+		b.ResetTimer()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			imported := smt.ImportSparseMerkleSumTrie(nodes, sha256.New(), root)
+			for _, key := range keys {
+				_, _, _ = imported.Get(key)
+			}
+		}
+		b.StopTimer()
+	})
+
+	b.Run("GetMany (Keys: 1000)", func(b *testing.B) {
+		b.ResetTimer()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			imported := smt.ImportSparseMerkleSumTrie(nodes, sha256.New(), root)
+			_, _, _ = imported.GetMany(keys)
+		}
+		b.StopTimer()
+	})
+}
@@ -0,0 +1,156 @@
+//go:build benchmark
+
+package smt
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pokt-network/smt"
+	"github.com/pokt-network/smt/kvstore/simplemap"
+)
+
+func BenchmarkSparseMerkleSumTrie_VerifySumProof(b *testing.B) {
+	testCases := []struct {
+		desc     string
+		trieSize int
+		compact  bool
+	}{
+		{
+			desc:     "VerifySumProof (Prefilled: 10000)",
+			trieSize: 10000,
+			compact:  false,
+		},
+		{
+			desc:     "VerifyCompactSumProof (Prefilled: 10000)",
+			trieSize: 10000,
+			compact:  true,
+		},
+		{
+			desc:     "VerifySumProof (Prefilled: 100000)",
+			trieSize: 100000,
+			compact:  false,
+		},
+		{
+			desc:     "VerifyCompactSumProof (Prefilled: 100000)",
+			trieSize: 100000,
+			compact:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		b.ResetTimer()
+		b.Run(tc.desc, func(b *testing.B) {
+			trie := setupSMST(b, tc.trieSize)
+			root := trie.Root()
+			key := []byte(strconv.Itoa(tc.trieSize / 2))
+			proof, err := trie.Prove(key)
+			require.NoError(b, err)
+			compactProof, err := smt.CompactProof(proof, trie.Spec())
+			require.NoError(b, err)
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if tc.compact {
+					_, _ = smt.VerifyCompactSumProof(compactProof, root, key, key, uint64(tc.trieSize/2), trie.Spec())
+				} else {
+					_, _ = smt.VerifySumProof(proof, root, key, key, uint64(tc.trieSize/2), trie.Spec())
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+func BenchmarkSparseMerkleSumTrie_VerifySumProof_ReusableSpec(b *testing.B) {
+	numProofs := 1000
+	trie := setupSMST(b, numProofs)
+	root := trie.Root()
+	proofs := make([]*smt.SparseMerkleProof, numProofs)
+	for i := range proofs {
+		proof, err := trie.Prove([]byte(strconv.Itoa(i)))
+		require.NoError(b, err)
+		proofs[i] = proof
+	}
+	spec := smt.ReusableSpec(sha256.New, true)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for i, proof := range proofs {
+				key := []byte(strconv.Itoa(i))
+				valid, err := smt.VerifySumProof(proof, root, key, key, uint64(i), spec)
+				if err != nil || !valid {
+					b.Errorf("proof %d failed to verify: %v", i, err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkSparseMerkleSumTrie_VerifySumProofsSameRoot(b *testing.B) {
+	numProofs := 500
+	trie := setupSMST(b, numProofs)
+	root := trie.Root()
+	items := make([]smt.KeyValueSumProof, numProofs)
+	for i := range items {
+		key := []byte(strconv.Itoa(i))
+		proof, err := trie.Prove(key)
+		require.NoError(b, err)
+		items[i] = smt.KeyValueSumProof{Key: key, Value: key, Sum: uint64(i), Proof: proof}
+	}
+
+	b.Run("VerifySumProof (Proofs: 500)", func(b *testing.B) {
+		b.ResetTimer()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, item := range items {
+				_, _ = smt.VerifySumProof(item.Proof, root, item.Key, item.Value, item.Sum, trie.Spec())
+			}
+		}
+		b.StopTimer()
+	})
+
+	b.Run("VerifySumProofsSameRoot (Proofs: 500)", func(b *testing.B) {
+		b.ResetTimer()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = smt.VerifySumProofsSameRoot(root, items, trie.Spec())
+		}
+		b.StopTimer()
+	})
+}
+
+func BenchmarkSparseMerkleSumTrie_VerifyCompactSumProof_Sparse(b *testing.B) {
+	// Two keys whose paths share their first two bytes produce proofs with at
+	// least 16 placeholder side nodes, which are restored from the bit mask of
+	// the compact proof during verification
+	key := []byte("0")
+	path := sha256.Sum256(key)
+	var other []byte
+	for i := 1; other == nil; i++ {
+		candidate := []byte(strconv.Itoa(i))
+		if p := sha256.Sum256(candidate); p[0] == path[0] && p[1] == path[1] {
+			other = candidate
+		}
+	}
+	trie := smt.NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(b, trie.Update(key, key, 1))
+	require.NoError(b, trie.Update(other, other, 2))
+	root := trie.Root()
+	proof, err := trie.Prove(key)
+	require.NoError(b, err)
+	compactProof, err := smt.CompactProof(proof, trie.Spec())
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = smt.VerifyCompactSumProof(compactProof, root, key, key, 1, trie.Spec())
+	}
+	b.StopTimer()
+}
@@ -146,3 +146,87 @@ func bulkCheckAll(t *testing.T, smt *SMTWithStorage, kv []bulkop) {
 		}
 	}
 }
+
+// Test that batch operations treat nil and empty inputs alike, returning
+// empty results without allocating.
+func TestBatchOperations_EmptyInputs(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("key"), []byte("value"), 1))
+	root := smst.Root()
+	invalid := func(valid bool) int {
+		if valid {
+			return 0
+		}
+		return 1
+	}
+
+	cases := []struct {
+		desc string
+		fn   func() (int, error)
+	}{
+		{"GetMany (nil)", func() (int, error) {
+			values, sums, err := smst.GetMany(nil)
+			return len(values) + len(sums), err
+		}},
+		{"GetMany (empty)", func() (int, error) {
+			values, sums, err := smst.GetMany([][]byte{})
+			return len(values) + len(sums), err
+		}},
+		{"ProveSumOf (nil)", func() (int, error) {
+			total, proofs, err := smst.ProveSumOf(nil)
+			return int(total) + len(proofs), err
+		}},
+		{"ProveSumOf (empty)", func() (int, error) {
+			total, proofs, err := smst.ProveSumOf([][]byte{})
+			return int(total) + len(proofs), err
+		}},
+		{"VerifySumProofsSameRoot (nil)", func() (int, error) {
+			results, err := VerifySumProofsSameRoot(root, nil, smst.Spec())
+			return len(results), err
+		}},
+		{"VerifySumProofsSameRoot (empty)", func() (int, error) {
+			results, err := VerifySumProofsSameRoot(root, []KeyValueSumProof{}, smst.Spec())
+			return len(results), err
+		}},
+		// Verifying no proofs succeeds, so an invalid result is counted
+		{"VerifySumProofs (nil)", func() (int, error) {
+			valid, err := VerifySumProofs(nil, root, nil, nil, nil, smst.Spec())
+			return invalid(valid), err
+		}},
+		{"VerifySumProofs (empty)", func() (int, error) {
+			valid, err := VerifySumProofs([]*SparseMerkleProof{}, root, [][]byte{}, [][]byte{}, []uint64{}, smst.Spec())
+			return invalid(valid), err
+		}},
+		{"VerifyEntryProofs (nil)", func() (int, error) {
+			valid, err := VerifyEntryProofs(nil, root, nil, smst.Spec())
+			return invalid(valid), err
+		}},
+		{"VerifyEntryProofs (empty)", func() (int, error) {
+			valid, err := VerifyEntryProofs([]*SparseMerkleProof{}, root, []KeyValueSum{}, smst.Spec())
+			return invalid(valid), err
+		}},
+		{"VerifySetSum (nil)", func() (int, error) {
+			valid, err := VerifySetSum(nil, nil, nil, 0, nil, root, smst.Spec())
+			return invalid(valid), err
+		}},
+		{"VerifySetSum (empty)", func() (int, error) {
+			valid, err := VerifySetSum([][]byte{}, [][]byte{}, []uint64{}, 0, []*SparseMerkleProof{}, root, smst.Spec())
+			return invalid(valid), err
+		}},
+		{"UpdateEntries (nil)", func() (int, error) {
+			return 0, smst.UpdateEntries(nil)
+		}},
+		{"UpdateEntries (empty)", func() (int, error) {
+			return 0, smst.UpdateEntries([]KeyValueSum{})
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			n, err := tc.fn()
+			require.NoError(t, err)
+			require.Zero(t, n)
+			allocs := testing.AllocsPerRun(10, func() { _, _ = tc.fn() })
+			require.Zero(t, allocs)
+		})
+	}
+}
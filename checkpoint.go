@@ -0,0 +1,68 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// Checkpoint is a compact summary of the state of a sum trie at a point in
+// time, to be signed over and anchored periodically. Only the root commits to
+// the trie's contents: the sum is part of the root, while the leaf count and
+// timestamp are attested to by whoever signs the checkpoint.
+type Checkpoint struct {
+	Root      []byte
+	Sum       uint64
+	LeafCount uint64
+	Timestamp time.Time
+}
+
+// Checkpoint returns a Checkpoint of the trie's current root, sum and number of
+// leaves, timestamped with the current time. The leaves are counted by visiting
+// every one of them.
+func (smst *SMST) Checkpoint() (Checkpoint, error) {
+	view := smst.readView()
+	it, err := view.NewLeafIterator(IteratorOptions{})
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	var count uint64
+	for it.Next() {
+		count++
+	}
+	if err := it.Err(); err != nil {
+		return Checkpoint{}, err
+	}
+	root := view.Root()
+	return Checkpoint{
+		Root:      bytes.Clone(root),
+		Sum:       binary.BigEndian.Uint64(smst.th.digestSum(root)),
+		LeafCount: count,
+		Timestamp: time.Now().UTC(),
+	}, nil
+}
+
+// Bytes returns the canonical serialisation of the checkpoint, to be signed:
+// [root]+[sum]+[leaf count]+[timestamp], where the sum, leaf count and the
+// timestamp in nanoseconds since the Unix epoch are 8 byte big endian integers.
+func (cp Checkpoint) Bytes() []byte {
+	bz := make([]byte, len(cp.Root), len(cp.Root)+3*8)
+	copy(bz, cp.Root)
+	bz = binary.BigEndian.AppendUint64(bz, cp.Sum)
+	bz = binary.BigEndian.AppendUint64(bz, cp.LeafCount)
+	return binary.BigEndian.AppendUint64(bz, uint64(cp.Timestamp.UnixNano()))
+}
+
+// VerifyCheckpoint verifies that the checkpoint provided is of the root given
+// and internally consistent with it for a sum trie with the spec provided: its
+// sum is the one committed to by the root, and it counts no leaves only if the
+// root is that of an empty trie.
+func VerifyCheckpoint(cp Checkpoint, root []byte, spec *TrieSpec) bool {
+	if len(root) != hashSize(spec) || !bytes.Equal(cp.Root, root) {
+		return false
+	}
+	if cp.Sum != binary.BigEndian.Uint64(spec.th.digestSum(root)) {
+		return false
+	}
+	return (cp.LeafCount == 0) == bytes.Equal(root, placeholder(spec))
+}
@@ -0,0 +1,63 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pokt-network/smt/kvstore/simplemap"
+)
+
+func TestSMST_Checkpoint(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+
+	// An empty trie has a checkpoint with no leaves
+	cp, err := smst.Checkpoint()
+	require.NoError(t, err)
+	require.Zero(t, cp.LeafCount)
+	require.True(t, VerifyCheckpoint(cp, smst.Root(), smst.Spec()))
+
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+		// Count some of the leaves from lazily loaded nodes
+		if i == 10 {
+			require.NoError(t, smst.Commit())
+		}
+	}
+	before := time.Now()
+	cp, err = smst.Checkpoint()
+	require.NoError(t, err)
+	require.Equal(t, []byte(smst.Root()), cp.Root)
+	require.Equal(t, smst.Sum(), cp.Sum)
+	require.Equal(t, uint64(20), cp.LeafCount)
+	require.False(t, cp.Timestamp.Before(before.Truncate(time.Second)))
+	require.True(t, VerifyCheckpoint(cp, smst.Root(), smst.Spec()))
+
+	// The serialisation is canonical and covers every field
+	require.Equal(t, cp.Bytes(), cp.Bytes())
+	require.Len(t, cp.Bytes(), len(cp.Root)+24)
+	require.True(t, bytes.HasPrefix(cp.Bytes(), cp.Root))
+	counted := cp
+	counted.LeafCount++
+	require.NotEqual(t, cp.Bytes(), counted.Bytes())
+	later := cp
+	later.Timestamp = later.Timestamp.Add(time.Nanosecond)
+	require.NotEqual(t, cp.Bytes(), later.Bytes())
+
+	// A tampered sum, another root or a count of no leaves is detected
+	tampered := cp
+	tampered.Sum++
+	require.False(t, VerifyCheckpoint(tampered, smst.Root(), smst.Spec()))
+	require.NotEqual(t, cp.Bytes(), tampered.Bytes())
+	empty := cp
+	empty.LeafCount = 0
+	require.False(t, VerifyCheckpoint(empty, smst.Root(), smst.Spec()))
+	require.NoError(t, smst.Delete([]byte("key0")))
+	require.False(t, VerifyCheckpoint(cp, smst.Root(), smst.Spec()))
+	require.False(t, VerifyCheckpoint(cp, cp.Root[1:], smst.Spec()))
+}
@@ -7,6 +7,64 @@ import (
 var (
 	// ErrBadProof is returned when an invalid Merkle proof is supplied.
 	ErrBadProof = errors.New("bad proof")
+	// ErrDeleteForbidden is returned when a leaf is removed from a trie
+	// created with WithAppendOnly.
+	ErrDeleteForbidden = errors.New("delete forbidden")
+	// ErrDuplicateKey is returned when a key, or the path of a key, appears
+	// more than once in a set of keys that must be distinct.
+	ErrDuplicateKey = errors.New("duplicate key")
+	// ErrKeyExists is returned when a key is moved to a key that is already
+	// present in the trie.
+	ErrKeyExists = errors.New("key exists")
+	// ErrKeyImmutable is returned when an existing key is updated in a trie
+	// created with WithAppendOnly.
+	ErrKeyImmutable = errors.New("key immutable")
 	// ErrKeyNotFound is returned when a key is not found in the tree.
 	ErrKeyNotFound = errors.New("key not found")
+	// ErrMalformedRoot is returned when a root cannot be parsed.
+	ErrMalformedRoot = errors.New("malformed root")
+	// ErrMalformedLeafData is returned when the leaf data of a proof is not
+	// structured as the data of a leaf.
+	ErrMalformedLeafData = errors.New("malformed leaf data")
+	// ErrMalformedProof is returned when a serialized proof cannot be
+	// unmarshaled.
+	ErrMalformedProof = errors.New("malformed proof")
+	// ErrMalformedSum is returned when the bytes of a sum are longer than the
+	// sum's encoding.
+	ErrMalformedSum = errors.New("malformed sum")
+	// ErrMalformedWAL is returned when a write-ahead log cannot be replayed.
+	ErrMalformedWAL = errors.New("malformed WAL")
+	// ErrKeysNotRetained is returned when an operation requires the original
+	// keys of the trie's leaves, which are not stored in the trie.
+	ErrKeysNotRetained = errors.New("original keys not retained")
+	// ErrSpecMismatch is returned when a proof is verified with a spec other
+	// than the one it was generated with.
+	ErrSpecMismatch = errors.New("spec mismatch")
+	// ErrMissingNode is returned when a node required to descend the trie is
+	// missing from its node store, such as after an incomplete import.
+	ErrMissingNode = errors.New("missing node")
+	// ErrNoCloserLeaf is returned when no leaf is closer to a path than the
+	// key claimed to be the closest.
+	ErrNoCloserLeaf = errors.New("no closer leaf")
+	// ErrRootPruned is returned when a root is queried whose nodes are no
+	// longer retained in the node store.
+	ErrRootPruned = errors.New("root pruned")
+	// ErrSumDecrease is returned when the sum of an existing key is decreased
+	// in a trie created with WithMonotonicSums.
+	ErrSumDecrease = errors.New("sum decrease")
+	// ErrSumOverflow is returned when the sums of many leaves are added up and
+	// their total overflows a uint64.
+	ErrSumOverflow = errors.New("sum overflow")
+	// ErrUnknownHasher is returned when a spec is requested for a hasher
+	// whose name is not known.
+	ErrUnknownHasher = errors.New("unknown hasher")
+	// ErrUnknownIteratorOrder is returned when an iterator is created with an
+	// unknown IteratorOrder.
+	ErrUnknownIteratorOrder = errors.New("unknown iterator order")
+	// ErrUnsupportedHashSize is the error a trie panics with when created with
+	// a hasher whose output size is outside of the supported bounds.
+	ErrUnsupportedHashSize = errors.New("unsupported hash size")
+	// ErrZeroSumNotAllowed is returned when a leaf is updated with a zero sum
+	// in a trie created with WithRejectZeroSum.
+	ErrZeroSumNotAllowed = errors.New("zero sum not allowed")
 )
@@ -0,0 +1,219 @@
+package smt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pokt-network/smt/kvstore"
+)
+
+// maxSnapshotBytesLen bounds the length of the digests and node preimages read
+// from a snapshot, guarding against allocations for corrupted lengths
+const maxSnapshotBytesLen = 1 << 24
+
+// ExportReachable writes a snapshot of the nodes reachable from the root
+// provided to w, such that the snapshot can be loaded into an empty node
+// store with ImportReachable to serve proofs for that root. Unlike copying the
+// node store, orphaned nodes and nodes of other roots are not included.
+//
+// The snapshot is encoded as the root followed by the digest and preimage of
+// each node, where every field is prefixed by its uvarint encoded length.
+func (smt *SMT) ExportReachable(root []byte, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if err := writeSnapshotBytes(bw, root); err != nil {
+		return err
+	}
+	empty := placeholder(smt.Spec())
+	stack := [][]byte{root}
+	for len(stack) > 0 {
+		digest := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if bytes.Equal(digest, empty) {
+			continue
+		}
+		data, err := smt.getNode(digest)
+		if err != nil {
+			return err
+		}
+		if err := writeSnapshotBytes(bw, digest); err != nil {
+			return err
+		}
+		if err := writeSnapshotBytes(bw, data); err != nil {
+			return err
+		}
+		stack = append(stack, smt.childDigests(data)...)
+	}
+	return bw.Flush()
+}
+
+// StorageSize returns the number of nodes reachable from the last committed
+// root and the total bytes they occupy in the node store, counting both the
+// digest each node is keyed by and its preimage. Uncommitted changes, orphaned
+// nodes and nodes retained for other roots are not included. Every reachable
+// node is read from the node store, so the cost is proportional to the size of
+// the trie.
+func (smt *SMT) StorageSize() (nodeCount int, totalBytes int64, err error) {
+	if smt.savedRoot == nil {
+		return 0, 0, nil
+	}
+	empty := placeholder(smt.Spec())
+	stack := [][]byte{smt.savedRoot}
+	for len(stack) > 0 {
+		digest := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if bytes.Equal(digest, empty) {
+			continue
+		}
+		data, err := smt.getNode(digest)
+		if err != nil {
+			return 0, 0, err
+		}
+		nodeCount++
+		totalBytes += int64(len(digest) + len(data))
+		stack = append(stack, smt.childDigests(data)...)
+	}
+	return nodeCount, totalBytes, nil
+}
+
+// forEachLeafProof walks the trie from left to right, calling fn with each leaf
+// and a proof of its inclusion identical to the one produced by prove. The
+// side nodes along the way are hashed once and shared by every leaf below
+// them, rather than being recomputed for each leaf.
+func (smt *SMT) forEachLeafProof(fn func(leaf *leafNode, proof *SparseMerkleProof) error) error {
+	// sideNodes holds the side nodes from the root downwards, with nil for
+	// the levels of extensions, and siblings the nodes they are the digests of
+	var sideNodes [][]byte
+	var siblings []trieNode
+	var walk func(node trieNode) error
+	walk = func(node trieNode) error {
+		node, err := smt.resolveLazy(node)
+		if err != nil || node == nil {
+			return err
+		}
+		switch n := node.(type) {
+		case *leafNode:
+			proof := &SparseMerkleProof{}
+			for i := len(sideNodes) - 1; i >= 0; i-- {
+				sideNode := sideNodes[i]
+				if sideNode == nil {
+					sideNode = hashNode(smt.Spec(), nil)
+				}
+				proof.SideNodes = append(proof.SideNodes, sideNode)
+			}
+			if len(siblings) > 0 && siblings[len(siblings)-1] != nil {
+				sib, err := smt.resolveLazy(siblings[len(siblings)-1])
+				if err != nil {
+					return err
+				}
+				proof.SiblingData = serialize(smt.Spec(), sib)
+			}
+			return fn(n, proof)
+		case *extensionNode:
+			for i := 0; i < n.length(); i++ {
+				sideNodes = append(sideNodes, nil)
+				siblings = append(siblings, nil)
+			}
+			err = walk(n.child)
+			sideNodes = sideNodes[:len(sideNodes)-n.length()]
+			siblings = siblings[:len(siblings)-n.length()]
+			return err
+		case *innerNode:
+			for _, children := range [2][2]trieNode{
+				{n.leftChild, n.rightChild},
+				{n.rightChild, n.leftChild},
+			} {
+				sideNodes = append(sideNodes, hashNode(smt.Spec(), children[1]))
+				siblings = append(siblings, children[1])
+				err = walk(children[0])
+				sideNodes = sideNodes[:len(sideNodes)-1]
+				siblings = siblings[:len(siblings)-1]
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(smt.trie)
+}
+
+// ImportReachable loads a snapshot written by ExportReachable into the node
+// store provided, returning the root of the snapshot. The nodes are stored as
+// they are read and are not verified against the root; a trie importing the
+// root from the store should be used with a spec matching that of the trie the
+// snapshot was exported from.
+func ImportReachable(r io.Reader, dst kvstore.MapStore) ([]byte, error) {
+	br := bufio.NewReader(r)
+	root, err := readSnapshotBytes(br)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		digest, err := readSnapshotBytes(br)
+		if errors.Is(err, io.EOF) {
+			return root, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := readSnapshotBytes(br)
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := dst.Set(digest, data); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// childDigests returns the digests of the children of the node serialised in
+// the data provided
+func (smt *SMT) childDigests(data []byte) [][]byte {
+	if isLeaf(data) {
+		return nil
+	}
+	if isExtension(data) {
+		var child []byte
+		if smt.sumTrie {
+			_, _, child, _ = parseSumExtension(data, smt.ph)
+		} else {
+			_, _, child = parseExtension(data, smt.ph)
+		}
+		return [][]byte{child}
+	}
+	var leftChild, rightChild []byte
+	if smt.sumTrie {
+		leftChild, rightChild = smt.th.parseSumNode(data)
+	} else {
+		leftChild, rightChild = smt.th.parseNode(data)
+	}
+	return [][]byte{leftChild, rightChild}
+}
+
+func writeSnapshotBytes(w io.Writer, data []byte) error {
+	field := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(data)), uint64(len(data)))
+	_, err := w.Write(append(field, data...))
+	return err
+}
+
+func readSnapshotBytes(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSnapshotBytesLen {
+		return nil, fmt.Errorf("invalid snapshot field length %d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,309 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pokt-network/smt/kvstore/simplemap"
+)
+
+func TestSMST_ExportImportReachable(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New())
+	for i := 0; i < 50; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	require.NoError(t, smst.Delete([]byte("0")))
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+
+	// Store the nodes of another trie alongside those of the trie exported
+	other := NewSparseMerkleSumTrie(snm, sha256.New())
+	for i := 0; i < 10; i++ {
+		key := []byte("other" + strconv.Itoa(i))
+		require.NoError(t, other.Update(key, key, uint64(i)))
+	}
+	require.NoError(t, other.Commit())
+	store := simplemap.NewSimpleMap()
+
+	var snapshot bytes.Buffer
+	require.NoError(t, smst.ExportReachable(root, &snapshot))
+	imported, err := ImportReachable(bytes.NewReader(snapshot.Bytes()), store)
+	require.NoError(t, err)
+	require.Equal(t, []byte(root), imported)
+
+	// Only the reachable nodes are exported, and the snapshot is complete as
+	// exporting it again from the imported store produces the same snapshot
+	require.Less(t, store.Len(), snm.Len())
+	var reexported bytes.Buffer
+	trie := ImportSparseMerkleSumTrie(store, sha256.New(), imported)
+	require.NoError(t, trie.ExportReachable(imported, &reexported))
+	require.Equal(t, snapshot.Bytes(), reexported.Bytes())
+
+	// Keys can be proven from the imported store
+	for i := 1; i < 50; i++ {
+		key := []byte(strconv.Itoa(i))
+		proof, err := trie.Prove(key)
+		require.NoError(t, err)
+		valid, err := VerifySumProof(proof, root, key, key, uint64(i), trie.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+	proof, err := trie.Prove([]byte("0"))
+	require.NoError(t, err)
+	valid, err := VerifySumProof(proof, root, []byte("0"), nil, 0, trie.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// The other trie is not served by the snapshot
+	otherTrie := ImportSparseMerkleSumTrie(store, sha256.New(), other.Root())
+	_, err = otherTrie.Prove([]byte("other0"))
+	require.Error(t, err)
+
+	// A truncated snapshot is rejected
+	_, err = ImportReachable(bytes.NewReader(snapshot.Bytes()[:snapshot.Len()-1]), simplemap.NewSimpleMap())
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// An empty trie exports only its root
+	empty := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	snapshot.Reset()
+	require.NoError(t, empty.ExportReachable(empty.Root(), &snapshot))
+	store = simplemap.NewSimpleMap()
+	imported, err = ImportReachable(&snapshot, store)
+	require.NoError(t, err)
+	require.Equal(t, []byte(empty.Root()), imported)
+	require.Zero(t, store.Len())
+}
+
+func TestSMST_StorageSize(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New())
+
+	// Nothing has been committed
+	nodes, size, err := smst.StorageSize()
+	require.NoError(t, err)
+	require.Zero(t, nodes)
+	require.Zero(t, size)
+
+	// A single leaf is stored under its digest: [hash]+[sum]
+	require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 1))
+	require.NoError(t, smst.Commit())
+	leafData, err := smst.GetLeafData([]byte("foo"))
+	require.NoError(t, err)
+	nodes, size, err = smst.StorageSize()
+	require.NoError(t, err)
+	require.Equal(t, 1, nodes)
+	require.Equal(t, int64(sha256.Size+sumSize+len(leafData)), size)
+
+	for i := 0; i < 50; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	require.NoError(t, smst.Commit())
+	nodes, size, err = smst.StorageSize()
+	require.NoError(t, err)
+	require.Equal(t, snm.Len(), nodes)
+
+	// Uncommitted changes are not counted
+	require.NoError(t, smst.Delete([]byte("foo")))
+	again, againSize, err := smst.StorageSize()
+	require.NoError(t, err)
+	require.Equal(t, nodes, again)
+	require.Equal(t, size, againSize)
+
+	// The orphans deleted on commit are no longer counted
+	require.NoError(t, smst.Commit())
+	nodes, size, err = smst.StorageSize()
+	require.NoError(t, err)
+	require.Equal(t, snm.Len(), nodes)
+	require.Less(t, size, againSize)
+}
+
+func TestSMST_ProveAllCompact(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+
+	// An empty trie has no leaves to prove
+	leaves, root, err := smst.ProveAllCompact()
+	require.NoError(t, err)
+	require.Empty(t, leaves)
+	require.Equal(t, []byte(smst.Root()), root)
+
+	keys := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+		keys[string(smst.ph.Path(key))] = key
+		// Prove some of the leaves from lazily loaded nodes
+		if i == 25 {
+			require.NoError(t, smst.Commit())
+		}
+	}
+	require.NoError(t, smst.Delete([]byte("0")))
+	delete(keys, string(smst.ph.Path([]byte("0"))))
+
+	leaves, root, err = smst.ProveAllCompact()
+	require.NoError(t, err)
+	require.Equal(t, []byte(smst.Root()), root)
+	require.Len(t, leaves, len(keys))
+	for i, leaf := range leaves {
+		if i > 0 {
+			require.Equal(t, -1, bytes.Compare(leaves[i-1].Path, leaf.Path))
+		}
+		valid, err := leaf.Verify(root, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+
+		// Each proof is the one produced by proving the leaf's key
+		key, ok := keys[string(leaf.Path)]
+		require.True(t, ok)
+		value, sum, err := smst.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, smst.digestValue(key), value)
+		require.Equal(t, sum, leaf.Sum)
+		proof, err := smst.Prove(key)
+		require.NoError(t, err)
+		compactProof, err := CompactProof(proof, smst.Spec())
+		require.NoError(t, err)
+		require.Equal(t, compactProof, leaf.Proof)
+
+		// A leaf with the wrong sum does not verify
+		leaf.Sum++
+		valid, err = leaf.Verify(root, smst.Spec())
+		require.NoError(t, err)
+		require.False(t, valid)
+	}
+
+	// ForEachProof stops at the first error returned
+	count := 0
+	errStop := errors.New("stop")
+	err = smst.ForEachProof(func(SyncedLeaf) error {
+		count++
+		if count == 10 {
+			return errStop
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, 10, count)
+}
+
+func TestSMST_ProveTopNSum(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	sums := map[string]uint64{"a": 5, "b": 40, "c": 12, "d": 40, "e": 7, "f": 30, "g": 1}
+	for key, sum := range sums {
+		require.NoError(t, smst.Update([]byte(key), []byte(key), sum))
+	}
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+
+	total, leaves, err := smst.ProveTopNSum(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(110), total)
+	require.Len(t, leaves, 3)
+	require.Equal(t, []uint64{40, 40, 30}, []uint64{leaves[0].Sum, leaves[1].Sum, leaves[2].Sum})
+	for _, leaf := range leaves {
+		valid, err := leaf.Verify(root, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+	require.Equal(t, smst.ph.Path([]byte("f")), leaves[2].Path)
+
+	// Asking for more leaves than the trie holds returns all of them
+	total, leaves, err = smst.ProveTopNSum(10)
+	require.NoError(t, err)
+	require.Equal(t, smst.Sum(), total)
+	require.Len(t, leaves, len(sums))
+
+	total, leaves, err = smst.ProveTopNSum(0)
+	require.NoError(t, err)
+	require.Zero(t, total)
+	require.Empty(t, leaves)
+}
+
+func TestSMST_VerifyExport(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+		// Every tenth leaf has a zero sum, so omitting it leaves the total intact
+		require.NoError(t, smst.Update(key, key, uint64(i%10)))
+	}
+	leaves, root, err := smst.ProveAllCompact()
+	require.NoError(t, err)
+	reusable := ReusableSpec(sha256.New, true)
+
+	for _, spec := range []*TrieSpec{smst.Spec(), reusable} {
+		valid, err := VerifyExport(leaves, root, spec)
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+
+	// Leaving out any leaf is detected, even one with a zero sum at either end
+	// of the export
+	for i, leaf := range leaves {
+		omitted := append(append([]SyncedLeaf{}, leaves[:i]...), leaves[i+1:]...)
+		valid, err := VerifyExport(omitted, root, reusable)
+		require.NoError(t, err)
+		require.False(t, valid, "leaf %d with sum %d omitted", i, leaf.Sum)
+	}
+
+	// Leaves must be in order, once each, with valid proofs
+	reordered := append([]SyncedLeaf{}, leaves...)
+	reordered[0], reordered[1] = reordered[1], reordered[0]
+	valid, err := VerifyExport(reordered, root, reusable)
+	require.NoError(t, err)
+	require.False(t, valid)
+	duplicated := append(append([]SyncedLeaf{}, leaves...), leaves[len(leaves)-1])
+	valid, err = VerifyExport(duplicated, root, reusable)
+	require.NoError(t, err)
+	require.False(t, valid)
+	tampered := append([]SyncedLeaf{}, leaves...)
+	tampered[10].Sum++
+	tampered[20].Sum--
+	valid, err = VerifyExport(tampered, root, reusable)
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// An empty export is only valid for an empty trie
+	empty := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	valid, err = VerifyExport(nil, empty.Root(), reusable)
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifyExport(nil, root, reusable)
+	require.NoError(t, err)
+	require.False(t, valid)
+	_, err = VerifyExport(leaves, root[1:], reusable)
+	require.ErrorIs(t, err, ErrMalformedRoot)
+}
+
+func BenchmarkVerifyExport(b *testing.B) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 10000; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(b, smst.Update(key, key, uint64(i)))
+	}
+	leaves, root, err := smst.ProveAllCompact()
+	require.NoError(b, err)
+	specs := []struct {
+		name string
+		spec *TrieSpec
+	}{
+		{"serial", smst.Spec()},
+		{"parallel", ReusableSpec(sha256.New, true)},
+	}
+	for _, tc := range specs {
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				valid, err := VerifyExport(leaves, root, tc.spec)
+				require.NoError(b, err)
+				require.True(b, valid)
+			}
+		})
+	}
+}
@@ -3,7 +3,18 @@ package smt
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"hash"
+	"sync"
+)
+
+const (
+	// minHashSize is the smallest hasher output size, in bytes, supported as
+	// it determines both the collision resistance of node digests and the
+	// depth of the trie
+	minHashSize = 16
+	// maxHashSize is the largest hasher output size, in bytes, supported
+	maxHashSize = 64
 )
 
 var (
@@ -14,6 +25,7 @@ var (
 
 var (
 	_ PathHasher  = (*pathHasher)(nil)
+	_ PathHasher  = (*saltedPathHasher)(nil)
 	_ ValueHasher = (*valueHasher)(nil)
 )
 
@@ -31,9 +43,47 @@ type ValueHasher interface {
 	HashValue([]byte) []byte
 }
 
+// ValueCodec defines a reversible encoding of value data into leaf data, used
+// in place of a ValueHasher when the original values must be recoverable from
+// the trie.
+type ValueCodec interface {
+	// Encode encodes value data to produce the data stored in a leaf node.
+	Encode(value []byte) ([]byte, error)
+	// Decode decodes the data stored in a leaf node to the original value.
+	Decode(leafData []byte) ([]byte, error)
+}
+
+// NodeSerializer defines the layout of the data hashed to compute the digest
+// of a node, used in place of its canonical encoding where a different layout
+// is required, such as a field element aligned layout for verifying proofs in
+// a zero knowledge circuit. Nodes are stored and included in proofs in their
+// canonical encoding regardless of the serializer:
+//   - leaf: [0]+[path]+[value hash] with the 8 byte sum appended in sum tries
+//   - inner: [1]+[left digest]+[right digest] with the 8 byte sum of the two
+//     appended in sum tries, where the digests are those of the child nodes
+type NodeSerializer interface {
+	// SerializeNode returns the data hashed for the node with the canonical
+	// encoding provided.
+	SerializeNode(encoding []byte) []byte
+}
+
 type trieHasher struct {
 	hasher    hash.Hash
 	zeroValue []byte
+	// zeroSumValue is the placeholder of sum tries, [zero hash]+[zero sum],
+	// precomputed as it is needed for every empty side node of a proof
+	zeroSumValue []byte
+	// pool, when set, provides the hashers used to compute digests so the
+	// trieHasher can be used concurrently
+	pool *sync.Pool
+	// sumFirst places the sum before the hash in sum trie digests, as in the
+	// legacy node layout: [sum]+[hash] instead of [hash]+[sum]
+	sumFirst bool
+	// ns, when set, serializes the canonical encoding of nodes before they
+	// are hashed
+	ns NodeSerializer
+	// size, when set, is the number of bytes node digests are truncated to
+	size int
 }
 type pathHasher struct {
 	trieHasher
@@ -43,11 +93,23 @@ type valueHasher struct {
 }
 
 func newTrieHasher(hasher hash.Hash) *trieHasher {
+	if size := hasher.Size(); size < minHashSize || size > maxHashSize {
+		panic(fmt.Errorf("%w: hasher size %d is not within [%d, %d] bytes", ErrUnsupportedHashSize, size, minHashSize, maxHashSize))
+	}
 	th := trieHasher{hasher: hasher}
 	th.zeroValue = make([]byte, th.hashSize())
+	th.zeroSumValue = make([]byte, th.hashSize()+sumSize)
 	return &th
 }
 
+// newPooledTrieHasher returns a trieHasher that draws a hasher from a pool of
+// hashers created by the function provided each time a digest is computed.
+func newPooledTrieHasher(newHasher func() hash.Hash) *trieHasher {
+	th := newTrieHasher(newHasher())
+	th.pool = &sync.Pool{New: func() any { return newHasher() }}
+	return th
+}
+
 // Path returns the digest of a key produced by the path hasher
 func (ph *pathHasher) Path(key []byte) []byte {
 	return ph.digest(key)[:ph.PathSize()]
@@ -59,41 +121,116 @@ func (ph *pathHasher) PathSize() int {
 	return ph.hasher.Size()
 }
 
+// saltedPathHasher is a PathHasher that prefixes keys with a secret salt
+// before hashing them with the PathHasher it wraps
+type saltedPathHasher struct {
+	PathHasher
+	salt []byte
+}
+
+// Path returns the path of the salted key produced by the wrapped PathHasher
+func (sph *saltedPathHasher) Path(key []byte) []byte {
+	salted := make([]byte, 0, len(sph.salt)+len(key))
+	salted = append(salted, sph.salt...)
+	return sph.PathHasher.Path(append(salted, key...))
+}
+
 func (vh *valueHasher) HashValue(data []byte) []byte {
 	return vh.digest(data)
 }
 
 func (th *trieHasher) digest(data []byte) []byte {
-	th.hasher.Write(data)
-	sum := th.hasher.Sum(nil)
-	th.hasher.Reset()
+	hasher := th.hasher
+	if th.pool != nil {
+		hasher = th.pool.Get().(hash.Hash)
+		defer th.pool.Put(hasher)
+	}
+	hasher.Write(data)
+	sum := hasher.Sum(nil)
+	hasher.Reset()
 	return sum
 }
 
+// nodeDigest returns the hash of the node with the canonical encoding
+// provided, serialized with the NodeSerializer if one is set
+func (th *trieHasher) nodeDigest(encoding []byte) []byte {
+	if th.ns == nil {
+		return th.truncate(th.digest(encoding))
+	}
+	return th.truncate(th.digest(th.ns.SerializeNode(encoding)))
+}
+
+// truncate truncates the digest provided to the size set by WithHashSize, if
+// any, sharing the digest's backing array
+func (th *trieHasher) truncate(digest []byte) []byte {
+	if th.size == 0 {
+		return digest
+	}
+	return digest[:th.size]
+}
+
+// setHashSize sets the size node digests are truncated to and recomputes the
+// placeholders, panicking with ErrUnsupportedHashSize if the size is below the
+// minimum supported or above the size of the hasher's digests
+func (th *trieHasher) setHashSize(size int) {
+	if size < minHashSize || size > th.hasher.Size() {
+		panic(fmt.Errorf("%w: hash size %d is not within [%d, %d] bytes", ErrUnsupportedHashSize, size, minHashSize, th.hasher.Size()))
+	}
+	th.size = size
+	th.zeroValue = make([]byte, size)
+	th.zeroSumValue = make([]byte, size+sumSize)
+}
+
 func (th *trieHasher) digestLeaf(path []byte, leafData []byte) ([]byte, []byte) {
 	value := encodeLeaf(path, leafData)
-	return th.digest(value), value
+	return th.nodeDigest(value), value
 }
 
 func (th *trieHasher) digestSumLeaf(path []byte, leafData []byte) ([]byte, []byte) {
 	value := encodeLeaf(path, leafData)
-	digest := th.digest(value)
-	digest = append(digest, value[len(value)-sumSize:]...)
+	digest := th.sumDigest(th.nodeDigest(value), value[len(value)-sumSize:])
 	return digest, value
 }
 
 func (th *trieHasher) digestNode(leftData []byte, rightData []byte) ([]byte, []byte) {
 	value := encodeInner(leftData, rightData)
-	return th.digest(value), value
+	return th.nodeDigest(value), value
 }
 
 func (th *trieHasher) digestSumNode(leftData []byte, rightData []byte) ([]byte, []byte) {
-	value := encodeSumInner(leftData, rightData)
-	digest := th.digest(value)
-	digest = append(digest, value[len(value)-sumSize:]...)
+	value := th.encodeSumInner(leftData, rightData)
+	digest := th.sumDigest(th.nodeDigest(value), value[len(value)-sumSize:])
 	return digest, value
 }
 
+// sumDigest joins the hash of a sum trie node with its sum to produce the
+// digest of the node: [hash]+[sum], or [sum]+[hash] for the legacy layout
+func (th *trieHasher) sumDigest(hash, sum []byte) []byte {
+	digest := make([]byte, 0, len(hash)+sumSize)
+	if th.sumFirst {
+		digest = append(digest, sum...)
+		return append(digest, hash...)
+	}
+	digest = append(digest, hash...)
+	return append(digest, sum...)
+}
+
+// digestHash returns the hash bytes of a sum trie node's digest
+func (th *trieHasher) digestHash(digest []byte) []byte {
+	if th.sumFirst {
+		return digest[sumSize:]
+	}
+	return digest[:len(digest)-sumSize]
+}
+
+// digestSum returns the sum bytes of a sum trie node's digest
+func (th *trieHasher) digestSum(digest []byte) []byte {
+	if th.sumFirst {
+		return digest[:sumSize]
+	}
+	return digest[len(digest)-sumSize:]
+}
+
 func (th *trieHasher) parseNode(data []byte) ([]byte, []byte) {
 	return data[len(innerPrefix) : th.hashSize()+len(innerPrefix)], data[len(innerPrefix)+th.hashSize():]
 }
@@ -104,6 +241,9 @@ func (th *trieHasher) parseSumNode(data []byte) ([]byte, []byte) {
 }
 
 func (th *trieHasher) hashSize() int {
+	if th.size != 0 {
+		return th.size
+	}
 	return th.hasher.Size()
 }
 
@@ -111,6 +251,12 @@ func (th *trieHasher) placeholder() []byte {
 	return th.zeroValue
 }
 
+// sumPlaceholder returns the placeholder of a sum trie, which is the same for
+// both node layouts as its hash and sum are both zero
+func (th *trieHasher) sumPlaceholder() []byte {
+	return th.zeroSumValue
+}
+
 func isLeaf(data []byte) bool {
 	return bytes.Equal(data[:len(leafPrefix)], leafPrefix)
 }
@@ -156,7 +302,7 @@ func encodeInner(leftData []byte, rightData []byte) []byte {
 	return value
 }
 
-func encodeSumInner(leftData []byte, rightData []byte) []byte {
+func (th *trieHasher) encodeSumInner(leftData []byte, rightData []byte) []byte {
 	value := make([]byte, 0, len(innerPrefix)+len(leftData)+len(rightData))
 	value = append(value, innerPrefix...)
 	value = append(value, leftData...)
@@ -164,8 +310,8 @@ func encodeSumInner(leftData []byte, rightData []byte) []byte {
 	var sum [sumSize]byte
 	leftSum := uint64(0)
 	rightSum := uint64(0)
-	leftSumBz := leftData[len(leftData)-sumSize:]
-	rightSumBz := rightData[len(rightData)-sumSize:]
+	leftSumBz := th.digestSum(leftData)
+	rightSumBz := th.digestSum(rightData)
 	if !bytes.Equal(leftSumBz, defaultSum[:]) {
 		leftSum = binary.BigEndian.Uint64(leftSumBz)
 	}
@@ -186,14 +332,14 @@ func encodeExtension(pathBounds [2]byte, path []byte, childData []byte) []byte {
 	return value
 }
 
-func encodeSumExtension(pathBounds [2]byte, path []byte, childData []byte) []byte {
+func (th *trieHasher) encodeSumExtension(pathBounds [2]byte, path []byte, childData []byte) []byte {
 	value := make([]byte, 0, len(extPrefix)+len(path)+2+len(childData))
 	value = append(value, extPrefix...)
 	value = append(value, pathBounds[:]...)
 	value = append(value, path...)
 	value = append(value, childData...)
 	var sum [sumSize]byte
-	copy(sum[:], childData[len(childData)-sumSize:])
+	copy(sum[:], th.digestSum(childData))
 	value = append(value, sum[:]...)
 	return value
 }
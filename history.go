@@ -0,0 +1,267 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// rootHistory retains the orphans of the most recent commits of a trie, so
+// that the nodes of the roots committed before them remain in the node store
+type rootHistory struct {
+	// roots committed prior to the current root, oldest first
+	roots [][]byte
+	// orphans of the commit that followed each of the roots
+	orphans []orphanNodes
+	// sequence number of the commit each retained orphan was orphaned by, an
+	// orphan is removed once its node is persisted again
+	orphanedBy map[string]int
+	commits    int
+}
+
+// expiredOrphans returns the orphans to delete on committing the orphan sets
+// provided, those no longer retained once the commit has replaced the trie's
+// saved root, as their root leaves the window set by WithRetainOrphansFor. The
+// history is left unchanged until retainOrphanSets records the commit.
+func (smt *SMT) expiredOrphans(sets []orphanNodes) []orphanNodes {
+	if smt.savedRoot == nil {
+		// Nothing was persisted before this commit
+		return sets
+	}
+	h := smt.history
+	if h == nil || len(h.roots) < smt.retainOrphans {
+		return nil
+	}
+	// Nodes persisted again or orphaned by a later commit, including this
+	// one, are kept
+	orphaned := make(map[string]bool)
+	for _, set := range sets {
+		for _, hash := range set {
+			orphaned[string(hash)] = true
+		}
+	}
+	oldest := h.commits - len(h.roots) + 1
+	var expired orphanNodes
+	for _, hash := range h.orphans[0] {
+		if h.orphanedBy[string(hash)] == oldest && !orphaned[string(hash)] {
+			expired = append(expired, hash)
+		}
+	}
+	return []orphanNodes{expired}
+}
+
+// retainOrphanSets records the orphan sets provided as those of the commit
+// that replaced the trie's saved root, which must be set, once the commit has
+// succeeded, dropping the oldest root from the history if it has left the
+// window
+func (smt *SMT) retainOrphanSets(sets []orphanNodes) {
+	if smt.history == nil {
+		smt.history = &rootHistory{orphanedBy: make(map[string]int)}
+	}
+	h := smt.history
+	h.commits++
+	var orphans orphanNodes
+	for _, set := range sets {
+		for _, hash := range set {
+			orphans = append(orphans, hash)
+			h.orphanedBy[string(hash)] = h.commits
+		}
+	}
+	h.roots = append(h.roots, smt.savedRoot)
+	h.orphans = append(h.orphans, orphans)
+	if len(h.roots) <= smt.retainOrphans {
+		return
+	}
+	oldest := h.commits - len(h.roots) + 1
+	for _, hash := range h.orphans[0] {
+		if h.orphanedBy[string(hash)] == oldest {
+			delete(h.orphanedBy, string(hash))
+		}
+	}
+	h.roots, h.orphans = h.roots[1:], h.orphans[1:]
+}
+
+// unorphan stops retaining the node with the digest provided as an orphan,
+// as it has been persisted again
+func (h *rootHistory) unorphan(hash []byte) {
+	delete(h.orphanedBy, string(hash))
+}
+
+// AtRoot returns a trie at the root provided, which must be the last root
+// committed or one of the roots before it retained by WithRetainOrphansFor,
+// otherwise ErrRootPruned is returned. The history of roots is held in memory
+// and is not carried over by ImportSparseMerkleTrie.
+// NOTE: The returned trie shares the node store and must only be read from,
+// committing it would delete nodes of the trie it was returned from.
+func (smt *SMT) AtRoot(root []byte) (*SMT, error) {
+	if !smt.isRetainedRoot(root) {
+		return nil, ErrRootPruned
+	}
+	return &SMT{
+		TrieSpec:  smt.TrieSpec,
+		nodes:     smt.nodes,
+		savedRoot: root,
+		trie:      &lazyNode{root},
+	}, nil
+}
+
+// isRetainedRoot returns whether the nodes of the root provided are retained
+// in the node store
+func (smt *SMT) isRetainedRoot(root []byte) bool {
+	if smt.savedRoot != nil && bytes.Equal(root, smt.savedRoot) {
+		return true
+	}
+	if smt.history == nil {
+		return false
+	}
+	for _, retained := range smt.history.roots {
+		if bytes.Equal(root, retained) {
+			return true
+		}
+	}
+	return false
+}
+
+// ChangedKey is a leaf whose value or sum differs between two roots of a sum
+// trie. Tries do not retain the original keys of their leaves, so the leaf is
+// identified by its path. The value hashes exclude the sum, and are nil on the
+// side of the change where the leaf is absent.
+type ChangedKey struct {
+	Path         []byte
+	OldValueHash []byte
+	NewValueHash []byte
+	OldSum       uint64
+	NewSum       uint64
+}
+
+// Added returns whether the leaf is only present at the new root
+func (c ChangedKey) Added() bool { return c.OldValueHash == nil }
+
+// Removed returns whether the leaf is only present at the old root
+func (c ChangedKey) Removed() bool { return c.NewValueHash == nil }
+
+// ChangedKeys returns the leaves whose value or sum differs between the old
+// and new roots provided, in path order, covering leaves added, removed and
+// modified. Subtries with equal digests at both roots are skipped, so only the
+// nodes along the changes are loaded. Both roots must be retained, see
+// AtRoot, otherwise ErrRootPruned is returned.
+func (smst *SMST) ChangedKeys(oldRoot, newRoot []byte) ([]ChangedKey, error) {
+	oldTrie, err := smst.SMT.AtRoot(oldRoot)
+	if err != nil {
+		return nil, err
+	}
+	newTrie, err := smst.SMT.AtRoot(newRoot)
+	if err != nil {
+		return nil, err
+	}
+	return smst.changedKeys(oldTrie.trie, newTrie.trie)
+}
+
+// changedKeys returns the leaves whose value or sum differs between the old
+// and new subtries provided, in path order
+func (smst *SMST) changedKeys(oldTrie, newTrie trieNode) ([]ChangedKey, error) {
+	var changes []ChangedKey
+	err := smst.diffLeaves(oldTrie, newTrie, func(oldLeaf, newLeaf *leafNode) {
+		var change ChangedKey
+		if oldLeaf != nil {
+			change.Path = oldLeaf.path
+			change.OldValueHash, change.OldSum = splitSumLeafValue(oldLeaf.valueHash)
+		}
+		if newLeaf != nil {
+			change.Path = newLeaf.path
+			change.NewValueHash, change.NewSum = splitSumLeafValue(newLeaf.valueHash)
+		}
+		change.Path = bytes.Clone(change.Path)
+		changes = append(changes, change)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// splitSumLeafValue splits the value hash of a sum trie leaf into a copy of
+// the value hash without the sum, and the sum
+func splitSumLeafValue(valueHash []byte) ([]byte, uint64) {
+	return bytes.Clone(valueHash[:len(valueHash)-sumSize]), binary.BigEndian.Uint64(valueHash[len(valueHash)-sumSize:])
+}
+
+// diffLeaves calls fn, in path order, with each pair of leaves at the same path
+// that differ between the subtries provided, where the leaf absent from one of
+// them is nil. Subtries with equal digests are skipped.
+func (smt *SMT) diffLeaves(a, b trieNode, fn func(a, b *leafNode)) error {
+	if bytes.Equal(hashNode(smt.Spec(), a), hashNode(smt.Spec(), b)) {
+		return nil
+	}
+	var err error
+	if a, err = smt.resolveLazy(a); err != nil {
+		return err
+	}
+	if b, err = smt.resolveLazy(b); err != nil {
+		return err
+	}
+	if ext, ok := a.(*extensionNode); ok {
+		a = ext.expand()
+	}
+	if ext, ok := b.(*extensionNode); ok {
+		b = ext.expand()
+	}
+	innerA, okA := a.(*innerNode)
+	innerB, okB := b.(*innerNode)
+	if okA && okB {
+		if err := smt.diffLeaves(innerA.leftChild, innerB.leftChild, fn); err != nil {
+			return err
+		}
+		return smt.diffLeaves(innerA.rightChild, innerB.rightChild, fn)
+	}
+	// One of the subtries holds at most a single leaf, so the leaves of both
+	// are compared directly
+	leavesA, err := smt.subtrieLeaves(a)
+	if err != nil {
+		return err
+	}
+	leavesB, err := smt.subtrieLeaves(b)
+	if err != nil {
+		return err
+	}
+	for len(leavesA) > 0 || len(leavesB) > 0 {
+		switch {
+		case len(leavesB) == 0 || len(leavesA) > 0 && bytes.Compare(leavesA[0].path, leavesB[0].path) < 0:
+			fn(leavesA[0], nil)
+			leavesA = leavesA[1:]
+		case len(leavesA) == 0 || bytes.Compare(leavesA[0].path, leavesB[0].path) > 0:
+			fn(nil, leavesB[0])
+			leavesB = leavesB[1:]
+		default:
+			if !bytes.Equal(leavesA[0].valueHash, leavesB[0].valueHash) {
+				fn(leavesA[0], leavesB[0])
+			}
+			leavesA, leavesB = leavesA[1:], leavesB[1:]
+		}
+	}
+	return nil
+}
+
+// subtrieLeaves returns the leaves of the subtrie provided in path order
+func (smt *SMT) subtrieLeaves(node trieNode) ([]*leafNode, error) {
+	node, err := smt.resolveLazy(node)
+	if err != nil {
+		return nil, err
+	}
+	switch n := node.(type) {
+	case *leafNode:
+		return []*leafNode{n}, nil
+	case *extensionNode:
+		return smt.subtrieLeaves(n.child)
+	case *innerNode:
+		leaves, err := smt.subtrieLeaves(n.leftChild)
+		if err != nil {
+			return nil, err
+		}
+		right, err := smt.subtrieLeaves(n.rightChild)
+		if err != nil {
+			return nil, err
+		}
+		return append(leaves, right...), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,312 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pokt-network/smt/kvstore/simplemap"
+)
+
+func TestSMST_RetainOrphansFor(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New(), WithRetainOrphansFor(2))
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, smst.Update(key, key, 1))
+	}
+	var roots []MerkleRoot
+	for i := uint64(1); i <= 4; i++ {
+		require.NoError(t, smst.Update([]byte("key0"), []byte("key0"), i))
+		require.NoError(t, smst.Delete([]byte(fmt.Sprintf("key%d", i))))
+		root, err := smst.CommitRoot()
+		require.NoError(t, err)
+		roots = append(roots, root)
+	}
+
+	// The current root and the two before it are queryable
+	for i, root := range roots[1:] {
+		snapshot, err := smst.AtRoot(root)
+		require.NoError(t, err)
+		require.Equal(t, root, snapshot.Root())
+		_, sum, err := snapshot.Get([]byte("key0"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i+2), sum)
+		proof, err := snapshot.Prove([]byte("key0"))
+		require.NoError(t, err)
+		valid, err := VerifySumProof(proof, root, []byte("key0"), []byte("key0"), uint64(i+2), smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+
+	// Older roots have been pruned
+	_, err := smst.AtRoot(roots[0])
+	require.ErrorIs(t, err, ErrRootPruned)
+	_, err = smst.AtRoot([]byte("unknown root"))
+	require.ErrorIs(t, err, ErrRootPruned)
+	_, _, err = ImportSparseMerkleSumTrie(snm, sha256.New(), roots[0]).Get([]byte("key0"))
+	require.ErrorIs(t, err, ErrMissingNode)
+
+	// Nodes persisted again after being orphaned are not pruned
+	require.NoError(t, smst.Update([]byte("key0"), []byte("key0"), 3))
+	require.NoError(t, smst.Commit())
+	for i := 0; i < 3; i++ {
+		require.NoError(t, smst.Update([]byte("key9"), []byte("key9"), uint64(i+10)))
+		require.NoError(t, smst.Commit())
+	}
+	imported := ImportSparseMerkleSumTrie(snm, sha256.New(), smst.Root())
+	_, sum, err := imported.Get([]byte("key0"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), sum)
+	for i := 5; i < 10; i++ {
+		_, sum, err := imported.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		require.NotZero(t, sum)
+	}
+
+	// Orphans are deleted once out of the window, so the node store matches
+	// a trie committed with the same history without any retention
+	plain := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, plain.Update([]byte("key0"), []byte("key0"), 3))
+	for i := 5; i < 9; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, plain.Update(key, key, 1))
+	}
+	require.NoError(t, plain.Update([]byte("key9"), []byte("key9"), 12))
+	require.NoError(t, plain.Commit())
+	require.Equal(t, plain.Root(), smst.Root())
+	require.Greater(t, snm.Len(), plain.nodes.Len())
+	require.LessOrEqual(t, snm.Len(), 3*plain.nodes.Len())
+}
+
+func TestSMST_RetainOrphansFor_FailedCommit(t *testing.T) {
+	store := &failingBatchStore{MapStore: simplemap.NewSimpleMap()}
+	smst := NewSparseMerkleSumTrie(store, sha256.New(), WithRetainOrphansFor(1))
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, smst.Update(key, key, 1))
+	}
+	first, err := smst.CommitRoot()
+	require.NoError(t, err)
+
+	// A failed commit does not change the history, so the retried commit
+	// retains the root before it
+	require.NoError(t, smst.Update([]byte("key0"), []byte("key0"), 2))
+	require.NoError(t, smst.Delete([]byte("key1")))
+	store.fail = true
+	require.Error(t, smst.Commit())
+	store.fail = false
+	second, err := smst.CommitRoot()
+	require.NoError(t, err)
+	for i, root := range []MerkleRoot{first, second} {
+		snapshot, err := smst.AtRoot(root)
+		require.NoError(t, err)
+		_, sum, err := snapshot.Get([]byte("key0"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i+1), sum)
+	}
+
+	// The root is pruned by the next commit, as if no commit had failed
+	require.NoError(t, smst.Update([]byte("key0"), []byte("key0"), 3))
+	store.fail = true
+	require.Error(t, smst.Commit())
+	store.fail = false
+	require.NoError(t, smst.Commit())
+	_, err = smst.AtRoot(first)
+	require.ErrorIs(t, err, ErrRootPruned)
+	_, _, err = ImportSparseMerkleSumTrie(store, sha256.New(), first).Get([]byte("key1"))
+	require.ErrorIs(t, err, ErrMissingNode)
+	snapshot, err := smst.AtRoot(second)
+	require.NoError(t, err)
+	_, sum, err := snapshot.Get([]byte("key0"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), sum)
+}
+
+func TestSMST_RetainOrphansFor_Default(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("key"), []byte("value"), 1))
+	first, err := smst.CommitRoot()
+	require.NoError(t, err)
+	require.NoError(t, smst.Update([]byte("key"), []byte("value"), 2))
+	second, err := smst.CommitRoot()
+	require.NoError(t, err)
+
+	// Only the last committed root is retained by default
+	_, err = smst.AtRoot(second)
+	require.NoError(t, err)
+	_, err = smst.AtRoot(first)
+	require.ErrorIs(t, err, ErrRootPruned)
+}
+
+func TestSMST_ChangedKeys(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithRetainOrphansFor(3))
+	// leaves models the leaves of the trie at each root, by path
+	type leaf struct {
+		valueHash []byte
+		sum       uint64
+	}
+	leaves := make(map[string]leaf)
+	update := func(key string, value string, sum uint64) {
+		require.NoError(t, smst.Update([]byte(key), []byte(value), sum))
+		leaves[string(smst.ph.Path([]byte(key)))] = leaf{smst.digestValue([]byte(value)), sum}
+	}
+	remove := func(key string) {
+		require.NoError(t, smst.Delete([]byte(key)))
+		delete(leaves, string(smst.ph.Path([]byte(key))))
+	}
+	var roots []MerkleRoot
+	var models []map[string]leaf
+	commit := func() {
+		root, err := smst.CommitRoot()
+		require.NoError(t, err)
+		model := make(map[string]leaf, len(leaves))
+		for path, l := range leaves {
+			model[path] = l
+		}
+		roots, models = append(roots, root), append(models, model)
+	}
+
+	for i := 0; i < 40; i++ {
+		update(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), uint64(i))
+	}
+	commit()
+	// Leaves added, removed, with a changed value and with a changed sum
+	update("added1", "added", 1)
+	update("added2", "added", 2)
+	remove("key3")
+	remove("key4")
+	update("key5", "changed", 5)
+	update("key6", "value6", 60)
+	commit()
+	// Every leaf but one removed, leaving a single leaf at the root
+	for i := 0; i < 40; i++ {
+		if key := fmt.Sprintf("key%d", i); i != 7 && i != 3 && i != 4 {
+			remove(key)
+		}
+	}
+	remove("added1")
+	remove("added2")
+	commit()
+
+	for i := range roots {
+		for j := range roots {
+			changes, err := smst.ChangedKeys(roots[i], roots[j])
+			require.NoError(t, err)
+			if i == j {
+				require.Empty(t, changes)
+				continue
+			}
+			// The changes match those between the models of both roots
+			expected := 0
+			for path, oldLeaf := range models[i] {
+				if newLeaf, ok := models[j][path]; !ok || oldLeaf.sum != newLeaf.sum || !bytes.Equal(oldLeaf.valueHash, newLeaf.valueHash) {
+					expected++
+				}
+			}
+			for path := range models[j] {
+				if _, ok := models[i][path]; !ok {
+					expected++
+				}
+			}
+			require.Len(t, changes, expected)
+			for k, change := range changes {
+				if k > 0 {
+					require.Equal(t, -1, bytes.Compare(changes[k-1].Path, change.Path))
+				}
+				oldLeaf, inOld := models[i][string(change.Path)]
+				newLeaf, inNew := models[j][string(change.Path)]
+				require.Equal(t, !inOld, change.Added())
+				require.Equal(t, !inNew, change.Removed())
+				if inOld {
+					require.Equal(t, oldLeaf.valueHash, change.OldValueHash)
+					require.Equal(t, oldLeaf.sum, change.OldSum)
+				}
+				if inNew {
+					require.Equal(t, newLeaf.valueHash, change.NewValueHash)
+					require.Equal(t, newLeaf.sum, change.NewSum)
+				}
+			}
+		}
+	}
+
+	// The roots must be retained
+	for i := 0; i < 3; i++ {
+		update("key7", "value7", uint64(100+i))
+		commit()
+	}
+	_, err := smst.ChangedKeys(roots[0], smst.Root())
+	require.ErrorIs(t, err, ErrRootPruned)
+	_, err = smst.ChangedKeys(smst.Root(), roots[0])
+	require.ErrorIs(t, err, ErrRootPruned)
+}
+
+func TestSMST_CommitHook(t *testing.T) {
+	var calls [][]LeafChange
+	var errHook error
+	hook := func(changes []LeafChange) error {
+		calls = append(calls, changes)
+		return errHook
+	}
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New(), WithCommitHook(hook))
+	for i := 0; i < 5; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+
+	// The first commit reports every leaf as added
+	require.NoError(t, smst.Commit())
+	require.Len(t, calls, 1)
+	require.Len(t, calls[0], 5)
+	for _, change := range calls[0] {
+		require.True(t, change.Added())
+	}
+	committed := smst.Root()
+
+	// A failing hook aborts the commit, leaving the store at the last root
+	require.NoError(t, smst.Update([]byte("key1"), []byte("new"), 10))
+	require.NoError(t, smst.Delete([]byte("key2")))
+	require.NoError(t, smst.Update([]byte("key5"), []byte("key5"), 5))
+	errHook = fmt.Errorf("index unavailable")
+	nodes := snm.Len()
+	require.ErrorIs(t, smst.Commit(), errHook)
+	require.Len(t, calls, 2)
+	require.Equal(t, nodes, snm.Len())
+	imported := ImportSparseMerkleSumTrie(snm, sha256.New(), committed)
+	_, sum, err := imported.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), sum)
+	_, err = smst.AtRoot(smst.Root())
+	require.ErrorIs(t, err, ErrRootPruned)
+
+	// The next commit reports the same changes
+	errHook = nil
+	require.NoError(t, smst.Commit())
+	require.Len(t, calls, 3)
+	require.Equal(t, calls[1], calls[2])
+	changes := calls[2]
+	require.Len(t, changes, 3)
+	for _, change := range changes {
+		switch {
+		case bytes.Equal(change.Path, smst.ph.Path([]byte("key1"))):
+			require.Equal(t, smst.digestValue([]byte("new")), change.NewValueHash)
+			require.Equal(t, uint64(1), change.OldSum)
+			require.Equal(t, uint64(10), change.NewSum)
+		case bytes.Equal(change.Path, smst.ph.Path([]byte("key2"))):
+			require.True(t, change.Removed())
+		default:
+			require.Equal(t, smst.ph.Path([]byte("key5")), change.Path)
+			require.True(t, change.Added())
+		}
+	}
+
+	// Commits without changed leaves do not call the hook
+	require.NoError(t, smst.Commit())
+	require.NoError(t, smst.Update([]byte("key1"), []byte("new"), 10))
+	require.NoError(t, smst.Commit())
+	require.Len(t, calls, 3)
+}
@@ -0,0 +1,106 @@
+package smt
+
+// IteratorOrder is the order in which a LeafIterator yields the leaves of a
+// trie
+type IteratorOrder int
+
+const (
+	// PathAsc yields leaves by path in ascending order, matching the
+	// structure of the trie from left to right
+	PathAsc IteratorOrder = iota
+	// PathDesc yields leaves by path in descending order
+	PathDesc
+	// KeyAsc yields leaves by their original key in ascending order. This
+	// requires the trie to retain the original keys of its leaves, which it
+	// does not, so iterators with this order cannot be created.
+	KeyAsc
+)
+
+// IteratorOptions configures a LeafIterator
+type IteratorOptions struct {
+	// Order is the order the leaves are yielded in, PathAsc by default
+	Order IteratorOrder
+}
+
+// LeafIterator iterates over the leaves of a trie, yielding each leaf exactly
+// once. The trie must not be modified while it is being iterated over.
+type LeafIterator struct {
+	smt   *SMT
+	desc  bool
+	stack []trieNode
+	leaf  *leafNode
+	err   error
+}
+
+// NewLeafIterator returns an iterator over the leaves of the trie in the order
+// given by the options provided. ErrKeysNotRetained is returned for KeyAsc.
+func (smt *SMT) NewLeafIterator(opts IteratorOptions) (*LeafIterator, error) {
+	switch opts.Order {
+	case PathAsc, PathDesc:
+	case KeyAsc:
+		return nil, ErrKeysNotRetained
+	default:
+		return nil, ErrUnknownIteratorOrder
+	}
+	it := &LeafIterator{smt: smt, desc: opts.Order == PathDesc}
+	if smt.trie != nil {
+		it.stack = append(it.stack, smt.trie)
+	}
+	return it, nil
+}
+
+// Next advances the iterator to the next leaf, returning false once all of
+// the leaves have been yielded or an error has occurred (see Err)
+func (it *LeafIterator) Next() bool {
+	it.leaf = nil
+	for len(it.stack) > 0 && it.err == nil {
+		node := it.stack[len(it.stack)-1]
+		it.stack = it.stack[:len(it.stack)-1]
+		node, it.err = it.smt.resolveLazy(node)
+		if it.err != nil {
+			return false
+		}
+		switch n := node.(type) {
+		case *leafNode:
+			it.leaf = n
+			return true
+		case *extensionNode:
+			it.stack = append(it.stack, n.child)
+		case *innerNode:
+			// The child to be yielded first is pushed last
+			first, second := n.leftChild, n.rightChild
+			if it.desc {
+				first, second = second, first
+			}
+			if second != nil {
+				it.stack = append(it.stack, second)
+			}
+			if first != nil {
+				it.stack = append(it.stack, first)
+			}
+		}
+	}
+	return false
+}
+
+// Path returns the path of the current leaf
+func (it *LeafIterator) Path() []byte {
+	if it.leaf == nil {
+		return nil
+	}
+	return it.leaf.path
+}
+
+// ValueHash returns the value hash stored in the current leaf, which for a
+// sum trie has the sum of the leaf appended to it
+func (it *LeafIterator) ValueHash() []byte {
+	if it.leaf == nil {
+		return nil
+	}
+	return it.leaf.valueHash
+}
+
+// Err returns the error encountered during iteration, if any
+func (it *LeafIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,78 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pokt-network/smt/kvstore/simplemap"
+)
+
+func TestSMST_LeafIterator_Order(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New())
+	paths := make([][]byte, 0, 50)
+	sums := make(map[string]uint64, 50)
+	for i := 0; i < 50; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+		paths = append(paths, smst.ph.Path(key))
+		sums[string(smst.ph.Path(key))] = uint64(i)
+	}
+	require.NoError(t, smst.Delete([]byte("7")))
+	paths = append(paths[:7], paths[8:]...)
+	sort.Slice(paths, func(i, j int) bool { return bytes.Compare(paths[i], paths[j]) < 0 })
+	require.NoError(t, smst.Commit())
+
+	collect := func(trie *SMST, order IteratorOrder) [][]byte {
+		t.Helper()
+		it, err := trie.NewLeafIterator(IteratorOptions{Order: order})
+		require.NoError(t, err)
+		var yielded [][]byte
+		for it.Next() {
+			yielded = append(yielded, it.Path())
+			valueHash := it.ValueHash()
+			require.Len(t, valueHash, sha256.Size+sumSize)
+			require.Equal(t, sums[string(it.Path())], binary.BigEndian.Uint64(valueHash[sha256.Size:]))
+		}
+		require.NoError(t, it.Err())
+		require.False(t, it.Next())
+		require.Nil(t, it.Path())
+		return yielded
+	}
+
+	// Ascending and descending path orders, each leaf yielded exactly once
+	require.Equal(t, paths, collect(smst, PathAsc))
+	descending := make([][]byte, len(paths))
+	for i, path := range paths {
+		descending[len(paths)-1-i] = path
+	}
+	require.Equal(t, descending, collect(smst, PathDesc))
+
+	// The default order is ascending
+	it, err := smst.NewLeafIterator(IteratorOptions{})
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	require.Equal(t, paths[0], it.Path())
+
+	// Lazily loaded nodes are resolved during iteration
+	imported := ImportSparseMerkleSumTrie(snm, sha256.New(), smst.Root())
+	require.Equal(t, paths, collect(imported, PathAsc))
+	require.Equal(t, descending, collect(imported, PathDesc))
+
+	// Original keys are not retained so cannot be ordered by
+	_, err = smst.NewLeafIterator(IteratorOptions{Order: KeyAsc})
+	require.ErrorIs(t, err, ErrKeysNotRetained)
+	_, err = smst.NewLeafIterator(IteratorOptions{Order: KeyAsc + 1})
+	require.ErrorIs(t, err, ErrUnknownIteratorOrder)
+
+	// An empty trie yields no leaves
+	empty := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.Empty(t, collect(empty, PathAsc))
+	require.Empty(t, collect(empty, PathDesc))
+}
@@ -0,0 +1,9 @@
+package kvstore
+
+import "errors"
+
+// ErrKeyNotFound is returned, or wrapped, by the Get method of a MapStore when
+// the key provided is not present in the store. A trie reading a node that is
+// missing from its node store distinguishes this error, as it does a nil value,
+// from other errors of the store.
+var ErrKeyNotFound = errors.New("key not found")
@@ -20,3 +20,33 @@ type MapStore interface {
 	// ClearAll deletes all key-value pairs in the store
 	ClearAll() error
 }
+
+// BatchStore is a MapStore that can apply many writes in a single operation,
+// such as a single round trip to a remote store. When the node store of a
+// trie is a BatchStore, all the writes of a commit are applied with one call
+// to Batch rather than a call to Set or Delete for each node.
+type BatchStore interface {
+	MapStore
+	// Batch applies the writes provided in order
+	Batch(ops []BatchOp) error
+}
+
+// BatchOp is a single write applied by a BatchStore: either setting Key to
+// Value or, if Delete is set, removing Key.
+type BatchOp struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// PreallocatingStore is a MapStore that can reserve capacity ahead of a large
+// number of writes. Before writing the nodes of a commit a trie whose node
+// store is a PreallocatingStore calls Preallocate with the number of nodes it
+// is about to write. The number is only a hint, which stores not implementing
+// the interface do without.
+type PreallocatingStore interface {
+	MapStore
+	// Preallocate reserves capacity for the number of additional key-value
+	// pairs provided
+	Preallocate(expectedKeys int)
+}
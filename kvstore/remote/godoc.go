@@ -0,0 +1,6 @@
+// Package remote provides a MapStore served over RPC, so that tries on many
+// hosts, such as stateless proof-serving front-ends, can share a single node
+// store. The service is defined by the methods of Service and uses the
+// standard library's net/rpc, and the client batches the writes of each
+// commit into a single call.
+package remote
@@ -0,0 +1,169 @@
+package remote
+
+import (
+	"errors"
+	"net/rpc"
+
+	"github.com/pokt-network/smt/kvstore"
+)
+
+// serviceName is the name the Service is registered under
+const serviceName = "MapStore"
+
+// Ensure the remote store can be used as an SMT node store that batches the
+// writes of each commit
+var _ kvstore.BatchStore = (*remoteStore)(nil)
+
+// KeyArgs are the arguments of the Get and Delete calls
+type KeyArgs struct {
+	Key []byte
+}
+
+// SetArgs are the arguments of the Set call
+type SetArgs struct {
+	Key   []byte
+	Value []byte
+}
+
+// BatchArgs are the arguments of the Batch call
+type BatchArgs struct {
+	Ops []kvstore.BatchOp
+}
+
+// ValueReply is the reply to the Get call
+type ValueReply struct {
+	Value []byte
+}
+
+// LenReply is the reply to the Len call
+type LenReply struct {
+	Len int
+}
+
+// Empty is the arguments or reply of calls that have none
+type Empty struct{}
+
+// Service serves the MapStore it wraps over RPC. Each of its methods is a
+// call of the service, named after the corresponding method of the MapStore.
+type Service struct {
+	store kvstore.MapStore
+}
+
+// NewServer returns an RPC server serving the MapStore provided, which can
+// accept connections with Accept or ServeConn, or be served over HTTP.
+func NewServer(store kvstore.MapStore) (*rpc.Server, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName(serviceName, &Service{store: store}); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// Get returns the value for a given key
+func (s *Service) Get(args *KeyArgs, reply *ValueReply) (err error) {
+	reply.Value, err = s.store.Get(args.Key)
+	if errors.Is(err, kvstore.ErrKeyNotFound) {
+		// Only the message of an error is sent, so that of a key not being
+		// found is made recognisable by the client
+		return kvstore.ErrKeyNotFound
+	}
+	return err
+}
+
+// Set sets/updates the value for a given key
+func (s *Service) Set(args *SetArgs, _ *Empty) error {
+	return s.store.Set(args.Key, args.Value)
+}
+
+// Delete removes a key
+func (s *Service) Delete(args *KeyArgs, _ *Empty) error {
+	return s.store.Delete(args.Key)
+}
+
+// Batch applies the writes provided in order, using the Batch method of the
+// store if it is a kvstore.BatchStore
+func (s *Service) Batch(args *BatchArgs, _ *Empty) error {
+	if batch, ok := s.store.(kvstore.BatchStore); ok {
+		return batch.Batch(args.Ops)
+	}
+	for _, op := range args.Ops {
+		var err error
+		if op.Delete {
+			err = s.store.Delete(op.Key)
+		} else {
+			err = s.store.Set(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of key-value pairs in the store
+func (s *Service) Len(_ *Empty, reply *LenReply) error {
+	reply.Len = s.store.Len()
+	return nil
+}
+
+// ClearAll deletes all key-value pairs in the store
+func (s *Service) ClearAll(_ *Empty, _ *Empty) error {
+	return s.store.ClearAll()
+}
+
+// remoteStore is a MapStore whose operations are calls to a Service
+type remoteStore struct {
+	client *rpc.Client
+}
+
+// NewRemoteStore returns a MapStore backed by the Service the client provided
+// is connected to. Errors returned by the remote store are returned as an
+// rpc.ServerError holding their message, except for a key not being found by
+// Get, which is returned as kvstore.ErrKeyNotFound. The client remains owned by the
+// caller, who must close it once the store is no longer used.
+func NewRemoteStore(client *rpc.Client) kvstore.BatchStore {
+	return &remoteStore{client: client}
+}
+
+// Get gets the value for a key.
+func (rs *remoteStore) Get(key []byte) ([]byte, error) {
+	var reply ValueReply
+	if err := rs.client.Call(serviceName+".Get", &KeyArgs{Key: key}, &reply); err != nil {
+		if err == rpc.ServerError(kvstore.ErrKeyNotFound.Error()) {
+			return nil, kvstore.ErrKeyNotFound
+		}
+		return nil, err
+	}
+	return reply.Value, nil
+}
+
+// Set updates the value for a key.
+func (rs *remoteStore) Set(key, value []byte) error {
+	return rs.client.Call(serviceName+".Set", &SetArgs{Key: key, Value: value}, &Empty{})
+}
+
+// Delete deletes a key.
+func (rs *remoteStore) Delete(key []byte) error {
+	return rs.client.Call(serviceName+".Delete", &KeyArgs{Key: key}, &Empty{})
+}
+
+// Batch applies the writes provided in order with a single call.
+func (rs *remoteStore) Batch(ops []kvstore.BatchOp) error {
+	return rs.client.Call(serviceName+".Batch", &BatchArgs{Ops: ops}, &Empty{})
+}
+
+// Len returns the number of key-value pairs in the store, or 0 if the call
+// fails.
+func (rs *remoteStore) Len() int {
+	var reply LenReply
+	if err := rs.client.Call(serviceName+".Len", &Empty{}, &reply); err != nil {
+		return 0
+	}
+	return reply.Len
+}
+
+// ClearAll clears all key-value pairs
+// NB: This should only be used for testing purposes.
+func (rs *remoteStore) ClearAll() error {
+	return rs.client.Call(serviceName+".ClearAll", &Empty{}, &Empty{})
+}
@@ -0,0 +1,118 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"net"
+	"net/rpc"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pokt-network/smt"
+	"github.com/pokt-network/smt/kvstore"
+	"github.com/pokt-network/smt/kvstore/simplemap"
+)
+
+// newTestStore returns a remote store connected to an in-process server
+// serving the store provided
+func newTestStore(t *testing.T, store kvstore.MapStore) kvstore.BatchStore {
+	t.Helper()
+	server, err := NewServer(store)
+	require.NoError(t, err)
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	t.Cleanup(func() { require.NoError(t, client.Close()) })
+	return NewRemoteStore(client)
+}
+
+// countingStore counts the writes made to the BatchStore it wraps
+type countingStore struct {
+	kvstore.BatchStore
+	writes  int
+	batches int
+}
+
+func (s *countingStore) Set(key, value []byte) error {
+	s.writes++
+	return s.BatchStore.Set(key, value)
+}
+
+func (s *countingStore) Delete(key []byte) error {
+	s.writes++
+	return s.BatchStore.Delete(key)
+}
+
+func (s *countingStore) Batch(ops []kvstore.BatchOp) error {
+	s.batches++
+	return s.BatchStore.Batch(ops)
+}
+
+func TestRemoteStore_RoundTrip(t *testing.T) {
+	backing := simplemap.NewSimpleMap()
+	store := newTestStore(t, backing)
+
+	require.NoError(t, store.Set([]byte("foo"), []byte("bar")))
+	value, err := store.Get([]byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), value)
+	require.Equal(t, 1, store.Len())
+
+	// Errors of the backing store are returned
+	_, err = store.Get([]byte("baz"))
+	require.EqualError(t, err, simplemap.ErrKVStoreKeyNotFound.Error())
+	require.ErrorIs(t, err, kvstore.ErrKeyNotFound)
+
+	require.NoError(t, store.Batch([]kvstore.BatchOp{
+		{Key: []byte("baz"), Value: []byte("qux")},
+		{Key: []byte("foo"), Delete: true},
+	}))
+	_, err = backing.Get([]byte("foo"))
+	require.ErrorIs(t, err, simplemap.ErrKVStoreKeyNotFound)
+	value, err = backing.Get([]byte("baz"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("qux"), value)
+
+	require.NoError(t, store.Delete([]byte("baz")))
+	require.Zero(t, store.Len())
+	require.NoError(t, store.Set([]byte("foo"), []byte("bar")))
+	require.NoError(t, store.ClearAll())
+	require.Zero(t, backing.Len())
+}
+
+func TestRemoteStore_Trie(t *testing.T) {
+	backing := simplemap.NewSimpleMap()
+	store := &countingStore{BatchStore: newTestStore(t, backing)}
+	trie := smt.NewSparseMerkleSumTrie(store, sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, trie.Update(key, key, uint64(i)))
+	}
+
+	// The writes of a commit, including the removal of orphans, are batched
+	require.NoError(t, trie.Commit())
+	require.Equal(t, 1, store.batches)
+	require.NoError(t, trie.Delete([]byte("0")))
+	require.NoError(t, trie.Commit())
+	require.Equal(t, 2, store.batches)
+	require.Zero(t, store.writes)
+	root := trie.Root()
+
+	// A trie on another client serves proofs from the shared store
+	other := smt.ImportSparseMerkleSumTrie(newTestStore(t, backing), sha256.New(), root)
+	for i := 1; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		proof, err := other.Prove(key)
+		require.NoError(t, err)
+		valid, err := smt.VerifySumProof(proof, root, key, key, uint64(i), other.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+
+	// A node missing from the remote store is reported as such
+	require.NoError(t, backing.Delete(root))
+	other = smt.ImportSparseMerkleSumTrie(newTestStore(t, backing), sha256.New(), root)
+	_, err := other.Prove([]byte("1"))
+	require.ErrorIs(t, err, smt.ErrMissingNode)
+}
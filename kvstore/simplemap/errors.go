@@ -2,11 +2,14 @@ package simplemap
 
 import (
 	"errors"
+
+	"github.com/pokt-network/smt/kvstore"
 )
 
 var (
-	// ErrKVStoreKeyNotFound is returned when a key is not present in the trie.
-	ErrKVStoreKeyNotFound = errors.New("key already empty")
+	// ErrKVStoreKeyNotFound is returned when a key is not present in the trie,
+	// it is kvstore.ErrKeyNotFound.
+	ErrKVStoreKeyNotFound = kvstore.ErrKeyNotFound
 	// ErrKVStoreEmptyKey is returned when the given key is empty.
 	ErrKVStoreEmptyKey = errors.New("key is empty")
 )
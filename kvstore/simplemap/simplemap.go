@@ -5,11 +5,13 @@ import (
 )
 
 // Ensure that the SimpleMap can be used as an SMT node store
-var _ kvstore.MapStore = (*simpleMap)(nil)
+var _ kvstore.PreallocatingStore = (*simpleMap)(nil)
 
 // simpleMap is a simple in-memory map.
 type simpleMap struct {
 	m map[string][]byte
+	// capacity is the number of pairs the map was last allocated to hold
+	capacity int
 }
 
 // NewSimpleMap creates a new SimpleMap instance.
@@ -59,9 +61,29 @@ func (sm *simpleMap) Len() int {
 	return len(sm.m)
 }
 
+// Preallocate resizes the map to hold the number of additional key-value pairs
+// provided without growing. The map is only rebuilt if it was not already
+// allocated with enough capacity, and then at least doubles in capacity, so
+// that repeated small hints do not copy the map each time.
+func (sm *simpleMap) Preallocate(expectedKeys int) {
+	needed := len(sm.m) + expectedKeys
+	if expectedKeys <= 0 || needed <= sm.capacity {
+		return
+	}
+	if needed < 2*sm.capacity {
+		needed = 2 * sm.capacity
+	}
+	m := make(map[string][]byte, needed)
+	for key, value := range sm.m {
+		m[key] = value
+	}
+	sm.m, sm.capacity = m, needed
+}
+
 // ClearAll clears all key-value pairs
 // NB: This should only be used for testing purposes.
 func (sm *simpleMap) ClearAll() error {
 	sm.m = make(map[string][]byte)
+	sm.capacity = 0
 	return nil
 }
@@ -175,3 +175,26 @@ func TestSimpleMap_ClearAll(t *testing.T) {
 
 	require.Equal(t, 0, store.Len())
 }
+
+func TestSimpleMap_Preallocate(t *testing.T) {
+	store := NewSimpleMap().(kvstore.PreallocatingStore)
+	require.NoError(t, store.Set([]byte("key1"), []byte("value1")))
+
+	// The existing pairs are retained
+	store.Preallocate(100)
+	store.Preallocate(0)
+	require.Equal(t, 1, store.Len())
+	value, err := store.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), value)
+
+	// The map is only rebuilt when its capacity is exceeded, and then doubles
+	sm := store.(*simpleMap)
+	require.Equal(t, 101, sm.capacity)
+	store.Preallocate(50)
+	require.Equal(t, 101, sm.capacity)
+	store.Preallocate(101)
+	require.Equal(t, 202, sm.capacity)
+	store.Preallocate(1000)
+	require.Equal(t, 1001, sm.capacity)
+}
@@ -0,0 +1,5 @@
+// Package tracing provides a MapStore wrapper that records the keys read from
+// the store it wraps. Running Get or Prove through a trie backed by it reveals
+// the exact set of nodes they touch, which is the minimal set of nodes to
+// ship to a peer or preload into a cache to repeat them.
+package tracing
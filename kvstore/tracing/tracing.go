@@ -0,0 +1,43 @@
+package tracing
+
+import (
+	"sync"
+
+	"github.com/pokt-network/smt/kvstore"
+)
+
+// Ensure the tracing store can be used as an SMT node store
+var _ kvstore.MapStore = (*tracingStore)(nil)
+
+// tracingStore is a MapStore that records the keys read from the store it wraps
+type tracingStore struct {
+	kvstore.MapStore
+	mu    sync.Mutex
+	trace [][]byte
+}
+
+// NewTracingStore wraps the MapStore provided, returning the wrapper and a
+// function returning the keys read through it by Get since it was created, in
+// the order read. For a trie's node store these are the digests of the nodes
+// loaded. Writes are passed through to the wrapped store unrecorded.
+// NOTE: The wrapper is never a kvstore.BatchStore, so the writes of a commit
+// made through it are applied one at a time.
+func NewTracingStore(m kvstore.MapStore) (kvstore.MapStore, func() [][]byte) {
+	store := &tracingStore{MapStore: m}
+	return store, store.keys
+}
+
+// Get gets the value for a key, recording the key.
+func (s *tracingStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	s.trace = append(s.trace, append([]byte(nil), key...))
+	s.mu.Unlock()
+	return s.MapStore.Get(key)
+}
+
+// keys returns a copy of the keys read so far
+func (s *tracingStore) keys() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.trace...)
+}
@@ -0,0 +1,32 @@
+package tracing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pokt-network/smt/kvstore/simplemap"
+)
+
+func TestTracingStore(t *testing.T) {
+	backing := simplemap.NewSimpleMap()
+	require.NoError(t, backing.Set([]byte("key1"), []byte("value1")))
+	store, trace := NewTracingStore(backing)
+	require.Empty(t, trace())
+
+	// Writes are passed through but not recorded
+	require.NoError(t, store.Set([]byte("key2"), []byte("value2")))
+	require.NoError(t, store.Delete([]byte("key1")))
+	require.Equal(t, 1, store.Len())
+	require.Empty(t, trace())
+
+	// Reads are recorded in order, including those of missing keys
+	value, err := store.Get([]byte("key2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), value)
+	_, err = store.Get([]byte("key1"))
+	require.Error(t, err)
+	_, err = store.Get([]byte("key2"))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("key2"), []byte("key1"), []byte("key2")}, trace())
+}
@@ -1,20 +1,225 @@
 package smt
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
 	"hash"
+	"io"
 )
 
 // Option is a function that configures SparseMerkleTrie.
 type Option func(*TrieSpec)
 
 // WithPathHasher returns an Option that sets the PathHasher to the one provided
+// NOTE: Leaves store only the path of their key, not the key itself, so an
+// Update of a key whose path collides with that of another key replaces the
+// other key's leaf. The PathHasher must be collision resistant.
 func WithPathHasher(ph PathHasher) Option {
-	return func(ts *TrieSpec) { ts.ph = ph }
+	return func(ts *TrieSpec) { ts.setPathHasher(ph) }
 }
 
-// WithValueHasher returns an Option that sets the ValueHasher to the one provided
+// WithPathSalt returns an Option that prefixes every key with the salt
+// provided before it is hashed by the PathHasher, so that the paths of keys
+// cannot be computed, nor the keys in a trie enumerated, without the salt. It
+// salts the PathHasher set before it, so must follow any WithPathHasher option.
+// NOTE: Proofs can only be verified with a spec using the same salt.
+func WithPathSalt(salt []byte) Option {
+	return func(ts *TrieSpec) {
+		ts.setPathHasher(&saltedPathHasher{PathHasher: ts.ph, salt: bytes.Clone(salt)})
+	}
+}
+
+// WithValueHasher returns an Option that sets the ValueHasher to the one
+// provided, replacing any ValueCodec or value resolver previously set
 func WithValueHasher(vh ValueHasher) Option {
-	return func(ts *TrieSpec) { ts.vh = vh }
+	return func(ts *TrieSpec) {
+		ts.vh = vh
+		ts.vc = nil
+		ts.vr = nil
+	}
+}
+
+// WithValueCodec returns an Option that sets the ValueCodec to the one
+// provided. Values are encoded with the codec instead of being hashed, and Get
+// returns the decoded original value rather than its digest.
+// NOTE: Proofs must be verified with a spec using the same codec.
+func WithValueCodec(vc ValueCodec) Option {
+	return func(ts *TrieSpec) { ts.vc = vc }
+}
+
+// WithValueResolver returns an Option that sets a function used by Get to
+// resolve the value hash stored in a leaf to the original value, for example
+// by fetching it from an external blob store. The trie itself continues to
+// store only value hashes (and sums), keeping the authenticated structure
+// separate from the bulk storage of values.
+// NOTE: The resolver is not used when a ValueCodec is set.
+func WithValueResolver(resolve func(valueHash []byte) ([]byte, error)) Option {
+	return func(ts *TrieSpec) { ts.vr = resolve }
+}
+
+// WithWAL returns an Option that sets a write-ahead log for a sum trie. Every
+// Update and Delete is appended to the log before being applied in memory, so
+// that operations made since the last commit can be recovered with ReplayWAL
+// after a crash. If the log implements Truncate(int64) error, as *os.File does,
+// it is truncated (and rewound if it is an io.Seeker) after each successful
+// Commit; otherwise it is the caller's responsibility to discard it. Keys and
+// values over 16 MiB cannot be logged, and operations on them return
+// ErrMalformedWAL.
+func WithWAL(w io.Writer) Option {
+	return func(ts *TrieSpec) { ts.wal = w }
+}
+
+// WithProofFingerprint returns an Option that attaches the SpecFingerprint of
+// the trie's spec to the proofs it generates with Prove. Verifying such a proof
+// with a spec that has a different fingerprint returns ErrSpecMismatch instead
+// of an invalid result. The fingerprint adds 32 bytes to every proof, so it is
+// disabled by default.
+func WithProofFingerprint() Option {
+	return func(ts *TrieSpec) { ts.fingerprint = true }
+}
+
+// WithLegacyNodeLayout returns an Option that makes a sum trie use the legacy
+// node layout, where the sum of a node is placed before its hash in the node's
+// digest ([sum]+[hash]) rather than after it ([hash]+[sum]). This affects the
+// side nodes of proofs and the root of the trie, so proofs generated under the
+// legacy layout only verify with a spec that also uses it. This is intended
+// for verifying proofs from tries created prior to the layout change.
+func WithLegacyNodeLayout() Option {
+	return func(ts *TrieSpec) { ts.th.sumFirst = true }
+}
+
+// WithNodeSerializer returns an Option that sets the NodeSerializer used to
+// lay out the data hashed for each node, in place of its canonical encoding.
+// This affects the digests of all nodes, and so the root of the trie, but not
+// the data held in the node store or in proofs, which remain in the canonical
+// encoding. Proofs only verify with a spec using an equivalent serializer.
+func WithNodeSerializer(ns NodeSerializer) Option {
+	return func(ts *TrieSpec) { ts.th.ns = ns }
+}
+
+// WithRetainOrphansFor returns an Option that retains the nodes orphaned by
+// the last n commits in the node store, rather than deleting them on commit,
+// so that the n roots committed before the current one can still be queried
+// with AtRoot. Orphans are deleted once their commit leaves the window, which
+// bounds the growth of the node store while keeping a rolling history.
+func WithRetainOrphansFor(n int) Option {
+	return func(ts *TrieSpec) { ts.retainOrphans = n }
+}
+
+// WithHashSize returns an Option that truncates the digests of nodes to the
+// first n bytes of the hasher's output, shrinking side nodes, roots and so
+// proofs. Paths and value hashes are not truncated. It panics with
+// ErrUnsupportedHashSize if n is below 16 bytes or above the hasher's size.
+// NOTE: Truncation reduces the collision resistance of node digests to n*4
+// bits, so a 16 byte truncation only offers 64 bits of security against
+// collisions. Proofs can only be verified with a spec using the same size.
+func WithHashSize(n int) Option {
+	return func(ts *TrieSpec) { ts.th.setHashSize(n) }
+}
+
+// WithMaxProofSideNodes returns an Option that caps the number of side nodes a
+// proof may have to be verified, rejecting compact proofs that claim more side
+// nodes before they are decompacted. A cap of 0, or one above the depth of the
+// trie, leaves the depth of the trie as the maximum.
+// NOTE: Proofs of leaves deeper than the cap cannot be verified.
+func WithMaxProofSideNodes(n int) Option {
+	return func(ts *TrieSpec) { ts.maxProofSideNodes = n }
+}
+
+// WithMultiValue returns an Option that makes an Update of an existing key of a
+// sum trie combine the value and sum stored in its leaf with those provided,
+// using the functions given, rather than replace them. If either function is
+// nil, existing leaves are replaced as without the option. The existing value
+// is the one returned by Get, so it must be recoverable from the leaf, ie. the
+// trie must have a ValueCodec, a value resolver or no ValueHasher, otherwise
+// its hash is combined. Updates are recorded in a WAL with the combined value
+// and sum.
+func WithMultiValue(combine func(existing, incoming []byte) []byte, combineSum func(a, b uint64) uint64) Option {
+	return func(ts *TrieSpec) {
+		if combine == nil || combineSum == nil {
+			ts.combineValue, ts.combineSum = nil, nil
+			return
+		}
+		ts.combineValue = combine
+		ts.combineSum = combineSum
+	}
+}
+
+// WithCommitHook returns an Option that makes Commit of a sum trie call the hook
+// provided with the leaves added, updated or removed since the last commit, in
+// path order, before anything is written to the node store, so that external
+// indexes can be kept consistent with the trie. If the hook returns an error
+// the commit is aborted with it, leaving the node store at the last committed
+// root and the changes uncommitted. The hook is not called if no leaves have
+// changed.
+// NOTE: A commit can still fail after the hook succeeds, if the node store
+// returns an error, in which case the hook is called again with the same
+// changes, and any since, by the next commit.
+func WithCommitHook(hook func(changes []LeafChange) error) Option {
+	return func(ts *TrieSpec) { ts.commitHook = hook }
+}
+
+// WithLowMemoryCommit returns an Option that makes Commit free the nodes of the
+// trie from memory as it writes them, depth first, replacing each subtrie with
+// a lazy node once its root's digest is computed. Only the nodes along the
+// path being written are then held beyond the uncommitted changes themselves,
+// and after the commit the trie is held as its root alone, loading nodes from
+// the node store as they are next read. The root is that of a normal commit.
+// NOTE: Writes are applied one at a time, even to a kvstore.BatchStore, so
+// that they are not buffered until the end of the commit, and reads after a
+// commit load nodes from the node store again.
+func WithLowMemoryCommit() Option {
+	return func(ts *TrieSpec) { ts.lowMemoryCommit = true }
+}
+
+// WithProveCommittedOnly returns an Option that makes Get, Prove, ProveClosest
+// and the other reads of the trie, such as GetMany, GetLeafData, SubtreeRoot
+// and ProveSumOf, read the trie at its last committed root, ignoring any changes
+// made since, so that proofs match the root last returned by Commit and are
+// deterministic regardless of pending updates. By default they read the trie
+// with its uncommitted changes, matching Root. While there are uncommitted
+// changes the committed nodes are read from the node store on every call, and
+// a trie that has never been committed reads as empty.
+func WithProveCommittedOnly() Option {
+	return func(ts *TrieSpec) { ts.proveCommittedOnly = true }
+}
+
+// WithRejectZeroSum returns an Option that makes Update of a sum trie return
+// ErrZeroSumNotAllowed for a zero sum, so that every leaf in the trie has a
+// positive sum. Leaves should be removed with Delete instead.
+func WithRejectZeroSum() Option {
+	return func(ts *TrieSpec) { ts.rejectZeroSum = true }
+}
+
+// WithMonotonicSums returns an Option that makes Update of an existing key of a
+// sum trie return ErrSumDecrease if its new sum is less than its current one,
+// leaving the trie unchanged, so that the sums of keys only ever increase. New
+// keys may have any sum, and keys may still be deleted. In a trie created with
+// WithMultiValue it is the combined sum that is compared.
+func WithMonotonicSums() Option {
+	return func(ts *TrieSpec) { ts.monotonicSums = true }
+}
+
+// WithAppendOnly returns an Option that makes a trie append-only: once a key
+// is set it cannot be changed or removed. Update of an existing key returns
+// ErrKeyImmutable, while Delete, EvictBelow and Rekey return
+// ErrDeleteForbidden, including when called on the SMT embedded in a sum trie.
+// New keys can still be added.
+func WithAppendOnly() Option {
+	return func(ts *TrieSpec) { ts.appendOnly = true }
+}
+
+// WithoutExtensionNodes returns an Option that makes Update insert a chain of
+// inner nodes, each with a single child, where it would otherwise insert an
+// extension node, for consumers that only handle binary inner nodes. Roots and
+// the side nodes of proofs are unchanged, as an extension node is hashed as the
+// chain of inner nodes it stands in for, but a node is stored for every level
+// of the chain and the sibling data of proofs is never an extension node.
+// NOTE: Extension nodes already present in a loaded trie are kept.
+func WithoutExtensionNodes() Option {
+	return func(ts *TrieSpec) { ts.withoutExtensions = true }
 }
 
 // NoPrehashSpec returns a new TrieSpec that has a nil Value Hasher and a nil
@@ -30,3 +235,55 @@ func NoPrehashSpec(hasher hash.Hash, sumTrie bool) *TrieSpec {
 	opt(&spec)
 	return &spec
 }
+
+// ReusableSpec returns a new TrieSpec whose hashers are drawn from a pool of
+// hashers created by newHasher, and applies any options provided. Unlike the
+// TrieSpec of a trie, which shares a single hash.Hash between all operations,
+// a ReusableSpec can be shared by many goroutines verifying proofs at once.
+//
+// This is the recommended pattern for high-throughput verifiers: construct
+// the spec once and reuse it for every call to VerifyProof, VerifySumProof and
+// their compact and closest variants, instead of constructing a new spec (and
+// hasher) for each verification.
+// NOTE: Custom PathHasher or ValueHasher options are used as-is and must be
+// safe for concurrent use themselves.
+func ReusableSpec(newHasher func() hash.Hash, sumTrie bool, options ...Option) *TrieSpec {
+	spec := newTrieSpecFromHasher(newPooledTrieHasher(newHasher), sumTrie)
+	for _, option := range options {
+		option(&spec)
+	}
+	return &spec
+}
+
+// verifierHashers maps the names of the hashers accepted by
+// VerifierSpecFromParams to their constructors
+var verifierHashers = map[string]func() hash.Hash{
+	"sha224":     sha256.New224,
+	"sha256":     sha256.New,
+	"sha384":     sha512.New384,
+	"sha512":     sha512.New,
+	"sha512_256": sha512.New512_256,
+}
+
+// VerifierSpecFromParams returns a spec for verifying proofs built from the
+// parameters of a trie, such as those received over the wire by a light
+// client: the name of its hasher, whether it is a sum trie and whether keys
+// and values are hashed before being inserted. If prehashKeys is false proofs
+// must be verified with paths in place of keys, and if prehashValues is false
+// with value hashes in place of values. The spec is a ReusableSpec, so can be
+// shared by concurrent verifiers. ErrUnknownHasher is returned for a hasher
+// name other than "sha224", "sha256", "sha384", "sha512" or "sha512_256".
+func VerifierSpecFromParams(hasherName string, sumTrie, prehashKeys, prehashValues bool) (*TrieSpec, error) {
+	newHasher, ok := verifierHashers[hasherName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownHasher, hasherName)
+	}
+	var options []Option
+	if !prehashKeys {
+		options = append(options, WithPathHasher(newNilPathHasher(newHasher().Size())))
+	}
+	if !prehashValues {
+		options = append(options, WithValueHasher(nil))
+	}
+	return ReusableSpec(newHasher, sumTrie, options...), nil
+}
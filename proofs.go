@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math"
+	"math/bits"
+	"sort"
 )
 
 func init() {
 	gob.Register(SparseMerkleProof{})
 	gob.Register(SparseCompactMerkleProof{})
 	gob.Register(SparseMerkleClosestProof{})
+	gob.Register(DeltaProof{})
+	gob.Register(DeletionProof{})
 	gob.Register(SparseCompactMerkleClosestProof{})
 }
 
@@ -30,6 +34,52 @@ type SparseMerkleProof struct {
 	// SiblingData is the data of the sibling node to the leaf being proven,
 	// required for updatable proofs. For unupdatable proofs, is nil.
 	SiblingData []byte
+
+	// EmptyLeaf is set for non-membership proofs where the path of the key
+	// being proven ends in an empty (placeholder) subtrie, distinguishing them
+	// from membership proofs which also have nil NonMembershipLeafData.
+	EmptyLeaf bool
+
+	// SpecFingerprint is the SpecFingerprint of the spec the proof was
+	// generated with, if the trie was created WithProofFingerprint. Otherwise
+	// it is nil and the spec used for verification is not checked.
+	SpecFingerprint []byte
+}
+
+// ProofKind describes what a SparseMerkleProof proves about its key
+type ProofKind int
+
+const (
+	// Membership proofs prove the key is present in the trie
+	Membership ProofKind = iota
+	// NonMembershipPlaceholder proofs prove the key is absent from the trie
+	// as its path ends in an empty subtrie
+	NonMembershipPlaceholder
+	// NonMembershipUnrelatedLeaf proofs prove the key is absent from the trie
+	// as its path ends in the leaf of another key
+	NonMembershipUnrelatedLeaf
+)
+
+// Kind returns the kind of the proof, as declared by the prover. The kind is
+// not covered by the root, proofs must still be verified to be trusted.
+func (proof *SparseMerkleProof) Kind() ProofKind {
+	switch {
+	case proof.NonMembershipLeafData != nil:
+		return NonMembershipUnrelatedLeaf
+	case proof.EmptyLeaf:
+		return NonMembershipPlaceholder
+	default:
+		return Membership
+	}
+}
+
+// IsNonMembership returns whether the proof, as declared by the prover, is a
+// proof of non-membership. A nil NonMembershipLeafData alone does not
+// distinguish a membership proof from a non-membership proof ending in an
+// empty subtrie; the EmptyLeaf flag set on the latter does. As with Kind, the
+// result is not covered by the root and the proof must still be verified.
+func (proof *SparseMerkleProof) IsNonMembership() bool {
+	return proof.Kind() != Membership
 }
 
 // Marshal serialises the SparseMerkleProof to bytes
@@ -55,14 +105,19 @@ func (proof *SparseMerkleProof) validateBasic(spec *TrieSpec) error {
 	// error) or cause a CPU DoS attack.
 
 	// Check that the number of supplied sidenodes does not exceed the maximum possible.
-	if len(proof.SideNodes) > spec.ph.PathSize()*8 {
-		return fmt.Errorf("too many side nodes: got %d but max is %d", len(proof.SideNodes), spec.ph.PathSize()*8)
+	if len(proof.SideNodes) > spec.maxSideNodes() {
+		return fmt.Errorf("too many side nodes: got %d but max is %d", len(proof.SideNodes), spec.maxSideNodes())
 	}
 	// Check that leaf data for non-membership proofs is a valid size.
 	lps := len(leafPrefix) + spec.ph.PathSize()
 	if proof.NonMembershipLeafData != nil && len(proof.NonMembershipLeafData) < lps {
 		return fmt.Errorf("invalid non-membership leaf data size: got %d but min is %d", len(proof.NonMembershipLeafData), lps)
 	}
+	if proof.NonMembershipLeafData != nil {
+		if err := checkLeafData(proof.NonMembershipLeafData, spec); err != nil {
+			return err
+		}
+	}
 
 	// Check that all supplied sidenodes are the correct size.
 	for _, v := range proof.SideNodes {
@@ -83,6 +138,165 @@ func (proof *SparseMerkleProof) validateBasic(spec *TrieSpec) error {
 	return nil
 }
 
+// checkLeafData returns ErrMalformedLeafData if the data provided, of at least
+// the length of a leaf's prefix and path, is not structured as the data of a
+// leaf in a trie with the spec provided: [prefix]+[path]+[value hash] followed
+// by an 8 byte sum in sum tries. The length of the value hash is not checked as
+// it depends on the ValueHasher or ValueCodec used.
+func checkLeafData(data []byte, spec *TrieSpec) error {
+	if !isLeaf(data) {
+		return fmt.Errorf("%w: invalid prefix %x", ErrMalformedLeafData, data[:len(leafPrefix)])
+	}
+	lps := len(leafPrefix) + spec.ph.PathSize()
+	if spec.sumTrie && len(data) < lps+sumSize {
+		return fmt.Errorf("%w: size %d too small for sum, min is %d", ErrMalformedLeafData, len(data), lps+sumSize)
+	}
+	return nil
+}
+
+// LintSumProof returns every structural issue found in the proof provided for a
+// trie with the spec given, rather than only the first as verification does,
+// for reporting to the sender of a bad proof: a spec fingerprint mismatch, too
+// many side nodes, side nodes of the wrong size, malformed NonMembershipLeafData
+// and SiblingData that is malformed or does not hash to the first side node.
+// No issues return nil. A proof without issues may still fail verification, as
+// the root it commits to is not checked. It does not panic on arbitrary input.
+func LintSumProof(proof *SparseMerkleProof, spec *TrieSpec) []error {
+	if proof == nil {
+		return []error{errors.New("nil proof")}
+	}
+	var issues []error
+	if err := checkSpecFingerprint(proof, spec); err != nil {
+		issues = append(issues, err)
+	}
+	if len(proof.SideNodes) > spec.maxSideNodes() {
+		issues = append(issues, fmt.Errorf("too many side nodes: got %d but max is %d",
+			len(proof.SideNodes), spec.maxSideNodes()))
+	}
+	for i, sideNode := range proof.SideNodes {
+		if len(sideNode) != hashSize(spec) {
+			issues = append(issues, fmt.Errorf("invalid side node %d size: got %d but want %d",
+				i, len(sideNode), hashSize(spec)))
+		}
+	}
+	lps := len(leafPrefix) + spec.ph.PathSize()
+	if proof.NonMembershipLeafData != nil {
+		if len(proof.NonMembershipLeafData) < lps {
+			issues = append(issues, fmt.Errorf("invalid non-membership leaf data size: got %d but min is %d",
+				len(proof.NonMembershipLeafData), lps))
+		} else if err := checkLeafData(proof.NonMembershipLeafData, spec); err != nil {
+			issues = append(issues, err)
+		}
+	}
+	if proof.SiblingData == nil {
+		return issues
+	}
+	if err := checkNodeData(proof.SiblingData, spec); err != nil {
+		return append(issues, fmt.Errorf("invalid sibling data: %w", err))
+	}
+	if len(proof.SideNodes) == 0 {
+		return append(issues, errors.New("sibling data without side nodes"))
+	}
+	if siblingHash := hashPreimage(spec, proof.SiblingData); !bytes.Equal(proof.SideNodes[0], siblingHash) {
+		issues = append(issues, fmt.Errorf("invalid sibling data hash: got %x but want %x",
+			siblingHash, proof.SideNodes[0]))
+	}
+	return issues
+}
+
+// checkNodeData returns an error if the data provided is not structured as the
+// serialisation of a leaf, inner or extension node of a trie with the spec
+// provided, so that it can be hashed without panicking
+func checkNodeData(data []byte, spec *TrieSpec) error {
+	if len(data) == 0 {
+		return errors.New("empty node data")
+	}
+	childSize := hashSize(spec)
+	var sumLen int
+	if spec.sumTrie {
+		sumLen = sumSize
+	}
+	switch {
+	case isLeaf(data):
+		if lps := len(leafPrefix) + spec.ph.PathSize(); len(data) < lps {
+			return fmt.Errorf("%w: size %d too small, min is %d", ErrMalformedLeafData, len(data), lps)
+		}
+		return checkLeafData(data, spec)
+	case isExtension(data):
+		size := len(extPrefix) + 2 + spec.ph.PathSize() + childSize + sumLen
+		if len(data) != size {
+			return fmt.Errorf("invalid extension size: got %d but want %d", len(data), size)
+		}
+		start, end := int(data[len(extPrefix)]), int(data[len(extPrefix)+1])
+		if start >= end || end > spec.depth() {
+			return fmt.Errorf("invalid extension path bounds: [%d, %d)", start, end)
+		}
+	case bytes.Equal(data[:len(innerPrefix)], innerPrefix):
+		if size := len(innerPrefix) + 2*childSize + sumLen; len(data) != size {
+			return fmt.Errorf("invalid inner node size: got %d but want %d", len(data), size)
+		}
+	default:
+		return fmt.Errorf("invalid node prefix %x", data[0])
+	}
+	return nil
+}
+
+// AsMerkleProof converts a proof from a sum trie into the equivalent proof for
+// a non-sum trie, by stripping the sum from each of its side nodes. The sums
+// stripped are returned alongside the proof, in side node order, and can be
+// used to restore the original proof with NewSumProof.
+//
+// NOTE: This conversion is lossy: the non-sum view of the proof on its own
+// carries no sum information and cannot be verified against a sum trie root.
+// Its SiblingData is also dropped, as the serialisation is specific to the sum
+// trie. It is intended for sharing structural checks between both trie types.
+func (proof *SparseMerkleProof) AsMerkleProof(spec *TrieSpec) (*SparseMerkleProof, []uint64, error) {
+	if !spec.sumTrie {
+		return nil, nil, errors.New("not a sum trie spec")
+	}
+	if err := proof.validateBasic(spec); err != nil {
+		return nil, nil, errors.Join(ErrBadProof, err)
+	}
+	var sideNodes [][]byte
+	var sums []uint64
+	for _, sideNode := range proof.SideNodes {
+		hash := append([]byte{}, spec.th.digestHash(sideNode)...)
+		sideNodes = append(sideNodes, hash)
+		sums = append(sums, binary.BigEndian.Uint64(spec.th.digestSum(sideNode)))
+	}
+	return &SparseMerkleProof{
+		SideNodes:             sideNodes,
+		NonMembershipLeafData: proof.NonMembershipLeafData,
+		EmptyLeaf:             proof.EmptyLeaf,
+	}, sums, nil
+}
+
+// NewSumProof converts a proof for a non-sum trie into a proof for a sum trie,
+// by attaching the sums provided to each of the proof's side nodes in order.
+// It is the inverse of AsMerkleProof.
+func NewSumProof(proof *SparseMerkleProof, sideNodeSums []uint64, spec *TrieSpec) (*SparseMerkleProof, error) {
+	if !spec.sumTrie {
+		return nil, errors.New("not a sum trie spec")
+	}
+	if len(sideNodeSums) != len(proof.SideNodes) {
+		return nil, fmt.Errorf("invalid number of sums: got %d want %d", len(sideNodeSums), len(proof.SideNodes))
+	}
+	var sideNodes [][]byte
+	for i, sideNode := range proof.SideNodes {
+		if len(sideNode) != spec.th.hashSize() {
+			return nil, fmt.Errorf("invalid side node size: got %d but want %d", len(sideNode), spec.th.hashSize())
+		}
+		var sumBz [sumSize]byte
+		binary.BigEndian.PutUint64(sumBz[:], sideNodeSums[i])
+		sideNodes = append(sideNodes, spec.th.sumDigest(sideNode, sumBz[:]))
+	}
+	return &SparseMerkleProof{
+		SideNodes:             sideNodes,
+		NonMembershipLeafData: proof.NonMembershipLeafData,
+		EmptyLeaf:             proof.EmptyLeaf,
+	}, nil
+}
+
 // SparseCompactMerkleProof is a compact Merkle proof for an element in a SparseMerkleTrie.
 type SparseCompactMerkleProof struct {
 	// SideNodes is an array of the sibling nodes leading up to the leaf of the proof.
@@ -105,6 +319,14 @@ type SparseCompactMerkleProof struct {
 	// SiblingData is the data of the sibling node to the leaf being proven,
 	// required for updatable proofs. For unupdatable proofs, is nil.
 	SiblingData []byte
+
+	// EmptyLeaf is set for non-membership proofs where the path of the key
+	// being proven ends in an empty (placeholder) subtrie.
+	EmptyLeaf bool
+
+	// SpecFingerprint is the SpecFingerprint of the spec the proof was
+	// generated with, or nil if it was not attached.
+	SpecFingerprint []byte
 }
 
 // Marshal serialises the SparseCompactMerkleProof to bytes
@@ -131,9 +353,10 @@ func (proof *SparseCompactMerkleProof) validateBasic(spec *TrieSpec) error {
 	// When the proof is de-compacted and verified, the sanity check for the
 	// de-compacted proof should be executed.
 
-	// Compact proofs: check that NumSideNodes is within the right range.
-	if proof.NumSideNodes < 0 || proof.NumSideNodes > spec.ph.PathSize()*8 {
-		return fmt.Errorf("invalid number of side nodes: got %d, min is 0 and max is %d", len(proof.SideNodes), spec.ph.PathSize()*8)
+	// Compact proofs: check that NumSideNodes is within the right range, before
+	// anything is allocated for the side nodes it claims.
+	if proof.NumSideNodes < 0 || proof.NumSideNodes > spec.maxSideNodes() {
+		return fmt.Errorf("invalid number of side nodes: got %d, min is 0 and max is %d", len(proof.SideNodes), spec.maxSideNodes())
 	}
 
 	// Compact proofs: check that the length of the bit mask is as expected
@@ -141,7 +364,7 @@ func (proof *SparseCompactMerkleProof) validateBasic(spec *TrieSpec) error {
 	// number of bytes needed to represent the number of side nodes
 	// for example: 1 byte is needed to represent 8 side nodes
 	//              32 bytes are needed to represent 256 side nodes
-	bml := int(math.Ceil(float64(proof.NumSideNodes) / float64(8)))
+	bml := bitMaskLen(proof.NumSideNodes)
 	if len(proof.BitMask) != bml {
 		return fmt.Errorf("invalid bit mask length: got %d want %d", len(proof.BitMask), bml)
 	}
@@ -157,6 +380,146 @@ func (proof *SparseCompactMerkleProof) validateBasic(spec *TrieSpec) error {
 	return nil
 }
 
+// DeltaProof is a SparseMerkleProof from which the side nodes already known to
+// the client it was generated for are omitted. Each omitted side node is
+// referenced by the index of its digest in the client's known digests, sorted,
+// so the client must expand the proof with the same set it proved it with.
+type DeltaProof struct {
+	// SideNodes are the side nodes that are not omitted, bottom up.
+	SideNodes [][]byte
+
+	// References holds an entry for each side node of the full proof, bottom
+	// up, which is -1 if the side node is the next one in SideNodes, otherwise
+	// the index of its digest in the client's sorted known digests.
+	References []int
+
+	// NonMembershipLeafData, SiblingData, EmptyLeaf and SpecFingerprint are
+	// those of the full proof.
+	NonMembershipLeafData []byte
+	SiblingData           []byte
+	EmptyLeaf             bool
+	SpecFingerprint       []byte
+}
+
+// Marshal serialises the DeltaProof to bytes
+func (proof *DeltaProof) Marshal() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	enc := gob.NewEncoder(buf)
+	if err := enc.Encode(proof); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal deserialises the DeltaProof from bytes
+func (proof *DeltaProof) Unmarshal(bz []byte) error {
+	buf := bytes.NewBuffer(bz)
+	dec := gob.NewDecoder(buf)
+	return dec.Decode(proof)
+}
+
+// DeletionProof proves that a key was removed from a sum trie: that its leaf
+// was present at the root before the deletion, and that the root after it is
+// that of the same trie without the leaf. It is generated with ProveDeletion
+// and verified with VerifyDeletionProof.
+type DeletionProof struct {
+	// Proof is the proof of the leaf's membership at the root before the
+	// deletion.
+	Proof *SparseMerkleProof
+
+	// LeafData is the data of the leaf removed: [prefix]+[path]+[value hash]+[sum].
+	LeafData []byte
+}
+
+// Marshal serialises the DeletionProof to bytes
+func (proof *DeletionProof) Marshal() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	enc := gob.NewEncoder(buf)
+	if err := enc.Encode(proof); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal deserialises the DeletionProof from bytes
+func (proof *DeletionProof) Unmarshal(bz []byte) error {
+	buf := bytes.NewBuffer(bz)
+	dec := gob.NewDecoder(buf)
+	return dec.Decode(proof)
+}
+
+// sortedKnownNodes returns the digests in the set provided in sorted order
+func sortedKnownNodes(knownNodes map[string]bool) []string {
+	known := make([]string, 0, len(knownNodes))
+	for digest, ok := range knownNodes {
+		if ok {
+			known = append(known, digest)
+		}
+	}
+	sort.Strings(known)
+	return known
+}
+
+// newDeltaProof returns the proof provided with the side nodes in the set of
+// known digests omitted. Placeholders are never omitted as their digest is
+// found at many positions of the trie.
+func newDeltaProof(proof *SparseMerkleProof, knownNodes map[string]bool, spec *TrieSpec) *DeltaProof {
+	known := sortedKnownNodes(knownNodes)
+	empty := placeholder(spec)
+	delta := &DeltaProof{
+		References:            make([]int, len(proof.SideNodes)),
+		NonMembershipLeafData: proof.NonMembershipLeafData,
+		SiblingData:           proof.SiblingData,
+		EmptyLeaf:             proof.EmptyLeaf,
+		SpecFingerprint:       proof.SpecFingerprint,
+	}
+	for i, sideNode := range proof.SideNodes {
+		delta.References[i] = -1
+		if !bytes.Equal(sideNode, empty) {
+			if j := sort.SearchStrings(known, string(sideNode)); j < len(known) && known[j] == string(sideNode) {
+				delta.References[i] = j
+				continue
+			}
+		}
+		delta.SideNodes = append(delta.SideNodes, sideNode)
+	}
+	return delta
+}
+
+// Expand returns the full proof the DeltaProof was generated from, restoring
+// the omitted side nodes from the set of known digests the proof was generated
+// with. ErrBadProof is returned if a side node is missing.
+func (proof *DeltaProof) Expand(knownNodes map[string]bool) (*SparseMerkleProof, error) {
+	known := sortedKnownNodes(knownNodes)
+	full := &SparseMerkleProof{
+		NonMembershipLeafData: proof.NonMembershipLeafData,
+		SiblingData:           proof.SiblingData,
+		EmptyLeaf:             proof.EmptyLeaf,
+		SpecFingerprint:       proof.SpecFingerprint,
+	}
+	if len(proof.References) > 0 {
+		full.SideNodes = make([][]byte, len(proof.References))
+	}
+	position := 0
+	for i, ref := range proof.References {
+		switch {
+		case ref == -1 && position < len(proof.SideNodes):
+			full.SideNodes[i] = proof.SideNodes[position]
+			position++
+		case ref >= 0 && ref < len(known):
+			full.SideNodes[i] = []byte(known[ref])
+		default:
+			return nil, errors.Join(ErrBadProof, fmt.Errorf("missing side node %d", i))
+		}
+	}
+	if position != len(proof.SideNodes) {
+		return nil, errors.Join(ErrBadProof, fmt.Errorf(
+			"invalid number of side nodes: got %d want %d", len(proof.SideNodes), position,
+		))
+	}
+	return full, nil
+}
+
 // SparseMerkleClosestProof is a wrapper around a SparseMerkleProof that
 // represents the proof of the leaf with the closest path to the one provided.
 type SparseMerkleClosestProof struct {
@@ -187,13 +550,13 @@ func (proof *SparseMerkleClosestProof) Unmarshal(bz []byte) error {
 
 func (proof *SparseMerkleClosestProof) validateBasic(spec *TrieSpec) error {
 	// ensure the depth of the leaf node being proven is within the path size
-	if proof.Depth < 0 || proof.Depth > spec.ph.PathSize()*8 {
-		return fmt.Errorf("invalid depth: got %d, outside of [0, %d]", proof.Depth, spec.ph.PathSize()*8)
+	if proof.Depth < 0 || proof.Depth > spec.depth() {
+		return fmt.Errorf("invalid depth: got %d, outside of [0, %d]", proof.Depth, spec.depth())
 	}
 	// for each of the bits flipped ensure that they are within the path size
 	// and that they are not greater than the depth of the leaf node being proven
 	for i, b := range proof.FlippedBits {
-		// as proof.Depth <= spec.ph.PathSize()*8, i <= proof.Depth
+		// as proof.Depth <= spec.depth(), i <= proof.Depth
 		if b < 0 || b > proof.Depth {
 			return fmt.Errorf("invalid flipped bit index %d: got %d, outside of [0, %d]", i, b, proof.Depth)
 		}
@@ -240,7 +603,7 @@ func (proof *SparseCompactMerkleClosestProof) validateBasic(spec *TrieSpec) erro
 	// ensure no compressed fields are larger than the path size
 	// for example, for a 256-bit hasher, minBytes will return 1 and require
 	// all downstream values to have a length of at most one byte
-	maxSliceLen := minBytes(spec.ph.PathSize() * 8)
+	maxSliceLen := minBytes(spec.depth())
 	if len(proof.Depth) > maxSliceLen {
 		return fmt.Errorf("invalid depth: got %d but max is %d", proof.Depth, maxSliceLen)
 	}
@@ -275,28 +638,616 @@ func (proof *SparseCompactMerkleClosestProof) Unmarshal(bz []byte) error {
 
 // VerifyProof verifies a Merkle proof.
 func VerifyProof(proof *SparseMerkleProof, root, key, value []byte, spec *TrieSpec) (bool, error) {
+	if err := checkSpecFingerprint(proof, spec); err != nil {
+		return false, err
+	}
 	result, _, err := verifyProofWithUpdates(proof, root, key, value, spec)
 	return result, err
 }
 
-// VerifySumProof verifies a Merkle proof for a sum trie.
+// checkSpecFingerprint returns ErrSpecMismatch if the proof carries a spec
+// fingerprint that does not match that of the spec provided
+func checkSpecFingerprint(proof *SparseMerkleProof, spec *TrieSpec) error {
+	if proof == nil {
+		return nil
+	}
+	return checkFingerprint(proof.SpecFingerprint, spec)
+}
+
+// checkFingerprint returns ErrSpecMismatch if the proof fingerprint provided
+// is set and does not match that of the spec provided
+func checkFingerprint(proofFingerprint []byte, spec *TrieSpec) error {
+	if proofFingerprint == nil {
+		return nil
+	}
+	if fingerprint := SpecFingerprint(spec); !bytes.Equal(proofFingerprint, fingerprint[:]) {
+		return fmt.Errorf("%w: proof generated with spec %x, verifying with spec %x",
+			ErrSpecMismatch, proofFingerprint, fingerprint)
+	}
+	return nil
+}
+
+// VerifySumProof verifies a Merkle proof for a sum trie. A nil value with a
+// zero sum verifies the non-membership of the key, see VerifySumProofMembership
+// for a leaf stored with a nil value and zero sum.
 func VerifySumProof(proof *SparseMerkleProof, root, key, value []byte, sum uint64, spec *TrieSpec) (bool, error) {
+	if err := checkSpecFingerprint(proof, spec); err != nil {
+		return false, err
+	}
+	valueHash, err := sumValueHash(value, sum, spec)
+	if err != nil {
+		return false, err
+	}
+	result, _, err := verifyProofWithUpdates(proof, root, key, valueHash, sumProofSpec(spec))
+	return result, err
+}
+
+// VerifySumProofs verifies the proofs of many keys of a sum trie against the
+// same root, where the proof, value and sum of each key are at its index in
+// their slices. A nil value with a zero sum verifies the non-membership of its
+// key, so membership and non-membership may be mixed. ErrDuplicateKey is
+// returned if a key appears more than once or the paths of two keys collide,
+// so that no leaf is verified, nor its sum counted, twice. The result is true
+// only if every proof is valid.
+func VerifySumProofs(
+	proofs []*SparseMerkleProof,
+	root []byte,
+	keys, values [][]byte,
+	sums []uint64,
+	spec *TrieSpec,
+) (bool, error) {
+	if len(proofs) != len(keys) || len(values) != len(keys) || len(sums) != len(keys) {
+		return false, fmt.Errorf(
+			"mismatched lengths: %d proofs, %d keys, %d values and %d sums", len(proofs), len(keys), len(values), len(sums),
+		)
+	}
+	if err := checkDistinctPaths(keys, spec); err != nil {
+		return false, err
+	}
+	for i, proof := range proofs {
+		valid, err := VerifySumProof(proof, root, keys[i], values[i], sums[i], spec)
+		if err != nil || !valid {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// checkDistinctPaths returns ErrDuplicateKey if a key appears more than once
+// in the keys provided or the paths of two of them collide
+func checkDistinctPaths(keys [][]byte, spec *TrieSpec) error {
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		path := string(spec.ph.Path(key))
+		if _, ok := seen[path]; ok {
+			return fmt.Errorf("%w: %x", ErrDuplicateKey, key)
+		}
+		seen[path] = struct{}{}
+	}
+	return nil
+}
+
+// VerifySetSum verifies that each of the keys provided is in a sum trie with
+// its value and sum, using the proofs returned by ProveSumOf, and that their
+// sums add up to the total claimed. Unlike VerifySumProofs every key must be
+// present: a nil value with a zero sum is verified as a leaf rather than as the
+// absence of its key, so an absent key cannot be counted. ErrDuplicateKey is
+// returned if a key appears more than once or the paths of two keys collide.
+// False is returned if the sums overflow.
+func VerifySetSum(
+	keys, values [][]byte,
+	sums []uint64,
+	claimedTotal uint64,
+	proofs []*SparseMerkleProof,
+	root []byte,
+	spec *TrieSpec,
+) (bool, error) {
+	if len(proofs) != len(keys) || len(values) != len(keys) || len(sums) != len(keys) {
+		return false, fmt.Errorf(
+			"mismatched lengths: %d proofs, %d keys, %d values and %d sums", len(proofs), len(keys), len(values), len(sums),
+		)
+	}
+	if err := checkDistinctPaths(keys, spec); err != nil {
+		return false, err
+	}
+	var total, carry uint64
+	for _, sum := range sums {
+		if total, carry = bits.Add64(total, sum, 0); carry != 0 {
+			return false, nil
+		}
+	}
+	if total != claimedTotal {
+		return false, nil
+	}
+	for i, proof := range proofs {
+		valid, err := VerifySumProofMembership(proof, root, keys[i], values[i], sums[i], spec)
+		if err != nil || !valid {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// VerifyEntryProofs is similar to VerifySumProofs but for the keys, values and
+// sums of entries, where entries[i] is proven by proofs[i].
+func VerifyEntryProofs(proofs []*SparseMerkleProof, root []byte, entries []KeyValueSum, spec *TrieSpec) (bool, error) {
+	keys := make([][]byte, len(entries))
+	values := make([][]byte, len(entries))
+	sums := make([]uint64, len(entries))
+	for i, entry := range entries {
+		keys[i], values[i], sums[i] = entry.Key, entry.Value, entry.Sum
+	}
+	return VerifySumProofs(proofs, root, keys, values, sums, spec)
+}
+
+// VerifySumProofWithSpecDigest is similar to VerifySumProof but first checks
+// that the spec provided is the one expected, by comparing its SpecFingerprint
+// to the digest given, such as one agreed with the prover out of band. This
+// binds verification to a trie configuration even for proofs that do not carry
+// a fingerprint, so a proof cannot be verified under a spec it was not meant
+// for. ErrSpecMismatch is returned if the digests differ.
+func VerifySumProofWithSpecDigest(
+	proof *SparseMerkleProof,
+	root, key, value []byte,
+	sum uint64,
+	spec *TrieSpec,
+	expectedSpecDigest []byte,
+) (bool, error) {
+	if fingerprint := SpecFingerprint(spec); !bytes.Equal(expectedSpecDigest, fingerprint[:]) {
+		return false, fmt.Errorf("%w: expected spec %x, verifying with spec %x",
+			ErrSpecMismatch, expectedSpecDigest, fingerprint)
+	}
+	return VerifySumProof(proof, root, key, value, sum, spec)
+}
+
+// VerifySumProofMembership is similar to VerifySumProof but always verifies the
+// membership of a leaf with the value and sum provided. A leaf stored with a
+// nil value and zero sum, which VerifySumProof takes as a claim that the key
+// is absent, can only be proven present with it.
+func VerifySumProofMembership(proof *SparseMerkleProof, root, key, value []byte, sum uint64, spec *TrieSpec) (bool, error) {
+	if err := checkSpecFingerprint(proof, spec); err != nil {
+		return false, err
+	}
+	valueHash, err := spec.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
 	var sumBz [sumSize]byte
 	binary.BigEndian.PutUint64(sumBz[:], sum)
-	valueHash := spec.digestValue(value)
-	valueHash = append(valueHash, sumBz[:]...)
+	result, _, err := verifyProofWithUpdates(proof, root, key, append(valueHash, sumBz[:]...), sumProofSpec(spec))
+	return result, err
+}
+
+// VerifySumProofAgainstHash verifies a Merkle proof for a sum trie against
+// only the hash portion of a root, without its sum, for verifiers that hold a
+// commitment to the root hash alone. The full root is recomputed from the proof
+// and its hash, the root without the sum bytes, is compared to the one given.
+func VerifySumProofAgainstHash(proof *SparseMerkleProof, rootHash, key, value []byte, sum uint64, spec *TrieSpec) (bool, error) {
+	if err := checkSpecFingerprint(proof, spec); err != nil {
+		return false, err
+	}
+	if len(rootHash) != spec.th.hashSize() {
+		return false, fmt.Errorf("%w: invalid root hash length %d, expected %d",
+			ErrMalformedRoot, len(rootHash), spec.th.hashSize())
+	}
+	valueHash, err := sumValueHash(value, sum, spec)
+	if err != nil {
+		return false, err
+	}
+	root, _, err := computeProofRoot(proof, key, valueHash, sumProofSpec(spec))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(spec.th.digestHash(root), rootHash), nil
+}
+
+// VerifySumProofWithCost is similar to VerifySumProof but also returns the
+// number of node digests computed during verification: one for the leaf, unless
+// the proof is of non-membership ending in an empty subtrie, and one for each
+// side node. The hashing of the key and value are not included.
+func VerifySumProofWithCost(
+	proof *SparseMerkleProof,
+	root, key, value []byte,
+	sum uint64,
+	spec *TrieSpec,
+) (valid bool, hashOps int, err error) {
+	if err := checkSpecFingerprint(proof, spec); err != nil {
+		return false, 0, err
+	}
+	valueHash, err := sumValueHash(value, sum, spec)
+	if err != nil {
+		return false, 0, err
+	}
+	valid, updates, err := verifyProofWithUpdates(proof, root, key, valueHash, sumProofSpec(spec))
+	if err != nil {
+		return false, 0, err
+	}
+	return valid, len(updates), nil
+}
+
+// SumLeafHash returns the digest of the sum trie leaf for the key, value and
+// sum provided, as computed when verifying a proof of its inclusion: the key
+// is hashed with the spec's PathHasher and the value with its ValueHasher (or
+// encoded with its ValueCodec).
+func SumLeafHash(key, value []byte, sum uint64, spec *TrieSpec) ([]byte, error) {
+	valueHash, err := spec.encodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return SumLeafHashPrehashed(spec.ph.Path(key), valueHash, sum, spec)
+}
+
+// SumLeafHashPrehashed is similar to SumLeafHash but for a path and value hash
+// that have already been computed from the key and value.
+func SumLeafHashPrehashed(path, valueHash []byte, sum uint64, spec *TrieSpec) ([]byte, error) {
+	if len(path) != spec.ph.PathSize() {
+		return nil, fmt.Errorf("invalid path size: got %d but want %d", len(path), spec.ph.PathSize())
+	}
+	leafData := make([]byte, len(valueHash)+sumSize)
+	copy(leafData, valueHash)
+	binary.BigEndian.PutUint64(leafData[len(valueHash):], sum)
+	digest, _ := spec.th.digestSumLeaf(path, leafData)
+	return digest, nil
+}
+
+// VerifySumProofByLeafHash verifies a Merkle proof for a sum trie from the
+// digest of the leaf at the path provided, such as one computed by
+// SumLeafHash, by recomputing the root from the leaf digest and the proof's
+// side nodes alone. No key, value or sum is hashed, and the proof's
+// NonMembershipLeafData is not used, so the leaf digest determines what is
+// proven: the digest of a leaf proves its membership, while the placeholder
+// proves the path ends in an empty subtrie.
+func VerifySumProofByLeafHash(proof *SparseMerkleProof, root, leafHash, path []byte, spec *TrieSpec) (bool, error) {
+	if err := checkSpecFingerprint(proof, spec); err != nil {
+		return false, err
+	}
+	if err := proof.validateBasic(spec); err != nil {
+		return false, errors.Join(ErrBadProof, err)
+	}
+	if len(leafHash) != hashSize(spec) {
+		return false, fmt.Errorf("invalid leaf hash size: got %d but want %d", len(leafHash), hashSize(spec))
+	}
+	if len(path) != spec.ph.PathSize() {
+		return false, fmt.Errorf("invalid path size: got %d but want %d", len(path), spec.ph.PathSize())
+	}
+	current := leafHash
+	for i, sideNode := range proof.SideNodes {
+		if getPathBit(path, len(proof.SideNodes)-1-i) == left {
+			current, _ = digestNode(spec, current, sideNode)
+		} else {
+			current, _ = digestNode(spec, sideNode, current)
+		}
+	}
+	return bytes.Equal(current, root), nil
+}
+
+// VerifySumProofValueIn verifies a Merkle proof that the key provided is in a
+// sum trie with the sum given and one of the allowed values, and returns the
+// value that matched. The path of the key is hashed once and the leaf of each
+// allowed value is checked in turn against the proof with
+// VerifySumProofByLeafHash, so, as with VerifySumProofMembership, a nil value
+// is verified as a leaf rather than as the absence of the key.
+func VerifySumProofValueIn(
+	proof *SparseMerkleProof,
+	root, key []byte,
+	allowed [][]byte,
+	sum uint64,
+	spec *TrieSpec,
+) (matched []byte, ok bool, err error) {
+	path := spec.ph.Path(key)
+	for _, value := range allowed {
+		valueHash, err := spec.encodeValue(value)
+		if err != nil {
+			return nil, false, err
+		}
+		leafHash, err := SumLeafHashPrehashed(path, valueHash, sum, spec)
+		if err != nil {
+			return nil, false, err
+		}
+		valid, err := VerifySumProofByLeafHash(proof, root, leafHash, path, spec)
+		if err != nil {
+			return nil, false, err
+		}
+		if valid {
+			return value, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// SumProofStepVerifier recomputes the root of a sum trie from a leaf one level
+// at a time, so a verifier can request the side nodes of a proof on demand
+// rather than all at once, and compare the root reached to the one it trusts.
+// Side nodes are applied from the leaf upwards, as in a SparseMerkleProof.
+// Any error encountered is retained and returned by every later call.
+type SumProofStepVerifier struct {
+	spec    *TrieSpec
+	current []byte
+	steps   int
+	err     error
+}
+
+// NewSumProofStepVerifier returns a SumProofStepVerifier for proofs of the
+// sum trie with the spec provided. Init must be called before any Step.
+func NewSumProofStepVerifier(spec *TrieSpec) *SumProofStepVerifier {
+	return &SumProofStepVerifier{spec: spec}
+}
+
+// Init starts the recomputation from the leaf with the hash and sum provided,
+// where the hash is the leaf digest without its sum, such as that of the digest
+// returned by SumLeafHash. A zero hash and sum start from an empty subtrie.
+func (v *SumProofStepVerifier) Init(leafHash []byte, leafSum uint64) {
+	v.steps = 0
+	v.current = nil
+	v.err = nil
+	if len(leafHash) != v.spec.th.hashSize() {
+		v.err = errors.Join(ErrBadProof, fmt.Errorf(
+			"invalid leaf hash size: got %d but want %d", len(leafHash), v.spec.th.hashSize(),
+		))
+		return
+	}
+	var sumBz [sumSize]byte
+	binary.BigEndian.PutUint64(sumBz[:], leafSum)
+	v.current = v.spec.th.sumDigest(leafHash, sumBz[:])
+}
+
+// Step ascends one level, hashing the current node with the side node provided
+// as digestSumNode does in the batch verifier. The path bit is the bit of the
+// leaf's path at the level of the current node: 0 if it is the left child of
+// its parent and 1 if it is the right child.
+func (v *SumProofStepVerifier) Step(sideNode []byte, pathBit int) error {
+	switch {
+	case v.err != nil:
+		return v.err
+	case v.current == nil:
+		return errors.New("step before init")
+	case v.steps == v.spec.maxSideNodes():
+		v.err = errors.Join(ErrBadProof, fmt.Errorf("too many side nodes: max is %d", v.spec.maxSideNodes()))
+	case len(sideNode) != hashSize(v.spec):
+		v.err = errors.Join(ErrBadProof, fmt.Errorf(
+			"invalid side node size: got %d but want %d", len(sideNode), hashSize(v.spec),
+		))
+	case pathBit != left && pathBit != 1:
+		v.err = fmt.Errorf("invalid path bit: %d", pathBit)
+	}
+	if v.err != nil {
+		return v.err
+	}
+	if pathBit == left {
+		v.current, _ = v.spec.th.digestSumNode(v.current, sideNode)
+	} else {
+		v.current, _ = v.spec.th.digestSumNode(sideNode, v.current)
+	}
+	v.steps++
+	return nil
+}
+
+// Root returns the root, with its sum, reached by the steps taken so far
+func (v *SumProofStepVerifier) Root() ([]byte, error) {
+	if v.err != nil {
+		return nil, v.err
+	}
+	if v.current == nil {
+		return nil, errors.New("root before init")
+	}
+	return bytes.Clone(v.current), nil
+}
+
+// VerifySumProofHexRoot verifies a Merkle proof for a sum trie against a root
+// provided as a hex string. ErrMalformedRoot is returned if the string is of
+// odd length, is not valid hex or does not decode to a root of the length
+// produced by the spec provided.
+func VerifySumProofHexRoot(proof *SparseMerkleProof, rootHex string, key, value []byte, sum uint64, spec *TrieSpec) (bool, error) {
+	if len(rootHex)%2 != 0 {
+		return false, fmt.Errorf("%w: odd length hex root %d", ErrMalformedRoot, len(rootHex))
+	}
+	root, err := hex.DecodeString(rootHex)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrMalformedRoot, err)
+	}
+	if len(root) != hashSize(spec) {
+		return false, fmt.Errorf("%w: invalid root length %d, expected %d", ErrMalformedRoot, len(root), hashSize(spec))
+	}
+	return VerifySumProof(proof, root, key, value, sum, spec)
+}
+
+// NormalizeSumBytes returns the canonical 8 byte big-endian encoding of the sum
+// provided as up to 8 big-endian bytes, such as a sum received from a peer with
+// its leading zero bytes stripped, by right-aligning it. ErrMalformedSum is
+// returned if more than 8 bytes are provided.
+func NormalizeSumBytes(b []byte) ([sumSize]byte, error) {
+	var sum [sumSize]byte
+	if len(b) > sumSize {
+		return sum, fmt.Errorf("%w: %d bytes, expected at most %d", ErrMalformedSum, len(b), sumSize)
+	}
+	copy(sum[sumSize-len(b):], b)
+	return sum, nil
+}
+
+// VerifySumProofSumBytes is similar to VerifySumProof but for a sum provided
+// as big-endian bytes, which are normalized with NormalizeSumBytes so that
+// leading zero bytes may be stripped or present.
+func VerifySumProofSumBytes(proof *SparseMerkleProof, root, key, value, sumBytes []byte, spec *TrieSpec) (bool, error) {
+	sum, err := NormalizeSumBytes(sumBytes)
+	if err != nil {
+		return false, err
+	}
+	return VerifySumProof(proof, root, key, value, binary.BigEndian.Uint64(sum[:]), spec)
+}
+
+// VerifyAgainstCheckpoint verifies a Merkle proof for a sum trie against a
+// root that must be one of a set of checkpointed roots, for verifiers trusting
+// the checkpoints rather than a single live root. False is returned if the
+// root is not checkpointed, otherwise the proof is verified as VerifySumProof.
+func VerifyAgainstCheckpoint(
+	proof *SparseMerkleProof,
+	checkpointRoots [][]byte,
+	root, key, value []byte,
+	sum uint64,
+	spec *TrieSpec,
+) (bool, error) {
+	for _, checkpoint := range checkpointRoots {
+		if bytes.Equal(checkpoint, root) {
+			return VerifySumProof(proof, root, key, value, sum, spec)
+		}
+	}
+	return false, nil
+}
+
+// VerifyCrossTreeSumProof verifies that the inner key, value and sum provided
+// are in an inner sum trie whose root is itself committed to by an outer sum
+// trie, in which the leaves are the roots of inner tries. The inner proof is
+// verified against the inner root, and the outer proof is verified to show the
+// outer key maps to the inner root as its value, with the sum of the inner trie
+// (taken from the inner root) as its sum. Both tries must use the spec given.
+func VerifyCrossTreeSumProof(
+	outerRoot, innerKey []byte,
+	outerProof, innerProof *SparseMerkleProof,
+	innerRoot, outerKey, innerValue []byte,
+	innerSum uint64,
+	spec *TrieSpec,
+) (bool, error) {
+	if len(innerRoot) != hashSize(spec) {
+		return false, fmt.Errorf("%w: invalid inner root length %d, expected %d",
+			ErrMalformedRoot, len(innerRoot), hashSize(spec))
+	}
+	valid, err := VerifySumProof(innerProof, innerRoot, innerKey, innerValue, innerSum, spec)
+	if err != nil || !valid {
+		return false, err
+	}
+	innerTotal := binary.BigEndian.Uint64(spec.th.digestSum(innerRoot))
+	return VerifySumProof(outerProof, outerRoot, outerKey, innerRoot, innerTotal, spec)
+}
+
+// VerifyNonMembershipSumProofDetailed verifies a Merkle proof that the key
+// provided is absent from a sum trie. When the proof is valid it also returns
+// the path of the unrelated leaf found at the position of the key, which is
+// nil if the position is an empty (placeholder) subtrie.
+func VerifyNonMembershipSumProofDetailed(
+	proof *SparseMerkleProof,
+	root, key []byte,
+	spec *TrieSpec,
+) (valid bool, encounteredLeafPath []byte, err error) {
+	valid, err = VerifySumProof(proof, root, key, defaultValue, 0, spec)
+	if err != nil || !valid {
+		return false, nil, err
+	}
+	if proof.NonMembershipLeafData == nil {
+		return true, nil, nil
+	}
+	encounteredLeafPath, _ = parseLeaf(proof.NonMembershipLeafData, spec.ph)
+	return true, encounteredLeafPath, nil
+}
+
+// VerifyLeafInSubtree verifies that the leaf with the key, value and sum
+// provided is a member of the subtrie committed to by subtreeRoot, a sum trie
+// node digest with its sum appended. The proof provided is a membership proof
+// for the leaf from the root of the full trie, of which only the side nodes of
+// the subtreeDepth levels closest to the leaf are used to recompute the root
+// of the subtrie. A subtreeDepth of 0 compares the leaf digest itself.
+func VerifyLeafInSubtree(
+	proof *SparseMerkleProof,
+	subtreeRoot, key, value []byte,
+	sum uint64,
+	subtreeDepth int,
+	spec *TrieSpec,
+) (bool, error) {
+	if err := proof.validateBasic(spec); err != nil {
+		return false, errors.Join(ErrBadProof, err)
+	}
+	if err := checkSpecFingerprint(proof, spec); err != nil {
+		return false, err
+	}
+	if subtreeDepth < 0 || subtreeDepth > len(proof.SideNodes) {
+		return false, errors.Join(ErrBadProof, fmt.Errorf(
+			"subtree depth %d out of range [0, %d]", subtreeDepth, len(proof.SideNodes),
+		))
+	}
+	valueHash, err := sumValueHash(value, sum, spec)
+	if err != nil {
+		return false, err
+	}
+	smtSpec := sumProofSpec(spec)
+	path := smtSpec.ph.Path(key)
+	currentHash, _ := digestLeaf(smtSpec, path, valueHash)
+	for i := 0; i < subtreeDepth; i++ {
+		node := make([]byte, hashSize(smtSpec))
+		copy(node, proof.SideNodes[i])
+		if getPathBit(path, len(proof.SideNodes)-1-i) == left {
+			currentHash, _ = digestNode(smtSpec, currentHash, node)
+		} else {
+			currentHash, _ = digestNode(smtSpec, node, currentHash)
+		}
+	}
+	return bytes.Equal(currentHash, subtreeRoot), nil
+}
+
+// KeyValueSumProof is a key, value and sum together with the proof to verify
+// them with
+type KeyValueSumProof struct {
+	Key   []byte
+	Value []byte
+	Sum   uint64
+	Proof *SparseMerkleProof
+}
+
+// VerifySumProofsSameRoot verifies many Merkle proofs against the same root,
+// returning the result of each verification in the order of the items
+// provided. It is equivalent to calling VerifySumProof for every item, but the
+// spec used for the verifications is derived once and shared by all of them.
+// If any item fails to verify with an error, verification stops and the error
+// is returned together with the index of the item. No items, whether nil or
+// empty, return nil results.
+func VerifySumProofsSameRoot(root []byte, items []KeyValueSumProof, spec *TrieSpec) ([]bool, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	smtSpec := sumProofSpec(spec)
+	results := make([]bool, len(items))
+	for i, item := range items {
+		valueHash, err := sumValueHash(item.Value, item.Sum, spec)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, err)
+		}
+		if err = checkSpecFingerprint(item.Proof, spec); err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, err)
+		}
+		if results[i], _, err = verifyProofWithUpdates(item.Proof, root, item.Key, valueHash, smtSpec); err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, err)
+		}
+	}
+	return results, nil
+}
+
+// sumValueHash returns the data stored in a sum trie leaf for the value and
+// sum provided: [value hash]+[sum], or the default value for an empty leaf
+func sumValueHash(value []byte, sum uint64, spec *TrieSpec) ([]byte, error) {
 	if bytes.Equal(value, defaultValue) && sum == 0 {
-		valueHash = defaultValue
+		return defaultValue, nil
+	}
+	valueHash, err := spec.encodeValue(value)
+	if err != nil {
+		return nil, err
 	}
+	var sumBz [sumSize]byte
+	binary.BigEndian.PutUint64(sumBz[:], sum)
+	return append(valueHash, sumBz[:]...), nil
+}
+
+// sumProofSpec returns a copy of the sum trie spec provided without a value
+// hasher, used to verify proofs against leaf data from sumValueHash
+func sumProofSpec(spec *TrieSpec) *TrieSpec {
 	smtSpec := &TrieSpec{
-		th:      spec.th,
-		ph:      spec.ph,
-		vh:      spec.vh,
-		sumTrie: spec.sumTrie,
+		th:                spec.th,
+		ph:                spec.ph,
+		vh:                spec.vh,
+		sumTrie:           spec.sumTrie,
+		maxDepth:          spec.maxDepth,
+		maxProofSideNodes: spec.maxProofSideNodes,
 	}
 	nvh := WithValueHasher(nil)
 	nvh(smtSpec)
-	return VerifyProof(proof, root, key, valueHash, smtSpec)
+	return smtSpec
 }
 
 // VerifyClosestProof verifies a Merkle proof for a proof of inclusion for a leaf
@@ -321,35 +1272,31 @@ func VerifyClosestProof(proof *SparseMerkleClosestProof, root []byte, spec *Trie
 }
 
 func verifyProofWithUpdates(proof *SparseMerkleProof, root []byte, key []byte, value []byte, spec *TrieSpec) (bool, [][][]byte, error) {
+	currentHash, updates, err := computeProofRoot(proof, key, value, spec)
+	if err != nil {
+		return false, nil, err
+	}
+	return bytes.Equal(currentHash, root), updates, nil
+}
+
+// computeProofRoot recomputes the root committed to by the proof for the key
+// and value provided, returning it with the digest and preimage of each node
+// along the path from the leaf upwards
+func computeProofRoot(proof *SparseMerkleProof, key []byte, value []byte, spec *TrieSpec) ([]byte, [][][]byte, error) {
 	path := spec.ph.Path(key)
 
 	if err := proof.validateBasic(spec); err != nil {
-		return false, nil, errors.Join(ErrBadProof, err)
+		return nil, nil, errors.Join(ErrBadProof, err)
 	}
 
 	var updates [][][]byte
 
 	// Determine what the leaf hash should be.
-	var currentHash, currentData []byte
-	if bytes.Equal(value, defaultValue) { // Non-membership proof.
-		if proof.NonMembershipLeafData == nil { // Leaf is a placeholder value.
-			currentHash = placeholder(spec)
-		} else { // Leaf is an unrelated leaf.
-			var actualPath, valueHash []byte
-			actualPath, valueHash = parseLeaf(proof.NonMembershipLeafData, spec.ph)
-			if bytes.Equal(actualPath, path) {
-				// This is not an unrelated leaf; non-membership proof failed.
-				return false, nil, errors.Join(ErrBadProof, errors.New("non-membership proof on related leaf"))
-			}
-			currentHash, currentData = digestLeaf(spec, actualPath, valueHash)
-
-			update := make([][]byte, 2)
-			update[0], update[1] = currentHash, currentData
-			updates = append(updates, update)
-		}
-	} else { // Membership proof.
-		valueHash := spec.digestValue(value)
-		currentHash, currentData = digestLeaf(spec, path, valueHash)
+	currentHash, currentData, err := proofLeafDigest(proof.NonMembershipLeafData, path, value, spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if currentData != nil {
 		update := make([][]byte, 2)
 		update[0], update[1] = currentHash, currentData
 		updates = append(updates, update)
@@ -371,7 +1318,34 @@ func verifyProofWithUpdates(proof *SparseMerkleProof, root []byte, key []byte, v
 		updates = append(updates, update)
 	}
 
-	return bytes.Equal(currentHash, root), updates, nil
+	return currentHash, updates, nil
+}
+
+// proofLeafDigest returns the digest and preimage of the leaf a proof for the
+// path and value provided is computed from. For non-membership proofs this is
+// the unrelated leaf in the proof or, if there is none, the placeholder whose
+// preimage is nil.
+func proofLeafDigest(nonMembershipLeafData, path, value []byte, spec *TrieSpec) ([]byte, []byte, error) {
+	if !bytes.Equal(value, defaultValue) { // Membership proof.
+		valueHash, err := spec.encodeValue(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		hash, data := digestLeaf(spec, path, valueHash)
+		return hash, data, nil
+	}
+	// Non-membership proof.
+	if nonMembershipLeafData == nil { // Leaf is a placeholder value.
+		return placeholder(spec), nil, nil
+	}
+	// Leaf is an unrelated leaf.
+	actualPath, valueHash := parseLeaf(nonMembershipLeafData, spec.ph)
+	if bytes.Equal(actualPath, path) {
+		// This is not an unrelated leaf; non-membership proof failed.
+		return nil, nil, errors.Join(ErrBadProof, errors.New("non-membership proof on related leaf"))
+	}
+	hash, data := digestLeaf(spec, actualPath, valueHash)
+	return hash, data, nil
 }
 
 // VerifyCompactProof is similar to VerifyProof but for a compacted Merkle proof.
@@ -392,6 +1366,291 @@ func VerifyCompactSumProof(proof *SparseCompactMerkleProof, root []byte, key, va
 	return VerifySumProof(decompactedProof, root, key, value, sum, spec)
 }
 
+// VerifyDeltaSumProof is similar to VerifySumProof but for a DeltaProof, which
+// is expanded with the set of known digests it was generated with.
+func VerifyDeltaSumProof(
+	proof *DeltaProof,
+	knownNodes map[string]bool,
+	root, key, value []byte,
+	sum uint64,
+	spec *TrieSpec,
+) (bool, error) {
+	full, err := proof.Expand(knownNodes)
+	if err != nil {
+		return false, err
+	}
+	return VerifySumProof(full, root, key, value, sum, spec)
+}
+
+// VerifyCompactSumProofBytes is similar to VerifyCompactSumProof but for a
+// compact proof serialized with SparseCompactMerkleProof.Marshal. Bytes that
+// cannot be unmarshaled return ErrMalformedProof, whereas a proof that is
+// malformed or does not verify returns ErrBadProof or false respectively.
+func VerifyCompactSumProofBytes(proofBytes, root, key, value []byte, sum uint64, spec *TrieSpec) (bool, error) {
+	proof := new(SparseCompactMerkleProof)
+	if err := proof.Unmarshal(proofBytes); err != nil {
+		return false, fmt.Errorf("%w: %w", ErrMalformedProof, err)
+	}
+	return VerifyCompactSumProof(proof, root, key, value, sum, spec)
+}
+
+// UpdateCompactSumProof computes the root of the sum trie that results from
+// setting the leaf of the key proven by the compact proof provided, from its old
+// value and sum to the new ones, using only the proof. As with VerifySumProof a
+// nil value with a zero sum stands for an absent key. Removing a key relies on
+// the proof's SiblingData, and ErrBadProof is returned if it is missing while
+// the sibling is not empty. The proof is not verified, it should first be
+// checked against the current root with VerifyCompactSumProof and the same old
+// value and sum.
+func UpdateCompactSumProof(
+	proof *SparseCompactMerkleProof,
+	oldKey, oldValue []byte,
+	oldSum uint64,
+	newValue []byte,
+	newSum uint64,
+	spec *TrieSpec,
+) ([]byte, error) {
+	decompactedProof, err := DecompactProof(proof, spec)
+	if err != nil {
+		return nil, errors.Join(ErrBadProof, err)
+	}
+	if err := checkSpecFingerprint(decompactedProof, spec); err != nil {
+		return nil, err
+	}
+	path := spec.ph.Path(oldKey)
+	oldLeafData, err := provenLeafData(decompactedProof, path, oldValue, oldSum, spec)
+	if err != nil {
+		return nil, err
+	}
+	valueHash, err := sumValueHash(newValue, newSum, spec)
+	if err != nil {
+		return nil, err
+	}
+	return updatedProofRoot(decompactedProof, path, oldLeafData, valueHash, sumProofSpec(spec))
+}
+
+// VerifySumProofAndComputeNewRoot verifies the proof of the key with its old
+// value and sum against the old root, and if valid returns the root of the sum
+// trie that results from setting the key to the new value and sum, computed
+// from the same side nodes. As with VerifySumProof a nil value with a zero sum
+// stands for an absent key, so the proof of an absent key yields the root
+// after its insertion, and a nil new value with a zero sum the root after its
+// removal. The new root is nil if the proof is invalid, and ErrBadProof is
+// returned if the key's removal needs the proof's SiblingData and it is missing.
+func VerifySumProofAndComputeNewRoot(
+	proof *SparseMerkleProof,
+	oldRoot, key, oldValue []byte,
+	oldSum uint64,
+	newValue []byte,
+	newSum uint64,
+	spec *TrieSpec,
+) (valid bool, newRoot []byte, err error) {
+	valid, err = VerifySumProof(proof, oldRoot, key, oldValue, oldSum, spec)
+	if err != nil || !valid {
+		return false, nil, err
+	}
+	path := spec.ph.Path(key)
+	oldLeafData, err := provenLeafData(proof, path, oldValue, oldSum, spec)
+	if err != nil {
+		return false, nil, err
+	}
+	valueHash, err := sumValueHash(newValue, newSum, spec)
+	if err != nil {
+		return false, nil, err
+	}
+	newRoot, err = updatedProofRoot(proof, path, oldLeafData, valueHash, sumProofSpec(spec))
+	if err != nil {
+		return false, nil, err
+	}
+	return true, newRoot, nil
+}
+
+// VerifyDeletionProof verifies that the key was in the sum trie at the old root
+// and that the new root is that of the same trie with the key removed, so the
+// key is absent at the new root. The old state is verified from the proof's
+// leaf data, so the value and sum the key had need not be known. ErrBadProof
+// is returned if the proof lacks the SiblingData needed to remove the leaf.
+func VerifyDeletionProof(proof *DeletionProof, oldRoot, newRoot, key []byte, spec *TrieSpec) (bool, error) {
+	if proof == nil || proof.Proof == nil {
+		return false, errors.Join(ErrBadProof, errors.New("missing membership proof"))
+	}
+	if len(proof.LeafData) < len(leafPrefix) {
+		return false, fmt.Errorf("%w: size %d too small", ErrMalformedLeafData, len(proof.LeafData))
+	}
+	if err := checkLeafData(proof.LeafData, spec); err != nil {
+		return false, err
+	}
+	path := spec.ph.Path(key)
+	if leafPath, _ := parseLeaf(proof.LeafData, spec.ph); !bytes.Equal(leafPath, path) {
+		return false, nil
+	}
+	leafHash := hashPreimage(spec, proof.LeafData)
+	valid, err := VerifySumProofByLeafHash(proof.Proof, oldRoot, leafHash, path, spec)
+	if err != nil || !valid {
+		return false, err
+	}
+	removedRoot, err := updatedProofRoot(proof.Proof, path, proof.LeafData, defaultValue, sumProofSpec(spec))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(removedRoot, newRoot), nil
+}
+
+// provenLeafData returns the data of the leaf a proof of the key at the path
+// provided with the value and sum given is verified from: the key's own leaf if
+// the value and sum are set, otherwise the proof's unrelated leaf, or nil if the
+// path ends in an empty subtrie. It is derived from the value verified rather
+// than from the proof's flags, which the root does not commit to.
+func provenLeafData(proof *SparseMerkleProof, path, value []byte, sum uint64, spec *TrieSpec) ([]byte, error) {
+	valueHash, err := sumValueHash(value, sum, spec)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(valueHash, defaultValue) {
+		return proof.NonMembershipLeafData, nil
+	}
+	return encodeLeaf(path, valueHash), nil
+}
+
+// updatedProofRoot returns the root resulting from setting the leaf at the
+// path of the proof provided to the value hash provided, removing it if the
+// value hash is the default value, mirroring the changes Update and Delete
+// make to the trie. The old leaf data is that of the leaf the proof was
+// verified from, nil if the path ended in an empty subtrie. ErrBadProof is
+// returned if the key's leaf is removed and the proof lacks the SiblingData
+// needed to tell whether its sibling moves up.
+func updatedProofRoot(proof *SparseMerkleProof, path, oldLeafData, valueHash []byte, spec *TrieSpec) ([]byte, error) {
+	sideNodes := proof.SideNodes
+	var current, oldPath []byte
+	if oldLeafData != nil {
+		oldPath, _ = parseLeaf(oldLeafData, spec.ph)
+	}
+	unrelated := oldLeafData != nil && !bytes.Equal(oldPath, path)
+	switch {
+	case !bytes.Equal(valueHash, defaultValue) && unrelated:
+		// The new leaf and the unrelated leaf are placed below an inner node
+		// at the depth their paths diverge, with empty subtries above it
+		prefixLen := countCommonPrefixBits(path, oldPath, len(sideNodes))
+		leafHash, _ := digestLeaf(spec, path, valueHash)
+		otherHash := hashPreimage(spec, oldLeafData)
+		if getPathBit(path, prefixLen) == left {
+			current, _ = digestNode(spec, leafHash, otherHash)
+		} else {
+			current, _ = digestNode(spec, otherHash, leafHash)
+		}
+		for depth := prefixLen - 1; depth >= len(sideNodes); depth-- {
+			if getPathBit(path, depth) == left {
+				current, _ = digestNode(spec, current, placeholder(spec))
+			} else {
+				current, _ = digestNode(spec, placeholder(spec), current)
+			}
+		}
+	case !bytes.Equal(valueHash, defaultValue):
+		current, _ = digestLeaf(spec, path, valueHash)
+	case unrelated:
+		// Removing an absent key leaves the trie unchanged
+		current = hashPreimage(spec, oldLeafData)
+	case oldLeafData == nil || len(sideNodes) == 0 || bytes.Equal(sideNodes[0], placeholder(spec)):
+		current = placeholder(spec)
+	case len(proof.SiblingData) == 0:
+		return nil, errors.Join(ErrBadProof, errors.New("missing sibling data of removed leaf"))
+	case isLeaf(proof.SiblingData):
+		// A sibling leaf moves up past the empty subtries above the removed leaf
+		current = hashPreimage(spec, proof.SiblingData)
+		sideNodes = sideNodes[1:]
+		for len(sideNodes) > 0 && bytes.Equal(sideNodes[0], placeholder(spec)) {
+			sideNodes = sideNodes[1:]
+		}
+	default:
+		current = placeholder(spec)
+	}
+	for i, node := range sideNodes {
+		if getPathBit(path, len(sideNodes)-1-i) == left {
+			current, _ = digestNode(spec, current, node)
+		} else {
+			current, _ = digestNode(spec, node, current)
+		}
+	}
+	return current, nil
+}
+
+// VerifyCompactSumProofStreaming is equivalent to VerifyCompactSumProof, but
+// recomputes the root directly from the bit mask and compacted side nodes of
+// the proof instead of first decompacting it, so the side nodes are never
+// copied into a full array.
+func VerifyCompactSumProofStreaming(
+	proof *SparseCompactMerkleProof,
+	root, key, value []byte,
+	sum uint64,
+	spec *TrieSpec,
+) (bool, error) {
+	if err := proof.validateBasic(spec); err != nil {
+		return false, errors.Join(ErrBadProof, err)
+	}
+	if err := checkFingerprint(proof.SpecFingerprint, spec); err != nil {
+		return false, err
+	}
+	// Perform the checks of the decompacted proof's validateBasic
+	lps := len(leafPrefix) + spec.ph.PathSize()
+	if proof.NonMembershipLeafData != nil && len(proof.NonMembershipLeafData) < lps {
+		return false, errors.Join(ErrBadProof, fmt.Errorf(
+			"invalid non-membership leaf data size: got %d but min is %d", len(proof.NonMembershipLeafData), lps,
+		))
+	}
+	if proof.NonMembershipLeafData != nil {
+		if err := checkLeafData(proof.NonMembershipLeafData, spec); err != nil {
+			return false, errors.Join(ErrBadProof, err)
+		}
+	}
+	empty := placeholder(spec)
+	var sideNodes [][]byte
+	if proof.NumSideNodes > 0 {
+		sideNodes = proof.SideNodes
+	}
+	for _, v := range sideNodes {
+		if len(v) != hashSize(spec) {
+			return false, errors.Join(ErrBadProof, fmt.Errorf(
+				"invalid side node size: got %d but want %d", len(v), hashSize(spec),
+			))
+		}
+	}
+	if proof.SiblingData != nil && proof.NumSideNodes > 0 {
+		first := empty
+		if getPathBit(proof.BitMask, 0) == 0 {
+			first = sideNodes[0]
+		}
+		if siblingHash := hashPreimage(spec, proof.SiblingData); !bytes.Equal(first, siblingHash) {
+			return false, errors.Join(ErrBadProof, fmt.Errorf(
+				"invalid sibling data hash: got %x but want %x", siblingHash, first,
+			))
+		}
+	}
+
+	valueHash, err := sumValueHash(value, sum, spec)
+	if err != nil {
+		return false, err
+	}
+	smtSpec := sumProofSpec(spec)
+	path := smtSpec.ph.Path(key)
+	currentHash, _, err := proofLeafDigest(proof.NonMembershipLeafData, path, valueHash, smtSpec)
+	if err != nil {
+		return false, err
+	}
+	for i, position := 0, 0; i < proof.NumSideNodes; i++ {
+		node := empty
+		if getPathBit(proof.BitMask, i) == 0 {
+			node = sideNodes[position]
+			position++
+		}
+		if getPathBit(path, proof.NumSideNodes-1-i) == left {
+			currentHash, _ = digestNode(smtSpec, currentHash, node)
+		} else {
+			currentHash, _ = digestNode(smtSpec, node, currentHash)
+		}
+	}
+	return bytes.Equal(currentHash, root), nil
+}
+
 // VerifyCompactClosestProof is similar to VerifyClosestProof but for a compacted merkle proof
 func VerifyCompactClosestProof(proof *SparseCompactMerkleClosestProof, root []byte, spec *TrieSpec) (bool, error) {
 	decompactedProof, err := DecompactClosestProof(proof, spec)
@@ -407,7 +1666,7 @@ func CompactProof(proof *SparseMerkleProof, spec *TrieSpec) (*SparseCompactMerkl
 		return nil, errors.Join(ErrBadProof, err)
 	}
 
-	bitMask := make([]byte, int(math.Ceil(float64(len(proof.SideNodes))/float64(8))))
+	bitMask := make([]byte, bitMaskLen(len(proof.SideNodes)))
 	var compactedSideNodes [][]byte
 	for i := 0; i < len(proof.SideNodes); i++ {
 		node := make([]byte, hashSize(spec))
@@ -425,6 +1684,8 @@ func CompactProof(proof *SparseMerkleProof, spec *TrieSpec) (*SparseCompactMerkl
 		BitMask:               bitMask,
 		NumSideNodes:          len(proof.SideNodes),
 		SiblingData:           proof.SiblingData,
+		EmptyLeaf:             proof.EmptyLeaf,
+		SpecFingerprint:       proof.SpecFingerprint,
 	}, nil
 }
 
@@ -452,6 +1713,8 @@ func DecompactProof(proof *SparseCompactMerkleProof, spec *TrieSpec) (*SparseMer
 		SideNodes:             decompactedSideNodes,
 		NonMembershipLeafData: proof.NonMembershipLeafData,
 		SiblingData:           proof.SiblingData,
+		EmptyLeaf:             proof.EmptyLeaf,
+		SpecFingerprint:       proof.SpecFingerprint,
 	}, nil
 }
 
@@ -206,3 +206,47 @@ func checkClosestCompactEquivalence(t *testing.T, proof *SparseMerkleClosestProo
 	require.NoErrorf(t, err, "failed to decompact proof: %v", err)
 	require.Equal(t, proof, decompactedProof)
 }
+
+// countSetBitsKernighan is the previous implementation of countSetBits, using
+// Kernighan's method, which countSetBits must match
+func countSetBitsKernighan(data []byte) int {
+	count := 0
+	for _, b := range data {
+		for b != 0 {
+			b = b & (b - 1) // unset the rightmost set bit
+			count++
+		}
+	}
+	return count
+}
+
+func TestCountSetBits(t *testing.T) {
+	all := make([]byte, 0, 256)
+	for i := 0; i < 256; i++ {
+		b := []byte{byte(i)}
+		require.Equal(t, countSetBitsKernighan(b), countSetBits(b), "byte %08b", i)
+		all = append(all, byte(i))
+	}
+	require.Equal(t, 256*8/2, countSetBits(all))
+	require.Zero(t, countSetBits(nil))
+}
+
+func BenchmarkCountSetBits(b *testing.B) {
+	// The bit mask of a compact proof with the maximum number of side nodes
+	// for a 32 byte path
+	mask := make([]byte, bitMaskLen(256))
+	_, err := rand.Read(mask)
+	require.NoError(b, err)
+	b.Run("OnesCount8", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = countSetBits(mask)
+		}
+	})
+	b.Run("Kernighan", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = countSetBitsKernighan(mask)
+		}
+	})
+}
@@ -80,3 +80,44 @@ func getSumBzHelper(t *testing.T, r []byte) uint64 {
 	copy(sumBz[:], []byte(r)[len([]byte(r))-sumSize:])
 	return binary.BigEndian.Uint64(sumBz[:])
 }
+
+func TestParseSumRoot(t *testing.T) {
+	nodeStore := simplemap.NewSimpleMap()
+	trie := smt.NewSparseMerkleSumTrie(nodeStore, sha256.New())
+	for i := uint64(0); i < 10; i++ {
+		require.NoError(t, trie.Update([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), i))
+	}
+	root := trie.Root()
+
+	hash, sum, err := smt.ParseSumRoot(root, trie.Spec())
+	require.NoError(t, err)
+	require.Equal(t, []byte(root[:sha256.Size]), hash)
+	require.Equal(t, trie.Sum(), sum)
+	require.Equal(t, uint64(45), sum)
+
+	// Roots are split according to the hash size and layout of the spec
+	truncated := smt.NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), smt.WithHashSize(24))
+	legacy := smt.NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), smt.WithLegacyNodeLayout())
+	for _, other := range []*smt.SMST{truncated, legacy} {
+		require.NoError(t, other.Update([]byte("key"), []byte("value"), 45))
+	}
+	hash, sum, err = smt.ParseSumRoot(truncated.Root(), truncated.Spec())
+	require.NoError(t, err)
+	require.Equal(t, uint64(45), sum)
+	require.Equal(t, []byte(truncated.Root()[:24]), hash)
+	hash, sum, err = smt.ParseSumRoot(legacy.Root(), legacy.Spec())
+	require.NoError(t, err)
+	require.Equal(t, uint64(45), sum)
+	require.Equal(t, []byte(legacy.Root()[8:]), hash)
+
+	// Malformed roots are rejected
+	_, _, err = smt.ParseSumRoot(root[:sha256.Size], trie.Spec())
+	require.ErrorIs(t, err, smt.ErrMalformedRoot)
+	_, _, err = smt.ParseSumRoot([]byte{1, 2, 3}, trie.Spec())
+	require.ErrorIs(t, err, smt.ErrMalformedRoot)
+	_, _, err = smt.ParseSumRoot(nil, trie.Spec())
+	require.ErrorIs(t, err, smt.ErrMalformedRoot)
+	plain := smt.NewSparseMerkleTrie(simplemap.NewSimpleMap(), sha256.New())
+	_, _, err = smt.ParseSumRoot(root, plain.Spec())
+	require.ErrorIs(t, err, smt.ErrMalformedRoot)
+}
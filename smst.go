@@ -3,7 +3,15 @@ package smt
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"hash"
+	"io"
+	"math/bits"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pokt-network/smt/kvstore"
 )
@@ -16,7 +24,9 @@ type SMST struct {
 	*SMT
 }
 
-// NewSparseMerkleSumTrie returns a pointer to an SMST struct
+// NewSparseMerkleSumTrie returns a pointer to an SMST struct. It panics with
+// ErrUnsupportedHashSize if the output size of the hasher is below 16 or above
+// 64 bytes.
 func NewSparseMerkleSumTrie(
 	nodes kvstore.MapStore,
 	hasher hash.Hash,
@@ -41,6 +51,21 @@ func NewSparseMerkleSumTrie(
 	return smst
 }
 
+// newSparseMerkleSumTrieFromSpec returns a pointer to an SMST struct using the
+// TrieSpec provided for the hashing of its nodes, keys and values
+func newSparseMerkleSumTrieFromSpec(nodes kvstore.MapStore, spec *TrieSpec) *SMST {
+	smt := &SMT{
+		TrieSpec: *spec,
+		nodes:    nodes,
+	}
+	nvh := WithValueHasher(nil)
+	nvh(&smt.TrieSpec)
+	return &SMST{
+		TrieSpec: *spec,
+		SMT:      smt,
+	}
+}
+
 // ImportSparseMerkleSumTrie returns a pointer to an SMST struct with the root hash provided
 func ImportSparseMerkleSumTrie(
 	nodes kvstore.MapStore,
@@ -59,8 +84,8 @@ func (smst *SMST) Spec() *TrieSpec {
 	return &smst.TrieSpec
 }
 
-// Get returns the digest of the value stored at the given key and the weight
-// of the leaf node
+// Get returns the digest of the value stored at the given key (or the value
+// itself if a ValueCodec is set) and the weight of the leaf node
 func (smst *SMST) Get(key []byte) ([]byte, uint64, error) {
 	valueHash, err := smst.SMT.Get(key)
 	if err != nil {
@@ -69,31 +94,536 @@ func (smst *SMST) Get(key []byte) ([]byte, uint64, error) {
 	if bytes.Equal(valueHash, defaultValue) {
 		return defaultValue, 0, nil
 	}
+	return smst.decodeSumValue(valueHash)
+}
+
+// GetVerified returns the weight of the leaf stored at the given key and
+// whether the value stored in it is the expected value provided, by hashing
+// (or encoding, if a ValueCodec is set) the expected value and comparing it to
+// the stored value hash. An absent key returns a weight of 0 and false.
+func (smst *SMST) GetVerified(key, expectedValue []byte) (sum uint64, ok bool, err error) {
+	leaf, err := smst.readView().getLeaf(smst.ph.Path(key))
+	if err != nil || leaf == nil {
+		return 0, false, err
+	}
+	expectedHash, err := smst.encodeValue(expectedValue)
+	if err != nil {
+		return 0, false, err
+	}
+	valueHash := leaf.valueHash[:len(leaf.valueHash)-sumSize]
+	sum = binary.BigEndian.Uint64(leaf.valueHash[len(leaf.valueHash)-sumSize:])
+	return sum, bytes.Equal(valueHash, expectedHash), nil
+}
+
+// GetMany returns the values stored at each of the given keys and the weights
+// of their leaf nodes, as Get does, in the order of the keys provided. All of
+// the keys are looked up in a single descent of the trie so that nodes shared
+// by their paths are only loaded from the node store once. Absent keys have
+// defaultValue and a weight of 0 at their index. No keys, whether nil or
+// empty, return nil results.
+func (smst *SMST) GetMany(keys [][]byte) (values [][]byte, sums []uint64, err error) {
+	if len(keys) == 0 {
+		return nil, nil, nil
+	}
+	paths := make([][]byte, len(keys))
+	for i, key := range keys {
+		paths[i] = smst.ph.Path(key)
+	}
+	leaves, err := smst.readView().getLeaves(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	values = make([][]byte, len(keys))
+	sums = make([]uint64, len(keys))
+	for i, leaf := range leaves {
+		if leaf == nil {
+			values[i] = defaultValue
+			continue
+		}
+		values[i], sums[i], err = smst.decodeSumValue(leaf.valueHash)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return values, sums, nil
+}
+
+// decodeSumValue splits the value hash of a leaf node into its value, decoded
+// if a ValueCodec is set, and its weight
+func (smst *SMST) decodeSumValue(valueHash []byte) ([]byte, uint64, error) {
 	var weightBz [sumSize]byte
 	copy(weightBz[:], valueHash[len(valueHash)-sumSize:])
 	weight := binary.BigEndian.Uint64(weightBz[:])
-	return valueHash[:len(valueHash)-sumSize], weight, nil
+	value, err := smst.decodeValue(valueHash[:len(valueHash)-sumSize])
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, weight, nil
+}
+
+// SubtreeRoot returns the digest, with its sum appended, and the sum of the
+// subtrie rooted at the node reached by descending the first prefixBits bits
+// of the path prefix provided, or the placeholder digest and a sum of 0 if the
+// subtrie is empty. A subtrie holding a single leaf has the digest of the leaf.
+// If the prefix ends inside of an extension node, the digest of the part of
+// the extension below the prefix is returned, which is the digest the subtrie
+// would have if the extension were expanded into single child inner nodes.
+// A leaf committed to by the returned digest can be verified with
+// VerifyLeafInSubtree.
+func (smst *SMST) SubtreeRoot(prefix []byte, prefixBits int) (root []byte, sum uint64, err error) {
+	root, err = smst.readView().subtreeRoot(prefix, prefixBits)
+	if err != nil {
+		return nil, 0, err
+	}
+	return root, binary.BigEndian.Uint64(smst.th.digestSum(root)), nil
+}
+
+// ProveFirstDifference finds the first subtrie, in path order, whose leaves
+// differ between the trie and a peer's trie with the root provided, and returns
+// a path in it with a proof of the trie's leaf at that path: a membership proof
+// if the trie has a leaf there, otherwise a non-membership proof. No difference
+// is found, and a nil path and proof are returned, if the roots are equal.
+//
+// The subtrie is that at the first d bits of the path returned, where d is the
+// number of side nodes of the proof. No leaf with a lower path outside of it
+// differs between the tries, and it holds at most one leaf of this trie: either
+// the leaf at the path returned, or none, in which case the path is the lowest
+// of the subtrie and the difference is in the leaves the peer holds there. If
+// the peer has no leaves in it, the leaf returned is the first difference.
+//
+// Only the digests of the peer's subtries are fetched, lazily, with the
+// callback provided: fetchSibling(path, depth) must return the peer's digest,
+// with its sum, of the subtrie reached by following the first depth bits of
+// the path, as the peer's SubtreeRoot returns for the same arguments. The path
+// passed to the callback may be retained. The trie is walked node by node
+// towards the leftmost child whose digest differs from the peer's, stopping at
+// a leaf or an empty subtrie of either trie, so the callback is called once
+// per inner node on the path walked and, for each extension node on it, at
+// most once per bit it spans plus one. Two tries of a single leaf each are
+// compared without calling it.
+func (smst *SMST) ProveFirstDifference(
+	otherRoot []byte,
+	fetchSibling func(path []byte, depth int) ([]byte, error),
+) (diffPath []byte, myProof *SparseMerkleProof, err error) {
+	view := smst.readView()
+	if bytes.Equal(view.Root(), otherRoot) {
+		return nil, nil, nil
+	}
+	diffPath, err = view.firstDifference(otherRoot, fetchSibling)
+	if err != nil {
+		return nil, nil, err
+	}
+	myProof, err = view.prove(diffPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if smst.fingerprint {
+		fingerprint := SpecFingerprint(smst.Spec())
+		myProof.SpecFingerprint = fingerprint[:]
+	}
+	return diffPath, myProof, nil
+}
+
+// firstDifference returns a path in the first subtrie that differs from that
+// of the peer's trie with the root provided, as described by
+// ProveFirstDifference
+func (smt *SMT) firstDifference(
+	otherRoot []byte,
+	fetchSibling func(path []byte, depth int) ([]byte, error),
+) ([]byte, error) {
+	empty := placeholder(smt.Spec())
+	path := make([]byte, smt.ph.PathSize())
+	// theirs is the peer's digest of the subtrie being walked, if known
+	theirs := otherRoot
+	var err error
+	node := &smt.trie
+	for depth := 0; ; {
+		*node, err = smt.resolveLazy(*node)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(theirs, empty) {
+			// Every leaf of the subtrie differs, so its first is the difference
+			leaf, err := smt.edgeLeaf(*node, true)
+			if err != nil {
+				return nil, err
+			}
+			return leaf.path, nil
+		}
+		switch n := (*node).(type) {
+		case nil:
+			return path, nil
+		case *leafNode:
+			return n.path, nil
+		case *extensionNode:
+			// The subtries branching off the extension are empty in this trie,
+			// those to its left before the extension's child and those to its
+			// right after it, deepest first
+			var rightOf []int
+			for i := depth; i < n.pathEnd(); i++ {
+				if getPathBit(n.path, i) == left {
+					rightOf = append(rightOf, i)
+					continue
+				}
+				leftDigest, err := fetchSibling(bytes.Clone(path), i+1)
+				if err != nil {
+					return nil, err
+				}
+				if !bytes.Equal(leftDigest, empty) {
+					return path, nil
+				}
+				setPathBit(path, i)
+			}
+			depth = n.pathEnd()
+			if theirs, err = fetchSibling(bytes.Clone(path), depth); err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(theirs, hashNode(smt.Spec(), n.child)) {
+				node = &n.child
+				continue
+			}
+			for j := len(rightOf) - 1; j >= 0; j-- {
+				i := rightOf[j]
+				rightPath := make([]byte, len(path))
+				for b := 0; b < i; b++ {
+					if getPathBit(path, b) != left {
+						setPathBit(rightPath, b)
+					}
+				}
+				setPathBit(rightPath, i)
+				rightDigest, err := fetchSibling(bytes.Clone(rightPath), i+1)
+				if err != nil {
+					return nil, err
+				}
+				if !bytes.Equal(rightDigest, empty) {
+					return rightPath, nil
+				}
+			}
+			return nil, fmt.Errorf("%w: peer's subtries do not match its root", ErrBadProof)
+		case *innerNode:
+			// Descend to the left child if it differs and to the right otherwise
+			leftDigest, err := fetchSibling(bytes.Clone(path), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(leftDigest, hashNode(smt.Spec(), n.leftChild)) {
+				node, theirs = &n.leftChild, leftDigest
+			} else {
+				setPathBit(path, depth)
+				node, theirs = &n.rightChild, nil
+			}
+			depth++
+		}
+	}
+}
+
+// ClosestCandidate is a leaf considered by ProveClosestWeighted, identified by
+// its path as tries do not retain the original keys of their leaves.
+type ClosestCandidate struct {
+	Path         []byte
+	ValueHash    []byte // the value hash (or encoded value) without the sum
+	Sum          uint64
+	CommonPrefix int // the number of leading bits shared with the path proven
+}
+
+// ProveClosestWeighted generates a SparseMerkleClosestProof of inclusion for
+// the leaf closest to the path provided, as ProveClosest does, except that the
+// callback provided breaks ties between the leaves sharing the longest common
+// prefix with the path. The candidates are considered in the order ProveClosest
+// would pick them, the best so far being replaced by a candidate whenever
+// prefer(candidate, best) returns true, so a nil callback, or one that never
+// prefers a candidate, picks the leaf that ProveClosest does. All of the tied
+// leaves, those of the subtrie the path diverges into, are loaded.
+func (smst *SMST) ProveClosestWeighted(
+	path []byte,
+	prefer func(a, b ClosestCandidate) bool,
+) (*SparseMerkleClosestProof, error) {
+	view := smst.readView()
+	if prefer == nil {
+		return view.ProveClosest(path)
+	}
+	leaves, prefix, err := view.closestCandidates(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(leaves) == 0 {
+		return view.ProveClosest(path)
+	}
+	// ProveClosest picks the leaf with the most bits in common with the path
+	// after the first to differ, ie. the smallest XOR distance to it
+	distance := func(leaf *leafNode) []byte {
+		d := make([]byte, len(path))
+		for i := range d {
+			d[i] = path[i] ^ leaf.path[i]
+		}
+		return d
+	}
+	sort.SliceStable(leaves, func(i, j int) bool {
+		return bytes.Compare(distance(leaves[i]), distance(leaves[j])) < 0
+	})
+	candidate := func(leaf *leafNode) ClosestCandidate {
+		valueHash, sum := splitSumLeafValue(leaf.valueHash)
+		return ClosestCandidate{Path: bytes.Clone(leaf.path), ValueHash: valueHash, Sum: sum, CommonPrefix: prefix}
+	}
+	best, bestCandidate := leaves[0], candidate(leaves[0])
+	for _, leaf := range leaves[1:] {
+		if c := candidate(leaf); prefer(c, bestCandidate) {
+			best, bestCandidate = leaf, c
+		}
+	}
+	return view.closestProof(path, best)
+}
+
+// CommonPrefixLen returns the number of leading bits shared by the paths of
+// the two keys provided, after hashing them with the trie's PathHasher. This is
+// the depth at which the keys diverge in the trie, and is computed from their
+// paths alone without traversing the trie.
+func (smst *SMST) CommonPrefixLen(keyA, keyB []byte) int {
+	return countCommonPrefixBits(smst.ph.Path(keyA), smst.ph.Path(keyB), 0)
+}
+
+// GetLeafData returns the serialised leaf node stored at the given key, this
+// is the preimage of the leaf digest: [prefix]+[path]+[value hash]+[sum].
+// ErrKeyNotFound is returned if no leaf is stored at the key.
+func (smst *SMST) GetLeafData(key []byte) ([]byte, error) {
+	leaf, err := smst.readView().getLeaf(smst.ph.Path(key))
+	if err != nil {
+		return nil, err
+	}
+	if leaf == nil {
+		return nil, ErrKeyNotFound
+	}
+	return encodeLeaf(leaf.path, leaf.valueHash), nil
 }
 
 // Update sets the value for the given key, to the digest of the provided value
 // appended with the binary representation of the weight provided. The weight
-// is used to compute the interim and total sum of the trie.
+// is used to compute the interim and total sum of the trie. Updating a key to
+// the value and weight it already has is a no-op, leaving the trie unchanged
+// with nothing to commit. In a trie created with WithMultiValue an existing
+// key's value and weight are combined with those provided, and in one created
+// with WithMonotonicSums ErrSumDecrease is returned if an existing key's sum
+// would decrease.
 func (smst *SMST) Update(key, value []byte, weight uint64) error {
-	valueHash := smst.digestValue(value)
+	leaf, err := smst.SMT.getLeaf(smst.ph.Path(key))
+	if err != nil {
+		return err
+	}
+	if leaf != nil && smst.appendOnly {
+		return ErrKeyImmutable
+	}
+	if leaf != nil && smst.combineValue != nil {
+		if value, weight, err = smst.combine(leaf, value, weight); err != nil {
+			return err
+		}
+	}
+	if weight == 0 && smst.rejectZeroSum {
+		return ErrZeroSumNotAllowed
+	}
+	if leaf != nil && smst.monotonicSums &&
+		weight < binary.BigEndian.Uint64(leaf.valueHash[len(leaf.valueHash)-sumSize:]) {
+		return ErrSumDecrease
+	}
+	valueHash, err := smst.leafValue(value, weight)
+	if err != nil {
+		return err
+	}
+	if leaf != nil && bytes.Equal(leaf.valueHash, valueHash) {
+		return nil
+	}
+	if err := smst.writeWAL(walUpdate, key, value, weight); err != nil {
+		return err
+	}
+	return smst.SMT.set(key, valueHash)
+}
+
+// UpdateEntries updates the trie with each of the entries provided in order, as
+// Update does. If an update fails its error is returned and the entries before
+// it remain applied.
+func (smst *SMST) UpdateEntries(entries []KeyValueSum) error {
+	for _, entry := range entries {
+		if err := smst.Update(entry.Key, entry.Value, entry.Sum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (smst *SMST) update(key, value []byte, weight uint64) error {
+	valueHash, err := smst.leafValue(value, weight)
+	if err != nil {
+		return err
+	}
+	return smst.SMT.set(key, valueHash)
+}
+
+// combine returns the value and weight stored in the leaf provided combined
+// with the incoming value and weight, by the functions set with WithMultiValue
+func (smst *SMST) combine(leaf *leafNode, value []byte, weight uint64) ([]byte, uint64, error) {
+	existing, existingWeight, err := smst.decodeSumValue(leaf.valueHash)
+	if err != nil {
+		return nil, 0, err
+	}
+	return smst.combineValue(existing, value), smst.combineSum(existingWeight, weight), nil
+}
+
+// leafValue returns the data stored in a leaf for the value and weight
+// provided: [value hash]+[weight]
+func (smst *SMST) leafValue(value []byte, weight uint64) ([]byte, error) {
+	valueHash, err := smst.encodeValue(value)
+	if err != nil {
+		return nil, err
+	}
 	var weightBz [sumSize]byte
 	binary.BigEndian.PutUint64(weightBz[:], weight)
-	valueHash = append(valueHash, weightBz[:]...)
-	return smst.SMT.Update(key, valueHash)
+	return append(valueHash, weightBz[:]...), nil
 }
 
 // Delete removes the node at the path corresponding to the given key
 func (smst *SMST) Delete(key []byte) error {
+	if smst.appendOnly {
+		return ErrDeleteForbidden
+	}
+	if err := smst.writeWAL(walDelete, key, nil, 0); err != nil {
+		return err
+	}
 	return smst.SMT.Delete(key)
 }
 
+// Rekey moves the leaf of the old key provided to the new key, preserving its
+// value and weight, as a single operation equivalent to deleting the old key
+// and updating the new key with its value and weight. ErrKeyNotFound is
+// returned if the old key is absent and ErrKeyExists if the new key is already
+// present.
+func (smst *SMST) Rekey(oldKey, newKey []byte) error {
+	if smst.appendOnly {
+		return ErrDeleteForbidden
+	}
+	if err := smst.writeWAL(walRekey, oldKey, newKey, 0); err != nil {
+		return err
+	}
+	return smst.SMT.Rekey(oldKey, newKey)
+}
+
+// EvictBelow removes every leaf whose path sorts below the path of the key
+// provided and returns the number of leaves removed, after which Sum reflects
+// only the retained leaves. Leaves are ordered by path, so evicting by key
+// order, such as for keys that are timestamps, requires a PathHasher that
+// preserves the order of the keys.
+func (smst *SMST) EvictBelow(keyUpperBound []byte) (evicted int, err error) {
+	if smst.appendOnly {
+		return 0, ErrDeleteForbidden
+	}
+	if err := smst.writeWAL(walEvictBelow, keyUpperBound, nil, 0); err != nil {
+		return 0, err
+	}
+	return smst.SMT.evictBelow(smst.ph.Path(keyUpperBound))
+}
+
 // Prove generates a SparseMerkleProof for the given key
 func (smst *SMST) Prove(key []byte) (*SparseMerkleProof, error) {
-	return smst.SMT.Prove(key)
+	return smst.prove(smst.readView(), key)
+}
+
+// prove generates a SparseMerkleProof for the given key from the view of the
+// trie provided, as returned by readView
+func (smst *SMST) prove(view *SMT, key []byte) (*SparseMerkleProof, error) {
+	// The underlying trie would attach the fingerprint of its own spec, which
+	// has no value hasher, rather than that of the SMST's spec
+	proof, err := view.prove(smst.ph.Path(key))
+	if err != nil {
+		return nil, err
+	}
+	if smst.fingerprint {
+		fingerprint := SpecFingerprint(smst.Spec())
+		proof.SpecFingerprint = fingerprint[:]
+	}
+	return proof, nil
+}
+
+// SiblingHash returns the digest of the sibling of the given key's leaf, the
+// first side node of its proof, or the placeholder digest if the proof has no
+// side nodes. This is cheaper than generating the full proof with Prove.
+func (smst *SMST) SiblingHash(key []byte) ([]byte, error) {
+	return smst.readView().siblingHash(smst.ph.Path(key))
+}
+
+// ProveSumOf generates a membership SparseMerkleProof for each of the given
+// keys, in the order of the keys provided, and returns them with the total of
+// the keys' sums. The leaves of all of the keys are found in a single descent
+// of the trie, so nodes shared by their paths are only loaded once. The proofs
+// are not verified, but can be verified together with the total claimed using
+// VerifySetSum. ErrKeyNotFound is returned if any key is not in the trie, and
+// ErrSumOverflow if their sums overflow, as VerifySetSum would reject them.
+// No keys, whether nil or empty, return a total of 0 and nil proofs.
+func (smst *SMST) ProveSumOf(keys [][]byte) (total uint64, proofs []*SparseMerkleProof, err error) {
+	if len(keys) == 0 {
+		return 0, nil, nil
+	}
+	paths := make([][]byte, len(keys))
+	for i, key := range keys {
+		paths[i] = smst.ph.Path(key)
+	}
+	// The sums and proofs are read from the same view, so that they agree
+	view := smst.readView()
+	leaves, err := view.getLeaves(paths)
+	if err != nil {
+		return 0, nil, err
+	}
+	proofs = make([]*SparseMerkleProof, len(keys))
+	for i, leaf := range leaves {
+		if leaf == nil {
+			return 0, nil, fmt.Errorf("%w: %x", ErrKeyNotFound, keys[i])
+		}
+		var carry uint64
+		sum := binary.BigEndian.Uint64(leaf.valueHash[len(leaf.valueHash)-sumSize:])
+		if total, carry = bits.Add64(total, sum, 0); carry != 0 {
+			return 0, nil, ErrSumOverflow
+		}
+		if proofs[i], err = smst.prove(view, keys[i]); err != nil {
+			return 0, nil, err
+		}
+	}
+	return total, proofs, nil
+}
+
+// ProveSumBucket generates a membership SparseMerkleProof for the given key
+// together with the index of the bucket its sum falls in, for buckets of the
+// size provided. The sum must be stored bucketed, that is as the lower bound of
+// its bucket (bucketIndex*bucketSize), so that the exact value it was rounded
+// down from is never committed to by the trie. The proof is verified with
+// VerifySumProof using a sum of bucketIndex*bucketSize.
+// NOTE: This only hides the precision of a value within its bucket, as the
+// bucket itself is revealed by the proof. It is not a zero-knowledge range
+// proof.
+func (smst *SMST) ProveSumBucket(key []byte, bucketSize uint64) (bucketIndex uint64, proof *SparseMerkleProof, err error) {
+	if bucketSize == 0 {
+		return 0, nil, fmt.Errorf("invalid bucket size %d", bucketSize)
+	}
+	view := smst.readView()
+	leaf, err := view.getLeaf(smst.ph.Path(key))
+	if err != nil {
+		return 0, nil, err
+	}
+	if leaf == nil {
+		return 0, nil, ErrKeyNotFound
+	}
+	sum := binary.BigEndian.Uint64(leaf.valueHash[len(leaf.valueHash)-sumSize:])
+	if sum%bucketSize != 0 {
+		return 0, nil, fmt.Errorf("sum of key %x is not bucketed by size %d", key, bucketSize)
+	}
+	if proof, err = smst.prove(view, key); err != nil {
+		return 0, nil, err
+	}
+	return sum / bucketSize, proof, nil
+}
+
+// ProveTimed generates a SparseMerkleProof for the given key and returns the
+// wall-clock time spent generating it
+func (smst *SMST) ProveTimed(key []byte) (*SparseMerkleProof, time.Duration, error) {
+	start := time.Now()
+	proof, err := smst.Prove(key)
+	return proof, time.Since(start), err
 }
 
 // ProveClosest generates a SparseMerkleProof of inclusion for the key
@@ -105,10 +635,140 @@ func (smst *SMST) ProveClosest(path []byte) (
 	return smst.SMT.ProveClosest(path)
 }
 
+// ProveClosestRight generates a SparseMerkleClosestProof of inclusion for the
+// key with the smallest path strictly greater than the path provided
+func (smst *SMST) ProveClosestRight(path []byte) (*SparseMerkleClosestProof, error) {
+	return smst.SMT.ProveClosestRight(path)
+}
+
+// ProveClosestLeft generates a SparseMerkleClosestProof of inclusion for the
+// key with the greatest path strictly smaller than the path provided
+func (smst *SMST) ProveClosestLeft(path []byte) (*SparseMerkleClosestProof, error) {
+	return smst.SMT.ProveClosestLeft(path)
+}
+
+// ProveDelta generates a DeltaProof for the given key, omitting the side nodes
+// whose digests are in the set of nodes known to the client, so that it can be
+// verified with VerifyDeltaSumProof and the same set.
+func (smst *SMST) ProveDelta(key []byte, knownNodes map[string]bool) (*DeltaProof, error) {
+	proof, err := smst.Prove(key)
+	if err != nil {
+		return nil, err
+	}
+	return newDeltaProof(proof, knownNodes, smst.Spec()), nil
+}
+
+// ProveDeletion generates a DeletionProof of the removal of the given key from
+// the trie at the root before its deletion, which must be retained as for
+// AtRoot, so that it can be verified against the roots before and after the
+// deletion with VerifyDeletionProof. ErrKeyNotFound is returned if the key was
+// not in the trie at that root.
+func (smst *SMST) ProveDeletion(key, rootBeforeDelete []byte) (*DeletionProof, error) {
+	before, err := smst.AtRoot(rootBeforeDelete)
+	if err != nil {
+		return nil, err
+	}
+	leafData, err := before.GetLeafData(key)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := before.Prove(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DeletionProof{Proof: proof, LeafData: leafData}, nil
+}
+
+// ProveCloserThan generates a SparseMerkleClosestProof of inclusion for a
+// key whose path shares a longer common prefix with the path provided than
+// the claimed key, returning its path, or ErrNoCloserLeaf if there is none
+func (smst *SMST) ProveCloserThan(path, claimedKey []byte) (
+	betterPath []byte,
+	proof *SparseMerkleClosestProof,
+	err error,
+) {
+	return smst.SMT.ProveCloserThan(path, claimedKey)
+}
+
 // Commit persists all dirty nodes in the trie, deletes all orphaned
-// nodes from the database and then computes and saves the root hash
+// nodes from the database and then computes and saves the root hash. In a trie
+// created with WithCommitHook the hook is first called with the leaves changed
+// since the last commit, and an error it returns aborts the commit.
 func (smst *SMST) Commit() error {
-	return smst.SMT.Commit()
+	if err := smst.runCommitHook(); err != nil {
+		return err
+	}
+	if err := smst.SMT.Commit(); err != nil {
+		return err
+	}
+	return smst.truncateWAL()
+}
+
+// runCommitHook calls the hook set with WithCommitHook, if any, with the leaves
+// changed since the last commit, if there are any
+func (smst *SMST) runCommitHook() error {
+	if smst.commitHook == nil || !smst.dirty() {
+		return nil
+	}
+	var committed trieNode
+	if smst.savedRoot != nil {
+		committed = &lazyNode{smst.savedRoot}
+	}
+	changes, err := smst.changedKeys(committed, smst.trie)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	return smst.commitHook(changes)
+}
+
+// CommitIfDirty commits the trie, as Commit does, if it has been modified
+// since the last commit and reports whether it did. If nothing has changed it
+// returns false without accessing the node store or the write-ahead log.
+func (smst *SMST) CommitIfDirty() (committed bool, err error) {
+	if !smst.dirty() {
+		return false, nil
+	}
+	return true, smst.Commit()
+}
+
+// CommitRoot commits the trie, as Commit does, and returns the root hash with
+// the total sum appended that was committed. If there is nothing to commit the
+// current root is returned without accessing the node store.
+func (smst *SMST) CommitRoot() (MerkleRoot, error) {
+	if err := smst.Commit(); err != nil {
+		return nil, err
+	}
+	return smst.savedRoot, nil
+}
+
+// AtRoot returns a sum trie at the root provided, which must be the last root
+// committed or one of the roots before it retained by WithRetainOrphansFor,
+// otherwise ErrRootPruned is returned. The returned trie must only be read from.
+func (smst *SMST) AtRoot(root []byte) (*SMST, error) {
+	smt, err := smst.SMT.AtRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	return &SMST{TrieSpec: smst.TrieSpec, SMT: smt}, nil
+}
+
+// ExportReachable writes a snapshot of the nodes reachable from the root
+// provided to w, which can be loaded with ImportReachable
+func (smst *SMST) ExportReachable(root []byte, w io.Writer) error {
+	return smst.SMT.ExportReachable(root, w)
+}
+
+// StorageSize returns the number of nodes reachable from the last committed
+// root and the total bytes they occupy in the node store
+func (smst *SMST) StorageSize() (nodeCount int, totalBytes int64, err error) {
+	return smst.SMT.StorageSize()
+}
+
+// DirtySize returns the number of uncommitted nodes held in memory and an
+// estimate of the number of bytes they occupy, which can be used to decide
+// when to Commit
+func (smst *SMST) DirtySize() (nodes int, approxBytes int) {
+	return smst.SMT.DirtySize()
 }
 
 // Root returns the root hash of the trie with the total sum bytes appended
@@ -118,6 +778,293 @@ func (smst *SMST) Root() MerkleRoot {
 
 // Sum returns the uint64 sum of the entire trie
 func (smst *SMST) Sum() uint64 {
-	digest := smst.Root()
-	return digest.Sum()
+	return binary.BigEndian.Uint64(smst.th.digestSum(smst.Root()))
+}
+
+// SyncedLeaf is a leaf of a sum trie with a compact proof of its inclusion, as
+// handed to a client so it can verify the leaf independently of the others.
+// Tries do not retain the original keys of their leaves, so the leaf is
+// identified by its path.
+type SyncedLeaf struct {
+	Path      []byte
+	ValueHash []byte // the value hash (or encoded value) without the sum
+	Sum       uint64
+	Proof     *SparseCompactMerkleProof
+}
+
+// Verify verifies the inclusion of the leaf in the sum trie with the root and
+// spec provided.
+func (leaf SyncedLeaf) Verify(root []byte, spec *TrieSpec) (bool, error) {
+	proof, err := DecompactProof(leaf.Proof, spec)
+	if err != nil {
+		return false, err
+	}
+	leafHash, err := SumLeafHashPrehashed(leaf.Path, leaf.ValueHash, leaf.Sum, spec)
+	if err != nil {
+		return false, err
+	}
+	return VerifySumProofByLeafHash(proof, root, leafHash, leaf.Path, spec)
+}
+
+// VerifyExport verifies that the leaves provided, such as those returned by
+// ProveAllCompact, are every leaf of the sum trie with the root and spec given.
+// Each leaf's proof is verified, the leaves must be in strictly increasing path
+// order and their sums must add up to the sum of the root. The export is also
+// shown to be complete from the proofs themselves: every side node between a
+// leaf and its neighbours in path order, or beyond the first or last leaf, must
+// be empty, so no leaf can have been left out, including those with a zero
+// sum. No leaves are only a valid export of an empty trie.
+//
+// Proofs are verified on as many goroutines as GOMAXPROCS if the spec is a
+// ReusableSpec, stopping at the first that is invalid. The hasher of any other
+// spec cannot be shared, so its proofs are verified on a single goroutine.
+func VerifyExport(leaves []SyncedLeaf, root []byte, spec *TrieSpec) (bool, error) {
+	if len(root) != hashSize(spec) {
+		return false, fmt.Errorf("%w: invalid root length %d, expected %d", ErrMalformedRoot, len(root), hashSize(spec))
+	}
+	if len(leaves) == 0 {
+		return bytes.Equal(root, placeholder(spec)), nil
+	}
+	var total, carry uint64
+	for i, leaf := range leaves {
+		if len(leaf.Path) != spec.ph.PathSize() {
+			return false, fmt.Errorf("invalid path size of leaf %d: got %d but want %d", i, len(leaf.Path), spec.ph.PathSize())
+		}
+		if i > 0 && bytes.Compare(leaves[i-1].Path, leaf.Path) >= 0 {
+			return false, nil
+		}
+		if total, carry = bits.Add64(total, leaf.Sum, 0); carry != 0 {
+			return false, nil
+		}
+	}
+	if total != binary.BigEndian.Uint64(spec.th.digestSum(root)) {
+		return false, nil
+	}
+
+	workers := 1
+	if spec.th.pool != nil {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var (
+		wg       sync.WaitGroup
+		invalid  atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(leaves) && !invalid.Load(); i += workers {
+				valid, err := verifyExportedLeaf(leaves, i, root, spec)
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+				}
+				if err != nil || !valid {
+					invalid.Store(true)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return false, firstErr
+	}
+	return !invalid.Load(), nil
+}
+
+// verifyExportedLeaf verifies the proof of the leaf at the index provided and
+// that its proof leaves no room for another leaf between it and its neighbours
+func verifyExportedLeaf(leaves []SyncedLeaf, i int, root []byte, spec *TrieSpec) (bool, error) {
+	leaf := leaves[i]
+	proof, err := DecompactProof(leaf.Proof, spec)
+	if err != nil {
+		return false, err
+	}
+	leafHash, err := SumLeafHashPrehashed(leaf.Path, leaf.ValueHash, leaf.Sum, spec)
+	if err != nil {
+		return false, err
+	}
+	if valid, err := VerifySumProofByLeafHash(proof, root, leafHash, leaf.Path, spec); err != nil || !valid {
+		return false, err
+	}
+	// The left side nodes below the depth at which the leaf diverges from the
+	// previous leaf, and the right side nodes below the depth at which it
+	// diverges from the next, would hold leaves between them so must be empty
+	prev, next := -1, -1
+	if i > 0 {
+		prev = countCommonPrefixBits(leaves[i-1].Path, leaf.Path, 0)
+	}
+	if i < len(leaves)-1 {
+		next = countCommonPrefixBits(leaf.Path, leaves[i+1].Path, 0)
+	}
+	empty := placeholder(spec)
+	for depth := 0; depth < len(proof.SideNodes); depth++ {
+		sideNode := proof.SideNodes[len(proof.SideNodes)-1-depth]
+		if bytes.Equal(sideNode, empty) {
+			continue
+		}
+		if getPathBit(leaf.Path, depth) == left && depth > next {
+			return false, nil
+		}
+		if getPathBit(leaf.Path, depth) != left && depth > prev {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ProveAllCompact returns every leaf of the trie, in path order, each with a
+// compact proof of its inclusion, and the root they are proven against. The
+// whole trie is held in memory, see ForEachProof for large tries.
+func (smst *SMST) ProveAllCompact() ([]SyncedLeaf, []byte, error) {
+	view := smst.readView()
+	var leaves []SyncedLeaf
+	err := smst.forEachProof(view, func(leaf SyncedLeaf) error {
+		leaves = append(leaves, leaf)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaves, view.Root(), nil
+}
+
+// ProveTopNSum returns the n leaves of the trie with the largest sums, from
+// largest to smallest with ties in path order, each with a compact proof of its
+// inclusion against the trie's root, and the total of their sums. Every leaf of
+// the trie is visited, though at most n of them are held in memory.
+func (smst *SMST) ProveTopNSum(n int) (total uint64, leaves []SyncedLeaf, err error) {
+	if n <= 0 {
+		return 0, nil, nil
+	}
+	err = smst.forEachProof(smst.readView(), func(leaf SyncedLeaf) error {
+		i := sort.Search(len(leaves), func(i int) bool { return leaves[i].Sum < leaf.Sum })
+		if i == n {
+			return nil
+		}
+		if len(leaves) < n {
+			leaves = append(leaves, SyncedLeaf{})
+		}
+		copy(leaves[i+1:], leaves[i:])
+		leaves[i] = leaf
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, leaf := range leaves {
+		total += leaf.Sum
+	}
+	return total, leaves, nil
+}
+
+// ForEachProof calls fn with every leaf of the trie, in path order, each with
+// a compact proof of its inclusion against the trie's root, stopping at the
+// first error returned by fn. Side nodes are computed once for all the leaves
+// beneath them.
+func (smst *SMST) ForEachProof(fn func(SyncedLeaf) error) error {
+	return smst.forEachProof(smst.readView(), fn)
+}
+
+func (smst *SMST) forEachProof(view *SMT, fn func(SyncedLeaf) error) error {
+	var fingerprint []byte
+	if smst.fingerprint {
+		fp := SpecFingerprint(smst.Spec())
+		fingerprint = fp[:]
+	}
+	return view.forEachLeafProof(func(leaf *leafNode, proof *SparseMerkleProof) error {
+		proof.SpecFingerprint = fingerprint
+		compact, err := CompactProof(proof, smst.Spec())
+		if err != nil {
+			return err
+		}
+		valueHash := leaf.valueHash[:len(leaf.valueHash)-sumSize]
+		return fn(SyncedLeaf{
+			Path:      bytes.Clone(leaf.path),
+			ValueHash: bytes.Clone(valueHash),
+			Sum:       binary.BigEndian.Uint64(leaf.valueHash[len(leaf.valueHash)-sumSize:]),
+			Proof:     compact,
+		})
+	})
+}
+
+// VerifyFullTree verifies that the entries provided make up the entire sum trie
+// committed to by the claimed root and sum, by building a trie from them and
+// comparing both its root and its sum to the claimed ones.
+func VerifyFullTree(entries []Entry, claimedRoot []byte, claimedSum uint64, spec *TrieSpec) (bool, error) {
+	// The trie is never committed so it requires no node store
+	smst := newSparseMerkleSumTrieFromSpec(nil, spec)
+	seen := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		path := string(smst.ph.Path(entry.Key))
+		if _, ok := seen[path]; ok {
+			return false, fmt.Errorf("duplicate entry for key %x", entry.Key)
+		}
+		seen[path] = struct{}{}
+		if err := smst.update(entry.Key, entry.Value, entry.Sum); err != nil {
+			return false, err
+		}
+	}
+	return bytes.Equal(smst.Root(), claimedRoot) && smst.Sum() == claimedSum, nil
+}
+
+// MigrateSMSTHasher rebuilds the sum trie provided in the node store given,
+// with its nodes hashed by the new hasher, and commits it. Tries do not retain
+// the original keys and values of their leaves, so the source's PathHasher and
+// ValueHasher (or ValueCodec) are kept by the new trie: keys map to the same
+// paths and Get returns identical values, while the digests of all nodes, and
+// so the root, are recomputed with the new hasher. The sum of the new trie is
+// that of the source. Any truncation of node digests set with WithHashSize is
+// kept, and must not exceed the size of the new hasher. ErrUnsupportedHashSize
+// is returned if the new hasher's size is not supported by a trie. Options
+// that do not affect hashing, such as a WAL, commit hook or append-only mode,
+// are not carried over.
+func MigrateSMSTHasher(src *SMST, dstNodes kvstore.MapStore, newHasher hash.Hash) (*SMST, error) {
+	if size := newHasher.Size(); size < minHashSize || size > maxHashSize {
+		return nil, fmt.Errorf("%w: hasher size %d is not within [%d, %d] bytes", ErrUnsupportedHashSize, size, minHashSize, maxHashSize)
+	}
+	srcSpec := src.Spec()
+	th := newTrieHasher(newHasher)
+	th.sumFirst, th.ns = srcSpec.th.sumFirst, srcSpec.th.ns
+	if srcSpec.th.size != 0 {
+		if srcSpec.th.size > newHasher.Size() {
+			return nil, fmt.Errorf("%w: hash size %d exceeds the size of the new hasher", ErrUnsupportedHashSize, srcSpec.th.size)
+		}
+		th.setHashSize(srcSpec.th.size)
+	}
+	// Only the fields determining how the trie is hashed are carried over,
+	// none of the source's behaviours such as its WAL or commit hook
+	spec := TrieSpec{
+		th:          *th,
+		ph:          srcSpec.ph,
+		vh:          srcSpec.vh,
+		vc:          srcSpec.vc,
+		vr:          srcSpec.vr,
+		sumTrie:     srcSpec.sumTrie,
+		maxDepth:    srcSpec.maxDepth,
+		fingerprint: srcSpec.fingerprint,
+	}
+	dst := newSparseMerkleSumTrieFromSpec(dstNodes, &spec)
+
+	it, err := src.NewLeafIterator(IteratorOptions{Order: PathAsc})
+	if err != nil {
+		return nil, err
+	}
+	// The new trie has no persisted nodes to orphan
+	var orphans orphanNodes
+	for it.Next() {
+		trie, err := dst.SMT.update(dst.trie, 0, it.Path(), it.ValueHash(), &orphans)
+		if err != nil {
+			return nil, err
+		}
+		dst.trie = trie
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	if err := dst.Commit(); err != nil {
+		return nil, err
+	}
+	return dst, nil
 }
@@ -1,16 +1,25 @@
 package smt
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"math/rand"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/pokt-network/smt/kvstore"
 	"github.com/pokt-network/smt/kvstore/simplemap"
+	"github.com/pokt-network/smt/kvstore/tracing"
 )
 
 // Test base case Merkle proof operations.
@@ -357,6 +366,99 @@ func TestSMST_ProveClosest(t *testing.T) {
 	require.True(t, result)
 }
 
+func TestSMST_SubtreeBounds(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithValueHasher(nil))
+
+	// A single leaf has no extension above it
+	require.NoError(t, smst.Update([]byte("foo"), []byte("oof"), 3))
+	lowBit, highBit, err := smst.SubtreeBounds([]byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, [2]int{0, 0}, [2]int{lowBit, highBit})
+
+	// The trie of TestSMST_ProveClosest
+	require.NoError(t, smst.Update([]byte("bar"), []byte("rab"), 6))
+	require.NoError(t, smst.Update([]byte("baz"), []byte("zab"), 9))
+	require.NoError(t, smst.Update([]byte("bin"), []byte("nib"), 12))
+	require.NoError(t, smst.Update([]byte("fiz"), []byte("zif"), 15))
+	require.NoError(t, smst.Update([]byte("fob"), []byte("bof"), 18))
+	require.NoError(t, smst.Update([]byte("testKey"), []byte("testValue"), 21))
+	require.NoError(t, smst.Update([]byte("testKey2"), []byte("testValue2"), 24))
+	require.NoError(t, smst.Update([]byte("testKey3"), []byte("testValue3"), 27))
+	require.NoError(t, smst.Update([]byte("testKey4"), []byte("testValue4"), 30))
+	require.NoError(t, smst.Commit())
+
+	// testKey2 and its neighbour testKey4 are beneath the extension [3, 7)
+	for _, key := range []string{"testKey2", "testKey4"} {
+		lowBit, highBit, err = smst.SubtreeBounds([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, [2]int{3, 7}, [2]int{lowBit, highBit}, key)
+	}
+
+	// Flipping any bit within the bounds keeps testKey2 the closest leaf
+	closestPath := sha256.Sum256([]byte("testKey2"))
+	for bit := lowBit; bit < highBit; bit++ {
+		path := sha256.Sum256([]byte("testKey2"))
+		flipPathBit(path[:], bit)
+		proof, err := smst.ProveClosest(path[:])
+		require.NoError(t, err)
+		require.Equal(t, closestPath[:], proof.ClosestPath, "bit %d", bit)
+	}
+
+	_, _, err = smst.SubtreeBounds([]byte("absent"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestSMST_Proof_PaddedSideNodes(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithValueHasher(nil))
+	for i, key := range []string{"foo", "bar", "baz", "bin", "fiz", "fob", "testKey", "testKey2", "testKey3", "testKey4"} {
+		require.NoError(t, smst.Update([]byte(key), []byte(key), uint64(3*(i+1))))
+	}
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+	key := []byte("testKey2")
+	sum := uint64(24)
+	lowBit, highBit, err := smst.SubtreeBounds(key)
+	require.NoError(t, err)
+	require.Equal(t, [2]int{3, 7}, [2]int{lowBit, highBit})
+
+	// The proof holds a placeholder side node for each bit of the extension
+	// above the leaf, as the extension's digest is that of the chain of inner
+	// nodes it compresses, so its side nodes are one per bit of the leaf's depth
+	proof, err := smst.Prove(key)
+	require.NoError(t, err)
+	for depth := lowBit; depth < highBit; depth++ {
+		require.Equal(t, placeholder(smst.Spec()), proof.SideNodes[len(proof.SideNodes)-1-depth], "depth %d", depth)
+	}
+	valid, err := VerifySumProof(proof, root, key, key, sum, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Padding the proof with a placeholder at any depth, or dropping one of
+	// the extension's, moves the leaf to another depth and does not verify
+	verify := func(sideNodes [][]byte) {
+		padded := *proof
+		padded.SideNodes = sideNodes
+		padded.SiblingData = nil
+		valid, err := VerifySumProof(&padded, root, key, key, sum, smst.Spec())
+		require.NoError(t, err)
+		require.False(t, valid)
+
+		compactProof, err := CompactProof(&padded, smst.Spec())
+		require.NoError(t, err)
+		valid, err = VerifyCompactSumProof(compactProof, root, key, key, sum, smst.Spec())
+		require.NoError(t, err)
+		require.False(t, valid)
+	}
+	for i := 0; i <= len(proof.SideNodes); i++ {
+		sideNodes := append(append(append([][]byte{}, proof.SideNodes[:i]...), placeholder(smst.Spec())), proof.SideNodes[i:]...)
+		verify(sideNodes)
+	}
+	for depth := lowBit; depth < highBit; depth++ {
+		i := len(proof.SideNodes) - 1 - depth
+		verify(append(append([][]byte{}, proof.SideNodes[:i]...), proof.SideNodes[i+1:]...))
+	}
+}
+
 func TestSMST_ProveClosest_Empty(t *testing.T) {
 	var smn kvstore.MapStore
 	var smst *SMST
@@ -424,6 +526,164 @@ func TestSMST_ProveClosest_OneNode(t *testing.T) {
 	require.True(t, result)
 }
 
+func TestSMST_ProveClosestDirectional(t *testing.T) {
+	smn := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(smn, sha256.New(), WithValueHasher(nil))
+
+	paths := make([][]byte, 0, 20)
+	for i := 0; i < 20; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+		path := sha256.Sum256(key)
+		paths = append(paths, path[:])
+	}
+	sort.Slice(paths, func(i, j int) bool { return bytes.Compare(paths[i], paths[j]) < 0 })
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+
+	verify := func(proof *SparseMerkleClosestProof, expected []byte) {
+		t.Helper()
+		require.NotNil(t, proof)
+		require.Equal(t, expected, proof.ClosestPath)
+		checkClosestCompactEquivalence(t, proof, smst.Spec())
+		valid, err := VerifyClosestProof(proof, root, NoPrehashSpec(sha256.New(), true))
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+
+	for i, path := range paths {
+		// an existing path is never its own neighbour
+		proof, err := smst.ProveClosestRight(path)
+		require.NoError(t, err)
+		if i == len(paths)-1 {
+			require.Nil(t, proof)
+		} else {
+			verify(proof, paths[i+1])
+		}
+		proof, err = smst.ProveClosestLeft(path)
+		require.NoError(t, err)
+		if i == 0 {
+			require.Nil(t, proof)
+		} else {
+			verify(proof, paths[i-1])
+		}
+
+		// a path just after an existing one has the same right neighbour
+		// and the existing path as its left neighbour
+		next := bytes.Clone(path)
+		for j := len(next) - 1; j >= 0; j-- {
+			if next[j]++; next[j] != 0 {
+				break
+			}
+		}
+		proof, err = smst.ProveClosestLeft(next)
+		require.NoError(t, err)
+		verify(proof, path)
+	}
+
+	// the extremes of the key space
+	lowest := make([]byte, 32)
+	highest := bytes.Repeat([]byte{0xff}, 32)
+	proof, err := smst.ProveClosestRight(lowest)
+	require.NoError(t, err)
+	verify(proof, paths[0])
+	proof, err = smst.ProveClosestLeft(highest)
+	require.NoError(t, err)
+	verify(proof, paths[len(paths)-1])
+	proof, err = smst.ProveClosestLeft(lowest)
+	require.NoError(t, err)
+	require.Nil(t, proof)
+
+	// an empty trie has no neighbours in either direction
+	empty := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithValueHasher(nil))
+	proof, err = empty.ProveClosestRight(lowest)
+	require.NoError(t, err)
+	require.Nil(t, proof)
+	proof, err = empty.ProveClosestLeft(highest)
+	require.NoError(t, err)
+	require.Nil(t, proof)
+}
+
+// Directional closest proofs against the trie used in TestSMST_ProveClosest,
+// where paths diverging from the extension node with path bounds [3, 7] must
+// resolve to the nearest leaf on the requested side, not the one sharing the
+// most bits with the path.
+func TestSMST_ProveClosestDirectional_Divergence(t *testing.T) {
+	smn := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(smn, sha256.New(), WithValueHasher(nil))
+
+	keys := []string{
+		"foo", "bar", "baz", "bin", "fiz", "fob",
+		"testKey", "testKey2", "testKey3", "testKey4",
+	}
+	paths := make([][]byte, 0, len(keys))
+	for i, key := range keys {
+		require.NoError(t, smst.Update([]byte(key), []byte(key), uint64(i)))
+		path := sha256.Sum256([]byte(key))
+		paths = append(paths, path[:])
+	}
+	sort.Slice(paths, func(i, j int) bool { return bytes.Compare(paths[i], paths[j]) < 0 })
+	root := smst.Root()
+
+	// expected returns the nearest path to the right or left of the path given
+	expected := func(path []byte, right bool) []byte {
+		i := sort.Search(len(paths), func(i int) bool { return bytes.Compare(paths[i], path) >= 0 })
+		if right {
+			if i < len(paths) && bytes.Equal(paths[i], path) {
+				i++
+			}
+			if i == len(paths) {
+				return nil
+			}
+			return paths[i]
+		}
+		if i == 0 {
+			return nil
+		}
+		return paths[i-1]
+	}
+	check := func(path []byte) {
+		t.Helper()
+		for _, right := range []bool{true, false} {
+			var proof *SparseMerkleClosestProof
+			var err error
+			if right {
+				proof, err = smst.ProveClosestRight(path)
+			} else {
+				proof, err = smst.ProveClosestLeft(path)
+			}
+			require.NoError(t, err)
+			want := expected(path, right)
+			if want == nil {
+				require.Nil(t, proof)
+				continue
+			}
+			require.NotNil(t, proof)
+			require.Equal(t, want, proof.ClosestPath)
+			checkClosestCompactEquivalence(t, proof, smst.Spec())
+			valid, err := VerifyClosestProof(proof, root, NoPrehashSpec(sha256.New(), true))
+			require.NoError(t, err)
+			require.True(t, valid)
+		}
+	}
+
+	// diverge from the extension node at each of its bits, in both directions
+	for bit := 3; bit < 8; bit++ {
+		path := sha256.Sum256([]byte("testKey2"))
+		flipPathBit(path[:], bit)
+		check(path[:])
+	}
+
+	// diverge from the trie at random points
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		path := make([]byte, 32)
+		_, err := r.Read(path)
+		require.NoError(t, err)
+		check(path)
+	}
+}
+
 func TestSMST_ProveClosest_Proof(t *testing.T) {
 	var smn kvstore.MapStore
 	var smst256 *SMST
@@ -455,3 +715,1986 @@ func TestSMST_ProveClosest_Proof(t *testing.T) {
 		checkClosestCompactEquivalence(t, proof512, smst512.Spec())
 	}
 }
+
+func TestSMST_Proof_ReusableSpec(t *testing.T) {
+	smn := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(smn, sha256.New())
+	numKeys := 100
+	for i := 0; i < numKeys; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+	proofs := make([]*SparseMerkleProof, numKeys)
+	for i := range proofs {
+		proof, err := smst.Prove([]byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		proofs[i] = proof
+	}
+
+	// A single reusable spec can be shared by concurrent verifiers
+	spec := ReusableSpec(sha256.New, true)
+	var wg sync.WaitGroup
+	results := make([]bool, numKeys)
+	for i := range proofs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := []byte(strconv.Itoa(i))
+			valid, err := VerifySumProof(proofs[i], root, key, key, uint64(i), spec)
+			results[i] = valid && err == nil
+		}(i)
+	}
+	wg.Wait()
+	for i, valid := range results {
+		require.True(t, valid, "proof %d failed to verify", i)
+	}
+
+	// The reusable spec rejects invalid proofs as the trie's spec does
+	key := []byte(strconv.Itoa(1))
+	valid, err := VerifySumProof(proofs[1], root, key, key, 2, spec)
+	require.NoError(t, err)
+	require.False(t, valid)
+}
+
+func TestSMST_Proof_LegacyNodeLayout(t *testing.T) {
+	legacy := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithLegacyNodeLayout())
+	current := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, legacy.Update(key, key, uint64(i)))
+		require.NoError(t, current.Update(key, key, uint64(i)))
+	}
+	legacyRoot := legacy.Root()
+	require.NotEqual(t, current.Root(), legacyRoot)
+	require.Equal(t, current.Sum(), legacy.Sum())
+	require.Equal(t, uint64(190), legacy.Sum())
+
+	// The sum is placed before the hash in the legacy digests
+	var sumBz [sumSize]byte
+	binary.BigEndian.PutUint64(sumBz[:], 190)
+	require.Equal(t, sumBz[:], []byte(legacyRoot[:sumSize]))
+	require.Equal(t, len(current.Root()), len(legacyRoot))
+
+	key := []byte("5")
+	proof, err := legacy.Prove(key)
+	require.NoError(t, err)
+	checkCompactEquivalence(t, proof, legacy.Spec())
+	for _, sideNode := range proof.SideNodes {
+		require.Len(t, sideNode, hashSize(legacy.Spec()))
+	}
+
+	// A legacy proof only verifies with the legacy spec
+	valid, err := VerifySumProof(proof, legacyRoot, key, key, 5, legacy.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	// the sibling data does not hash to the first side node under the current layout
+	valid, err = VerifySumProof(proof, legacyRoot, key, key, 5, current.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+	require.False(t, valid)
+	valid, err = VerifySumProof(proof, legacyRoot, key, key, 6, legacy.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// Proofs of the current layout don't verify with the legacy spec
+	proof, err = current.Prove(key)
+	require.NoError(t, err)
+	valid, err = VerifySumProof(proof, current.Root(), key, key, 5, legacy.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+	require.False(t, valid)
+	proof.SiblingData = nil
+	valid, err = VerifySumProof(proof, current.Root(), key, key, 5, legacy.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// Legacy tries can be committed and imported
+	smn := simplemap.NewSimpleMap()
+	legacy = NewSparseMerkleSumTrie(smn, sha256.New(), WithLegacyNodeLayout())
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, legacy.Update(key, key, uint64(i)))
+	}
+	require.NoError(t, legacy.Commit())
+	imported := ImportSparseMerkleSumTrie(smn, sha256.New(), legacy.Root(), WithLegacyNodeLayout())
+	_, sum, err := imported.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), sum)
+	require.NoError(t, imported.Delete(key))
+	require.Equal(t, uint64(185), imported.Sum())
+	proof, err = imported.Prove([]byte("6"))
+	require.NoError(t, err)
+	valid, err = VerifySumProof(proof, imported.Root(), []byte("6"), []byte("6"), 6, imported.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+}
+
+func TestSMST_Proof_AsMerkleProof(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithLegacyNodeLayout()}} {
+		smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), opts...)
+		for i := 0; i < 20; i++ {
+			key := []byte(strconv.Itoa(i))
+			require.NoError(t, smst.Update(key, key, uint64(i)))
+		}
+		root := smst.Root()
+		key := []byte("5")
+		proof, err := smst.Prove(key)
+		require.NoError(t, err)
+
+		merkleProof, sums, err := proof.AsMerkleProof(smst.Spec())
+		require.NoError(t, err)
+		require.Len(t, sums, len(proof.SideNodes))
+		require.Nil(t, merkleProof.SiblingData)
+		for i, sideNode := range merkleProof.SideNodes {
+			require.Len(t, sideNode, smst.th.hashSize())
+			require.Equal(t, smst.th.digestSum(proof.SideNodes[i]), binary.BigEndian.AppendUint64(nil, sums[i]))
+		}
+
+		// The non-sum view passes the sanity checks of a non-sum spec
+		require.NoError(t, merkleProof.validateBasic(NoPrehashSpec(sha256.New(), false)))
+
+		// The non-sum view cannot be verified against the sum root
+		_, _, err = merkleProof.AsMerkleProof(NoPrehashSpec(sha256.New(), false))
+		require.Error(t, err)
+		valid, err := VerifySumProof(merkleProof, root, key, key, 5, smst.Spec())
+		require.ErrorIs(t, err, ErrBadProof)
+		require.False(t, valid)
+
+		// Restoring the sums produces a proof that verifies
+		sumProof, err := NewSumProof(merkleProof, sums, smst.Spec())
+		require.NoError(t, err)
+		require.Equal(t, proof.SideNodes, sumProof.SideNodes)
+		valid, err = VerifySumProof(sumProof, root, key, key, 5, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+
+		// Mismatched sums are rejected
+		_, err = NewSumProof(merkleProof, sums[1:], smst.Spec())
+		require.Error(t, err)
+		_, err = NewSumProof(proof, sums, smst.Spec())
+		require.Error(t, err)
+	}
+}
+
+func TestSMST_Proof_Kind(t *testing.T) {
+	ph := dummyPathHasher{32}
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithPathHasher(ph))
+	base := smst.Spec()
+
+	present := make([]byte, ph.PathSize())
+	unrelated := make([]byte, ph.PathSize()) // shares the leaf slot of `present`
+	placeholderKey := make([]byte, ph.PathSize())
+	other := make([]byte, ph.PathSize())
+	present[0] = byte(0b00000000)
+	unrelated[0] = byte(0b00100000)
+	placeholderKey[0] = byte(0b10000000)
+	other[0] = byte(0b01000000)
+	require.NoError(t, smst.Update(present, []byte("value"), 5))
+	require.NoError(t, smst.Update(other, []byte("value"), 5))
+	root := smst.Root()
+
+	tests := []struct {
+		desc  string
+		key   []byte
+		value []byte
+		sum   uint64
+		kind  ProofKind
+	}{
+		{
+			desc:  "present key",
+			key:   present,
+			value: []byte("value"),
+			sum:   5,
+			kind:  Membership,
+		},
+		{
+			desc:  "absent key over an unrelated leaf",
+			key:   unrelated,
+			value: defaultValue,
+			sum:   0,
+			kind:  NonMembershipUnrelatedLeaf,
+		},
+		{
+			desc:  "absent key over a placeholder",
+			key:   placeholderKey,
+			value: defaultValue,
+			sum:   0,
+			kind:  NonMembershipPlaceholder,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			proof, err := smst.Prove(tt.key)
+			require.NoError(t, err)
+			require.Equal(t, tt.kind, proof.Kind())
+			require.Equal(t, tt.kind != Membership, proof.IsNonMembership())
+			valid, err := VerifySumProof(proof, root, tt.key, tt.value, tt.sum, base)
+			require.NoError(t, err)
+			require.True(t, valid)
+
+			// The kind survives compaction and serialisation
+			compactProof, err := CompactProof(proof, base)
+			require.NoError(t, err)
+			bz, err := compactProof.Marshal()
+			require.NoError(t, err)
+			compactProof = new(SparseCompactMerkleProof)
+			require.NoError(t, compactProof.Unmarshal(bz))
+			proof, err = DecompactProof(compactProof, base)
+			require.NoError(t, err)
+			require.Equal(t, tt.kind, proof.Kind())
+			require.Equal(t, tt.kind != Membership, proof.IsNonMembership())
+		})
+	}
+}
+
+func TestSMST_Proof_VerifySumProofsSameRoot(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	items := make([]KeyValueSumProof, 0, 21)
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+		items = append(items, KeyValueSumProof{Key: key, Value: key, Sum: uint64(i)})
+	}
+	// A non-membership item
+	items = append(items, KeyValueSumProof{Key: []byte("missing")})
+	root := smst.Root()
+	for i := range items {
+		proof, err := smst.Prove(items[i].Key)
+		require.NoError(t, err)
+		items[i].Proof = proof
+	}
+
+	// Tamper with some of the items
+	items[3].Sum++
+	items[7].Value = []byte("wrong")
+	items[11].Proof = items[12].Proof
+
+	results, err := VerifySumProofsSameRoot(root, items, smst.Spec())
+	require.NoError(t, err)
+	require.Len(t, results, len(items))
+	for i, item := range items {
+		expected, err := VerifySumProof(item.Proof, root, item.Key, item.Value, item.Sum, smst.Spec())
+		require.NoError(t, err)
+		require.Equal(t, expected, results[i])
+		require.Equal(t, i != 3 && i != 7 && i != 11, results[i])
+	}
+
+	// Malformed proofs return an error identifying the item
+	items[5].Proof = &SparseMerkleProof{SideNodes: [][]byte{{1}}}
+	_, err = VerifySumProofsSameRoot(root, items, smst.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+	require.ErrorContains(t, err, "item 5")
+}
+
+func TestSMST_Proof_VerifyLeafInSubtree(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+
+	// subtreeRoot returns the digest of the node at the given depth along the
+	// path of the key provided
+	subtreeRoot := func(key []byte, depth int) []byte {
+		path := smst.ph.Path(key)
+		node := smst.SMT.trie
+		for d := 0; d < depth; d++ {
+			if ext, ok := node.(*extensionNode); ok {
+				node = ext.expand()
+			}
+			inner := node.(*innerNode)
+			if getPathBit(path, d) == left {
+				node = inner.leftChild
+			} else {
+				node = inner.rightChild
+			}
+		}
+		return smst.SMT.hashSumNode(node)
+	}
+
+	key := []byte("42")
+	proof, err := smst.Prove(key)
+	require.NoError(t, err)
+	leafDepth := len(proof.SideNodes)
+	require.Greater(t, leafDepth, 2)
+
+	for depth := 0; depth <= leafDepth; depth++ {
+		root := subtreeRoot(key, depth)
+		levels := leafDepth - depth
+		valid, err := VerifyLeafInSubtree(proof, root, key, key, 42, levels, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid, "subtree at depth %d", depth)
+
+		// The sum and value must match those of the leaf
+		valid, err = VerifyLeafInSubtree(proof, root, key, key, 41, levels, smst.Spec())
+		require.NoError(t, err)
+		require.False(t, valid)
+		valid, err = VerifyLeafInSubtree(proof, root, key, []byte("43"), 42, levels, smst.Spec())
+		require.NoError(t, err)
+		require.False(t, valid)
+
+		// Recomputing the wrong number of levels does not match the subtree
+		if levels > 0 {
+			valid, err = VerifyLeafInSubtree(proof, root, key, key, 42, levels-1, smst.Spec())
+			require.NoError(t, err)
+			require.False(t, valid)
+		}
+	}
+
+	// The subtree at depth 0 is the full trie
+	require.Equal(t, []byte(smst.Root()), subtreeRoot(key, 0))
+
+	// The subtree root includes the sum of the subtree
+	subRoot := subtreeRoot(key, 1)
+	_, subSum, err := ParseSumRoot(subRoot, smst.Spec())
+	require.NoError(t, err)
+	require.Less(t, subSum, smst.Sum())
+
+	// Out of range depths are rejected
+	_, err = VerifyLeafInSubtree(proof, subRoot, key, key, 42, leafDepth+1, smst.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+	_, err = VerifyLeafInSubtree(proof, subRoot, key, key, 42, -1, smst.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+}
+
+func TestSMST_Proof_VerifySumProofHexRoot(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 5))
+	require.NoError(t, smst.Update([]byte("baz"), []byte("qux"), 7))
+	proof, err := smst.Prove([]byte("foo"))
+	require.NoError(t, err)
+	rootHex := hex.EncodeToString(smst.Root())
+
+	valid, err := VerifySumProofHexRoot(proof, rootHex, []byte("foo"), []byte("bar"), 5, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySumProofHexRoot(proof, strings.ToUpper(rootHex), []byte("foo"), []byte("bar"), 5, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySumProofHexRoot(proof, rootHex, []byte("foo"), []byte("bar"), 6, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	malformed := []string{
+		"",                        // empty
+		rootHex[1:],               // odd length
+		rootHex[2:],               // too short
+		rootHex + "00",            // too long
+		"zz" + rootHex[2:],        // not hex
+		rootHex[:len(rootHex)-16], // missing the sum
+	}
+	for _, root := range malformed {
+		_, err = VerifySumProofHexRoot(proof, root, []byte("foo"), []byte("bar"), 5, smst.Spec())
+		require.ErrorIs(t, err, ErrMalformedRoot, "root %q", root)
+	}
+}
+
+func TestSMST_Proof_ProveTimed(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+
+	for _, key := range [][]byte{[]byte("5"), []byte("missing")} {
+		proof, elapsed, err := smst.ProveTimed(key)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, elapsed, time.Duration(0))
+		expected, err := smst.Prove(key)
+		require.NoError(t, err)
+		require.Equal(t, expected, proof)
+	}
+	proof, _, err := smst.ProveTimed([]byte("5"))
+	require.NoError(t, err)
+	valid, err := VerifySumProof(proof, root, []byte("5"), []byte("5"), 5, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+}
+
+func TestSMST_Proof_SpecFingerprint(t *testing.T) {
+	spec := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New()).Spec()
+
+	// Fingerprints are deterministic and differ between specs
+	require.Equal(t, SpecFingerprint(spec), SpecFingerprint(ReusableSpec(sha256.New, true)))
+	others := []*TrieSpec{
+		NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha512.New()).Spec(),
+		NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithValueHasher(nil)).Spec(),
+		NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithLegacyNodeLayout()).Spec(),
+		NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithNodeSerializer(fieldAlignedSerializer{})).Spec(),
+		NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithValueCodec(prefixCodec{prefix: 1})).Spec(),
+		NewSparseMerkleTrie(simplemap.NewSimpleMap(), sha256.New()).Spec(),
+		NoPrehashSpec(sha256.New(), true),
+	}
+	for _, other := range others {
+		require.NotEqual(t, SpecFingerprint(spec), SpecFingerprint(other))
+	}
+
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithProofFingerprint())
+	require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 5))
+	require.NoError(t, smst.Update([]byte("baz"), []byte("qux"), 7))
+	root := smst.Root()
+	proof, err := smst.Prove([]byte("foo"))
+	require.NoError(t, err)
+	fingerprint := SpecFingerprint(smst.Spec())
+	require.Equal(t, fingerprint[:], proof.SpecFingerprint)
+
+	// The proof verifies with an equivalent spec
+	valid, err := VerifySumProof(proof, root, []byte("foo"), []byte("bar"), 5, spec)
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySumProof(proof, root, []byte("foo"), []byte("bar"), 6, spec)
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// Verifying with a different spec is reported as a mismatch
+	valid, err = VerifySumProof(proof, root, []byte("foo"), []byte("bar"), 5, others[1])
+	require.ErrorIs(t, err, ErrSpecMismatch)
+	require.False(t, valid)
+
+	// The fingerprint survives compaction and serialisation
+	compactProof, err := CompactProof(proof, smst.Spec())
+	require.NoError(t, err)
+	bz, err := compactProof.Marshal()
+	require.NoError(t, err)
+	compactProof = new(SparseCompactMerkleProof)
+	require.NoError(t, compactProof.Unmarshal(bz))
+	_, err = VerifyCompactSumProof(compactProof, root, []byte("foo"), []byte("bar"), 5, others[1])
+	require.ErrorIs(t, err, ErrSpecMismatch)
+
+	// Proofs without a fingerprint are not checked
+	proof.SpecFingerprint = nil
+	valid, err = VerifySumProof(proof, root, []byte("foo"), []byte("bar"), 5, others[1])
+	require.NoError(t, err)
+	require.False(t, valid)
+	plain := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, plain.Update([]byte("foo"), []byte("bar"), 5))
+	proof, err = plain.Prove([]byte("foo"))
+	require.NoError(t, err)
+	require.Nil(t, proof.SpecFingerprint)
+}
+
+func TestSMST_Proof_VerifySumProofWithSpecDigest(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 5))
+	require.NoError(t, smst.Update([]byte("baz"), []byte("qux"), 7))
+	root := smst.Root()
+	proof, err := smst.Prove([]byte("foo"))
+	require.NoError(t, err)
+	digest := SpecFingerprint(smst.Spec())
+
+	valid, err := VerifySumProofWithSpecDigest(proof, root, []byte("foo"), []byte("bar"), 5, smst.Spec(), digest[:])
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySumProofWithSpecDigest(proof, root, []byte("foo"), []byte("bar"), 6, smst.Spec(), digest[:])
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// The proof is valid for the spec, but not the spec expected
+	legacy := SpecFingerprint(NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithLegacyNodeLayout()).Spec())
+	valid, err = VerifySumProof(proof, root, []byte("foo"), []byte("bar"), 5, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	_, err = VerifySumProofWithSpecDigest(proof, root, []byte("foo"), []byte("bar"), 5, smst.Spec(), legacy[:])
+	require.ErrorIs(t, err, ErrSpecMismatch)
+	_, err = VerifySumProofWithSpecDigest(proof, root, []byte("foo"), []byte("bar"), 5, smst.Spec(), nil)
+	require.ErrorIs(t, err, ErrSpecMismatch)
+}
+
+func TestSMST_Proof_UpdateCompactSumProof(t *testing.T) {
+	newTrie := func(numKeys int) *SMST {
+		smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+		for i := 0; i < numKeys; i++ {
+			key := []byte(strconv.Itoa(i))
+			require.NoError(t, smst.Update(key, key, uint64(i+1)))
+		}
+		return smst
+	}
+
+	// update applies the change to a proof of the key and to an actual trie,
+	// and checks that the root computed from the proof matches the trie's
+	update := func(t *testing.T, numKeys int, key, value []byte, sum uint64) {
+		smst := newTrie(numKeys)
+		proof, err := smst.Prove(key)
+		require.NoError(t, err)
+		compactProof, err := CompactProof(proof, smst.Spec())
+		require.NoError(t, err)
+		oldValue, oldSum, err := smst.Get(key)
+		require.NoError(t, err)
+		if oldValue == nil {
+			oldSum = 0
+		} else {
+			oldValue = key
+		}
+		newRoot, err := UpdateCompactSumProof(compactProof, key, oldValue, oldSum, value, sum, smst.Spec())
+		require.NoError(t, err)
+
+		if value == nil && sum == 0 {
+			if err := smst.Delete(key); err != nil {
+				require.ErrorIs(t, err, ErrKeyNotFound)
+			}
+		} else {
+			require.NoError(t, smst.Update(key, value, sum))
+		}
+		require.Equal(t, []byte(smst.Root()), newRoot)
+	}
+
+	for _, numKeys := range []int{0, 1, 2, 3, 10, 50} {
+		t.Run(strconv.Itoa(numKeys), func(t *testing.T) {
+			for i := 0; i < numKeys+10; i++ {
+				key := []byte(strconv.Itoa(i))
+				// Changing an existing leaf or inserting an absent one
+				update(t, numKeys, key, []byte("new value"), 100)
+				// Removing an existing leaf or an absent one
+				update(t, numKeys, key, nil, 0)
+			}
+		})
+	}
+
+	// Removing a leaf whose sibling is a leaf requires the sibling's data, which
+	// the root does not commit to, so a proof stripped of it is rejected rather
+	// than yielding the root of a trie the sibling did not move up in
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("a"), []byte("a"), 1))
+	require.NoError(t, smst.Update([]byte("b"), []byte("b"), 2))
+	proof, err := smst.Prove([]byte("a"))
+	require.NoError(t, err)
+	require.NotNil(t, proof.SiblingData)
+	proof.SiblingData = nil
+	compactProof, err := CompactProof(proof, smst.Spec())
+	require.NoError(t, err)
+	_, err = UpdateCompactSumProof(compactProof, []byte("a"), []byte("a"), 1, nil, 0, smst.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+
+	// Flagging the proof of a present key as one of an empty subtrie does not
+	// turn its removal into a no-op, as membership follows from the old value
+	proof.EmptyLeaf = true
+	compactProof, err = CompactProof(proof, smst.Spec())
+	require.NoError(t, err)
+	_, err = UpdateCompactSumProof(compactProof, []byte("a"), []byte("a"), 1, nil, 0, smst.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+}
+
+func TestSMST_Proof_VerifySumProofAndComputeNewRoot(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i+1)))
+	}
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+
+	// Changing, inserting and removing a key each yield the root of the trie
+	// the change is applied to
+	for i := 15; i < 25; i++ {
+		key := []byte(strconv.Itoa(i))
+		proof, err := smst.Prove(key)
+		require.NoError(t, err)
+		oldValue, oldSum := []byte(nil), uint64(0)
+		if i < 20 {
+			oldValue, oldSum = key, uint64(i+1)
+		}
+		for _, change := range []struct {
+			value []byte
+			sum   uint64
+		}{{[]byte("new value"), 100}, {nil, 0}} {
+			valid, newRoot, err := VerifySumProofAndComputeNewRoot(
+				proof, root, key, oldValue, oldSum, change.value, change.sum, smst.Spec(),
+			)
+			require.NoError(t, err)
+			require.True(t, valid)
+
+			trie, err := smst.AtRoot(root)
+			require.NoError(t, err)
+			if change.value == nil {
+				if err := trie.Delete(key); err != nil {
+					require.ErrorIs(t, err, ErrKeyNotFound)
+				}
+			} else {
+				require.NoError(t, trie.Update(key, change.value, change.sum))
+			}
+			require.Equal(t, []byte(trie.Root()), newRoot)
+		}
+	}
+
+	// No root is computed from a proof that does not verify the old state
+	proof, err := smst.Prove([]byte("1"))
+	require.NoError(t, err)
+	valid, newRoot, err := VerifySumProofAndComputeNewRoot(
+		proof, root, []byte("1"), []byte("1"), 3, []byte("new value"), 100, smst.Spec(),
+	)
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Nil(t, newRoot)
+
+	// Neither stripping the SiblingData nor setting the EmptyLeaf flag of a
+	// proof, which the root does not commit to, yields the wrong root for the
+	// removal of a key whose sibling is a leaf
+	pair := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, pair.Update([]byte("a"), []byte("a"), 1))
+	require.NoError(t, pair.Update([]byte("b"), []byte("b"), 2))
+	pairRoot := pair.Root()
+	honest, err := pair.Prove([]byte("a"))
+	require.NoError(t, err)
+	removed := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, removed.Update([]byte("b"), []byte("b"), 2))
+
+	stripped := *honest
+	stripped.SiblingData = nil
+	_, newRoot, err = VerifySumProofAndComputeNewRoot(&stripped, pairRoot, []byte("a"), []byte("a"), 1, nil, 0, pair.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+	require.Nil(t, newRoot)
+
+	flagged := *honest
+	flagged.EmptyLeaf = true
+	valid, newRoot, err = VerifySumProofAndComputeNewRoot(&flagged, pairRoot, []byte("a"), []byte("a"), 1, nil, 0, pair.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, []byte(removed.Root()), newRoot)
+	flagged.SiblingData = nil
+	_, _, err = VerifySumProofAndComputeNewRoot(&flagged, pairRoot, []byte("a"), []byte("a"), 1, nil, 0, pair.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+}
+
+func TestSMST_Proof_ProveDeletion(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i+1)))
+	}
+	require.NoError(t, smst.Commit())
+	oldRoot := smst.Root()
+
+	require.NoError(t, smst.Delete([]byte("5")))
+	newRoot := smst.Root()
+	proof, err := smst.ProveDeletion([]byte("5"), oldRoot)
+	require.NoError(t, err)
+	valid, err := VerifyDeletionProof(proof, oldRoot, newRoot, []byte("5"), smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// The proof survives serialisation
+	bz, err := proof.Marshal()
+	require.NoError(t, err)
+	unmarshaled := new(DeletionProof)
+	require.NoError(t, unmarshaled.Unmarshal(bz))
+	valid, err = VerifyDeletionProof(unmarshaled, oldRoot, newRoot, []byte("5"), smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// The proof does not verify for another key, an unchanged root, or a root
+	// from which more than the key was removed
+	valid, err = VerifyDeletionProof(proof, oldRoot, newRoot, []byte("6"), smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = VerifyDeletionProof(proof, oldRoot, oldRoot, []byte("5"), smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.NoError(t, smst.Delete([]byte("6")))
+	valid, err = VerifyDeletionProof(proof, oldRoot, smst.Root(), []byte("5"), smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// A proof stripped of its SiblingData, or flagged as of non-membership,
+	// cannot pass off a root in which the sibling leaf did not move up
+	pair := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, pair.Update([]byte("a"), []byte("a"), 1))
+	require.NoError(t, pair.Update([]byte("b"), []byte("b"), 2))
+	require.NoError(t, pair.Commit())
+	pairRoot := pair.Root()
+	require.NoError(t, pair.Delete([]byte("a")))
+	pairProof, err := pair.ProveDeletion([]byte("a"), pairRoot)
+	require.NoError(t, err)
+	forged := *pairProof.Proof
+	forged.SiblingData = nil
+	// The root accepted before, of the sibling leaf left below an empty subtrie
+	bogusRoot, _, err := computeProofRoot(&forged, []byte("a"), defaultValue, sumProofSpec(pair.Spec()))
+	require.NoError(t, err)
+	require.NotEqual(t, []byte(pair.Root()), bogusRoot)
+	valid, err = VerifyDeletionProof(&DeletionProof{Proof: &forged, LeafData: pairProof.LeafData}, pairRoot, bogusRoot, []byte("a"), pair.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+	require.False(t, valid)
+	flagged := *pairProof.Proof
+	flagged.EmptyLeaf = true
+	valid, err = VerifyDeletionProof(&DeletionProof{Proof: &flagged, LeafData: pairProof.LeafData}, pairRoot, pair.Root(), []byte("a"), pair.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifyDeletionProof(&DeletionProof{Proof: &flagged, LeafData: pairProof.LeafData}, pairRoot, pairRoot, []byte("a"), pair.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// A key absent before the deletion cannot be proven deleted
+	_, err = smst.ProveDeletion([]byte("absent"), oldRoot)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	// The root before the deletion must be retained
+	_, err = smst.ProveDeletion([]byte("5"), newRoot)
+	require.ErrorIs(t, err, ErrRootPruned)
+}
+
+func TestSMST_Proof_VerifyNonMembershipSumProofDetailed(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 10; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+
+	var unrelated, placeholders int
+	for i := 10; i < 50; i++ {
+		key := []byte(strconv.Itoa(i))
+		proof, err := smst.Prove(key)
+		require.NoError(t, err)
+		valid, leafPath, err := VerifyNonMembershipSumProofDetailed(proof, root, key, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+		switch proof.Kind() {
+		case NonMembershipUnrelatedLeaf:
+			unrelated++
+			// The encountered leaf is one of the keys in the trie
+			leaf, err := smst.getLeaf(leafPath)
+			require.NoError(t, err)
+			require.NotNil(t, leaf)
+			require.NotEqual(t, smst.ph.Path(key), leafPath)
+		case NonMembershipPlaceholder:
+			placeholders++
+			require.Nil(t, leafPath)
+		}
+	}
+	require.NotZero(t, unrelated)
+	require.NotZero(t, placeholders)
+
+	// Membership proofs are not valid non-membership proofs
+	proof, err := smst.Prove([]byte("1"))
+	require.NoError(t, err)
+	valid, leafPath, err := VerifyNonMembershipSumProofDetailed(proof, root, []byte("1"), smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Nil(t, leafPath)
+}
+
+func TestSMST_Proof_ProveSumOf(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i*3)))
+	}
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+
+	keys := [][]byte{[]byte("2"), []byte("7"), []byte("11"), []byte("19")}
+	total, proofs, err := smst.ProveSumOf(keys)
+	require.NoError(t, err)
+	require.Len(t, proofs, len(keys))
+	var expected uint64
+	for i, key := range keys {
+		value, sum, err := smst.Get(key)
+		require.NoError(t, err)
+		expected += sum
+		require.Equal(t, Membership, proofs[i].Kind())
+		valid, err := VerifySumProof(proofs[i], root, key, key, sum, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+		valueHash := sha256.Sum256(key)
+		require.Equal(t, valueHash[:], value)
+	}
+	require.Equal(t, expected, total)
+
+	// An absent key fails the whole call
+	_, _, err = smst.ProveSumOf(append(keys, []byte("absent")))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	// As do sums overflowing the total, which VerifySetSum would reject
+	require.NoError(t, smst.Update([]byte("max"), []byte("max"), math.MaxUint64))
+	_, _, err = smst.ProveSumOf([][]byte{[]byte("max"), []byte("2")})
+	require.ErrorIs(t, err, ErrSumOverflow)
+	total, _, err = smst.ProveSumOf([][]byte{[]byte("max"), []byte("0")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), total)
+}
+
+func TestSMST_Proof_VerifySetSum(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i*3)))
+	}
+	root := smst.Root()
+
+	keys := [][]byte{[]byte("2"), []byte("7"), []byte("11"), []byte("19")}
+	values := [][]byte{[]byte("2"), []byte("7"), []byte("11"), []byte("19")}
+	sums := []uint64{6, 21, 33, 57}
+	total, proofs, err := smst.ProveSumOf(keys)
+	require.NoError(t, err)
+	require.Equal(t, uint64(117), total)
+	valid, err := VerifySetSum(keys, values, sums, total, proofs, root, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// The total must match the sums, which must match the leaves
+	valid, err = VerifySetSum(keys, values, sums, total+1, proofs, root, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = VerifySetSum(keys, values, []uint64{7, 20, 33, 57}, total, proofs, root, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = VerifySetSum(keys, values, []uint64{6, 21, 33, 57 - total}, 0, proofs, root, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// An absent key cannot be counted, even with a zero sum
+	absent := []byte("absent")
+	absentProof, err := smst.Prove(absent)
+	require.NoError(t, err)
+	valid, err = VerifySetSum(
+		append(keys, absent), append(values, nil), append(sums, 0), total,
+		append(proofs, absentProof), root, smst.Spec(),
+	)
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// A key cannot be counted twice
+	_, err = VerifySetSum(
+		append(keys, keys[0]), append(values, values[0]), append(sums, sums[0]), total+sums[0],
+		append(proofs, proofs[0]), root, smst.Spec(),
+	)
+	require.ErrorIs(t, err, ErrDuplicateKey)
+	_, err = VerifySetSum(keys, values, sums[1:], total, proofs, root, smst.Spec())
+	require.Error(t, err)
+}
+
+func TestSMST_Proof_ProveSumBucket(t *testing.T) {
+	const bucketSize = 100
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	balances := map[string]uint64{"alice": 1234, "bob": 99, "carol": 500}
+	for key, balance := range balances {
+		// Sums are stored as the lower bound of their bucket
+		require.NoError(t, smst.Update([]byte(key), []byte(key), balance/bucketSize*bucketSize))
+	}
+	require.NoError(t, smst.Update([]byte("dave"), []byte("dave"), 42))
+	root := smst.Root()
+
+	for key, balance := range balances {
+		bucketIndex, proof, err := smst.ProveSumBucket([]byte(key), bucketSize)
+		require.NoError(t, err)
+		require.Equal(t, balance/bucketSize, bucketIndex)
+		valid, err := VerifySumProof(proof, root, []byte(key), []byte(key), bucketIndex*bucketSize, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+		// The exact balance does not verify
+		if balance%bucketSize != 0 {
+			valid, err = VerifySumProof(proof, root, []byte(key), []byte(key), balance, smst.Spec())
+			require.NoError(t, err)
+			require.False(t, valid)
+		}
+	}
+
+	_, _, err := smst.ProveSumBucket([]byte("dave"), bucketSize)
+	require.Error(t, err)
+	_, _, err = smst.ProveSumBucket([]byte("erin"), bucketSize)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	_, _, err = smst.ProveSumBucket([]byte("alice"), 0)
+	require.Error(t, err)
+}
+
+func TestSMST_Proof_VerifyCompactSumProofStreaming(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 1000; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+
+	verifyBoth := func(proof *SparseCompactMerkleProof, key, value []byte, sum uint64) bool {
+		expected, expectedErr := VerifyCompactSumProof(proof, root, key, value, sum, smst.Spec())
+		valid, err := VerifyCompactSumProofStreaming(proof, root, key, value, sum, smst.Spec())
+		require.Equal(t, expected, valid)
+		if expectedErr != nil {
+			require.ErrorIs(t, err, ErrBadProof)
+			require.ErrorIs(t, expectedErr, ErrBadProof)
+		} else {
+			require.NoError(t, err)
+		}
+		return valid
+	}
+
+	for i := 0; i < 1100; i += 7 {
+		key := []byte(strconv.Itoa(i))
+		proof, err := smst.Prove(key)
+		require.NoError(t, err)
+		compactProof, err := CompactProof(proof, smst.Spec())
+		require.NoError(t, err)
+
+		if i < 1000 {
+			require.True(t, verifyBoth(compactProof, key, key, uint64(i)))
+			require.False(t, verifyBoth(compactProof, key, key, uint64(i+1)))
+			require.False(t, verifyBoth(compactProof, key, nil, 0))
+		} else {
+			require.True(t, verifyBoth(compactProof, key, nil, 0))
+			require.False(t, verifyBoth(compactProof, key, key, 0))
+		}
+
+		// Tampered side nodes and sibling data are rejected alike
+		if len(compactProof.SideNodes) > 0 {
+			compactProof.SideNodes[len(compactProof.SideNodes)-1][0] ^= 0xff
+			verifyBoth(compactProof, key, key, uint64(i))
+			compactProof.SideNodes[0] = compactProof.SideNodes[0][1:]
+			verifyBoth(compactProof, key, key, uint64(i))
+		}
+		if compactProof.SiblingData != nil {
+			compactProof.SiblingData = append(bytes.Clone(compactProof.SiblingData), 0)
+			verifyBoth(compactProof, key, key, uint64(i))
+		}
+	}
+}
+
+func TestSMST_Proof_SiblingHash(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+
+	// Tries with no or a single leaf have no side nodes
+	sibling, err := smst.SiblingHash([]byte("0"))
+	require.NoError(t, err)
+	require.Equal(t, placeholder(smst.Spec()), sibling)
+	require.NoError(t, smst.Update([]byte("0"), []byte("0"), 1))
+	sibling, err = smst.SiblingHash([]byte("0"))
+	require.NoError(t, err)
+	require.Equal(t, placeholder(smst.Spec()), sibling)
+
+	for i := 1; i < 50; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	require.NoError(t, smst.Commit())
+	smst = ImportSparseMerkleSumTrie(smst.nodes, sha256.New(), smst.Root())
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+		sibling, err := smst.SiblingHash(key)
+		require.NoError(t, err)
+		proof, err := smst.Prove(key)
+		require.NoError(t, err)
+		require.NotEmpty(t, proof.SideNodes)
+		require.Equal(t, proof.SideNodes[0], sibling)
+	}
+}
+
+func TestSMST_Proof_VerifyCrossTreeSumProof(t *testing.T) {
+	outer := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	inners := make([]*SMST, 3)
+	for i := range inners {
+		inners[i] = NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+		for j := 0; j < 5; j++ {
+			key := []byte(strconv.Itoa(j))
+			require.NoError(t, inners[i].Update(key, key, uint64(i*10+j)))
+		}
+		// The outer leaves are the inner roots, weighted by the inner sums
+		innerRoot := inners[i].Root()
+		require.NoError(t, outer.Update([]byte(strconv.Itoa(i)), innerRoot, innerRoot.Sum()))
+	}
+	outerRoot := outer.Root()
+
+	innerKey := []byte("3")
+	innerRoot := inners[1].Root()
+	outerProof, err := outer.Prove([]byte("1"))
+	require.NoError(t, err)
+	innerProof, err := inners[1].Prove(innerKey)
+	require.NoError(t, err)
+
+	valid, err := VerifyCrossTreeSumProof(outerRoot, innerKey, outerProof, innerProof, innerRoot,
+		[]byte("1"), innerKey, 13, outer.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// A wrong inner sum, outer key or inner root fails verification
+	valid, err = VerifyCrossTreeSumProof(outerRoot, innerKey, outerProof, innerProof, innerRoot,
+		[]byte("1"), innerKey, 14, outer.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = VerifyCrossTreeSumProof(outerRoot, innerKey, outerProof, innerProof, innerRoot,
+		[]byte("2"), innerKey, 13, outer.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	otherProof, err := inners[2].Prove(innerKey)
+	require.NoError(t, err)
+	valid, err = VerifyCrossTreeSumProof(outerRoot, innerKey, outerProof, otherProof, inners[2].Root(),
+		[]byte("1"), innerKey, 23, outer.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	_, err = VerifyCrossTreeSumProof(outerRoot, innerKey, outerProof, innerProof, innerRoot[1:],
+		[]byte("1"), innerKey, 13, outer.Spec())
+	require.ErrorIs(t, err, ErrMalformedRoot)
+}
+
+func TestSMST_Proof_VerifySumProofAgainstHash(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		var opts []Option
+		if legacy {
+			opts = append(opts, WithLegacyNodeLayout())
+		}
+		smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), opts...)
+		require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 5))
+		require.NoError(t, smst.Update([]byte("baz"), []byte("qux"), 7))
+		rootHash := smst.th.digestHash(smst.Root())
+		require.Len(t, rootHash, sha256.Size)
+
+		proof, err := smst.Prove([]byte("foo"))
+		require.NoError(t, err)
+		valid, err := VerifySumProofAgainstHash(proof, rootHash, []byte("foo"), []byte("bar"), 5, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+		valid, err = VerifySumProofAgainstHash(proof, rootHash, []byte("foo"), []byte("bar"), 6, smst.Spec())
+		require.NoError(t, err)
+		require.False(t, valid)
+
+		// Non-membership proofs verify against the hash alone too
+		proof, err = smst.Prove([]byte("absent"))
+		require.NoError(t, err)
+		valid, err = VerifySumProofAgainstHash(proof, rootHash, []byte("absent"), nil, 0, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+
+		// The full root, with its sum, is not a root hash
+		_, err = VerifySumProofAgainstHash(proof, smst.Root(), []byte("absent"), nil, 0, smst.Spec())
+		require.ErrorIs(t, err, ErrMalformedRoot)
+	}
+}
+
+func TestSMST_Proof_VerifyCompactSumProofBytes(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 5))
+	require.NoError(t, smst.Update([]byte("baz"), []byte("qux"), 7))
+	root := smst.Root()
+
+	proof, err := smst.Prove([]byte("foo"))
+	require.NoError(t, err)
+	compactProof, err := CompactProof(proof, smst.Spec())
+	require.NoError(t, err)
+	proofBytes, err := compactProof.Marshal()
+	require.NoError(t, err)
+
+	valid, err := VerifyCompactSumProofBytes(proofBytes, root, []byte("foo"), []byte("bar"), 5, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifyCompactSumProofBytes(proofBytes, root, []byte("foo"), []byte("bar"), 6, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// Bytes that are not a proof fail to unmarshal
+	_, err = VerifyCompactSumProofBytes([]byte("not a proof"), root, []byte("foo"), []byte("bar"), 5, smst.Spec())
+	require.ErrorIs(t, err, ErrMalformedProof)
+	require.NotErrorIs(t, err, ErrBadProof)
+
+	// Whereas a well-formed encoding of an invalid proof is a bad proof
+	compactProof.NumSideNodes = smst.Spec().depth() + 1
+	proofBytes, err = compactProof.Marshal()
+	require.NoError(t, err)
+	_, err = VerifyCompactSumProofBytes(proofBytes, root, []byte("foo"), []byte("bar"), 5, smst.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+	require.NotErrorIs(t, err, ErrMalformedProof)
+}
+
+func TestSMST_Proof_ProveCloserThan(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithValueHasher(nil))
+
+	// The trie is empty so no leaf is closer than any claim
+	_, _, err := smst.ProveCloserThan(make([]byte, sha256.Size), []byte("foo"))
+	require.ErrorIs(t, err, ErrNoCloserLeaf)
+
+	for i, key := range []string{"foo", "bar", "baz", "testKey", "testKey2", "testKey4"} {
+		require.NoError(t, smst.Update([]byte(key), []byte(key), uint64(i)))
+	}
+	root := smst.Root()
+
+	// A path differing from that of testKey2 only in its last bit
+	path := sha256.Sum256([]byte("testKey2"))
+	flipPathBit(path[:], 255)
+	closestPath := sha256.Sum256([]byte("testKey2"))
+
+	// testKey4 is not the closest, the proof of testKey2 refutes the claim
+	betterPath, proof, err := smst.ProveCloserThan(path[:], []byte("testKey4"))
+	require.NoError(t, err)
+	require.Equal(t, closestPath[:], betterPath)
+	valid, err := VerifyClosestProof(proof, root, NoPrehashSpec(sha256.New(), true))
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Greater(t,
+		countCommonPrefixBits(proof.Path, proof.ClosestPath, 0),
+		countCommonPrefixBits(path[:], smst.ph.Path([]byte("testKey4")), 0),
+	)
+
+	// testKey2 is the closest so the claim cannot be refuted
+	_, _, err = smst.ProveCloserThan(path[:], []byte("testKey2"))
+	require.ErrorIs(t, err, ErrNoCloserLeaf)
+}
+
+func TestSMST_Proof_VerifySumProofWithCost(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+
+	// Membership proofs hash the leaf and a node for each side node
+	proof, err := smst.Prove([]byte("key7"))
+	require.NoError(t, err)
+	valid, hashOps, err := VerifySumProofWithCost(proof, root, []byte("key7"), []byte("key7"), 7, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, len(proof.SideNodes)+1, hashOps)
+
+	// An invalid proof has the same cost
+	valid, hashOps, err = VerifySumProofWithCost(proof, root, []byte("key7"), []byte("key7"), 8, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Equal(t, len(proof.SideNodes)+1, hashOps)
+
+	// Non-membership proofs ending in an empty subtrie do not hash a leaf
+	for i := 0; ; i++ {
+		key := []byte("absent" + strconv.Itoa(i))
+		proof, err = smst.Prove(key)
+		require.NoError(t, err)
+		if proof.NonMembershipLeafData != nil {
+			continue
+		}
+		valid, hashOps, err = VerifySumProofWithCost(proof, root, key, nil, 0, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+		require.Equal(t, len(proof.SideNodes), hashOps)
+		break
+	}
+}
+
+func TestSMST_Proof_NodeSerializer(t *testing.T) {
+	nodes := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(nodes, sha256.New(), WithNodeSerializer(fieldAlignedSerializer{}))
+	canonical := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+		require.NoError(t, canonical.Update(key, key, uint64(i)))
+	}
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+
+	// The serializer changes the root but not the sum
+	require.NotEqual(t, canonical.Root(), root)
+	require.Equal(t, canonical.Sum(), smst.Sum())
+
+	// The same trie rebuilt in a different order has the same root
+	rebuilt := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithNodeSerializer(fieldAlignedSerializer{}))
+	for i := 19; i >= 0; i-- {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, rebuilt.Update(key, key, uint64(i)))
+	}
+	require.Equal(t, root, rebuilt.Root())
+
+	// Proofs, including those served from an imported trie, verify only with
+	// a spec using the serializer
+	imported := ImportSparseMerkleSumTrie(nodes, sha256.New(), root, WithNodeSerializer(fieldAlignedSerializer{}))
+	for _, tc := range []struct {
+		key, value []byte
+		sum        uint64
+	}{
+		{key: []byte("key7"), value: []byte("key7"), sum: 7},
+		{key: []byte("absent")},
+	} {
+		key, value, sum := tc.key, tc.value, tc.sum
+		proof, err := imported.Prove(key)
+		require.NoError(t, err)
+		valid, err := VerifySumProof(proof, root, key, value, sum, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+		compactProof, err := CompactProof(proof, smst.Spec())
+		require.NoError(t, err)
+		valid, err = VerifyCompactSumProof(compactProof, root, key, value, sum, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+		valid, _ = VerifySumProof(proof, root, key, value, sum, canonical.Spec())
+		require.False(t, valid)
+	}
+}
+
+func TestSMST_Proof_SumLeafHash(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	key := []byte("key7")
+	leafHash, err := SumLeafHash(key, key, 7, smst.Spec())
+	require.NoError(t, err)
+	prehashed, err := SumLeafHashPrehashed(smst.ph.Path(key), smst.digestValue(key), 7, smst.Spec())
+	require.NoError(t, err)
+	require.Equal(t, leafHash, prehashed)
+	require.Len(t, leafHash, hashSize(smst.Spec()))
+
+	// Folding the side nodes of the key's proof into the leaf hash gives the root
+	proof, err := smst.Prove(key)
+	require.NoError(t, err)
+	path := smst.ph.Path(key)
+	current := leafHash
+	for i, sideNode := range proof.SideNodes {
+		if getPathBit(path, len(proof.SideNodes)-1-i) == left {
+			current, _ = digestNode(smst.Spec(), current, sideNode)
+		} else {
+			current, _ = digestNode(smst.Spec(), sideNode, current)
+		}
+	}
+	require.Equal(t, []byte(smst.Root()), current)
+
+	// A different sum gives a different leaf
+	other, err := SumLeafHash(key, key, 8, smst.Spec())
+	require.NoError(t, err)
+	require.NotEqual(t, leafHash, other)
+
+	_, err = SumLeafHashPrehashed(path[1:], smst.digestValue(key), 7, smst.Spec())
+	require.Error(t, err)
+}
+
+func TestSMST_Proof_MalformedNonMembershipLeafData(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+
+	// Find a non-membership proof ending in an unrelated leaf
+	var key []byte
+	var proof *SparseMerkleProof
+	for i := 0; proof == nil || proof.NonMembershipLeafData == nil; i++ {
+		key = []byte("absent" + strconv.Itoa(i))
+		var err error
+		proof, err = smst.Prove(key)
+		require.NoError(t, err)
+	}
+	valid, err := VerifySumProof(proof, root, key, nil, 0, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	leafData := proof.NonMembershipLeafData
+	lps := len(leafPrefix) + smst.ph.PathSize()
+
+	for desc, data := range map[string][]byte{
+		"inner node prefix": append(append([]byte{}, innerPrefix...), leafData[len(leafPrefix):]...),
+		"extension prefix":  append(append([]byte{}, extPrefix...), leafData[len(leafPrefix):]...),
+		"truncated sum":     leafData[:lps+sumSize/2],
+		"missing sum":       leafData[:lps],
+	} {
+		broken := *proof
+		broken.NonMembershipLeafData = data
+		require.ErrorIs(t, broken.validateBasic(smst.Spec()), ErrMalformedLeafData, desc)
+		valid, err := VerifySumProof(&broken, root, key, nil, 0, smst.Spec())
+		require.ErrorIs(t, err, ErrBadProof, desc)
+		require.ErrorIs(t, err, ErrMalformedLeafData, desc)
+		require.False(t, valid, desc)
+
+		// Compact proofs are checked before their side nodes are decompacted
+		compactProof, err := CompactProof(proof, smst.Spec())
+		require.NoError(t, err)
+		compactProof.NonMembershipLeafData = data
+		valid, err = VerifyCompactSumProofStreaming(compactProof, root, key, nil, 0, smst.Spec())
+		require.ErrorIs(t, err, ErrMalformedLeafData, desc)
+		require.False(t, valid, desc)
+	}
+}
+
+func TestSMST_Proof_VerifierSpecFromParams(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha512.New())
+	require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 5))
+	require.NoError(t, smst.Update([]byte("baz"), []byte("qux"), 7))
+	root := smst.Root()
+
+	spec, err := VerifierSpecFromParams("sha512", true, true, true)
+	require.NoError(t, err)
+	require.Equal(t, SpecFingerprint(smst.Spec()), SpecFingerprint(spec))
+	proof, err := smst.Prove([]byte("foo"))
+	require.NoError(t, err)
+	valid, err := VerifySumProof(proof, root, []byte("foo"), []byte("bar"), 5, spec)
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Without prehashing the spec matches NoPrehashSpec
+	spec, err = VerifierSpecFromParams("sha256", true, false, false)
+	require.NoError(t, err)
+	require.Equal(t, SpecFingerprint(NoPrehashSpec(sha256.New(), true)), SpecFingerprint(spec))
+	spec, err = VerifierSpecFromParams("sha256", false, true, false)
+	require.NoError(t, err)
+	require.Equal(t, SpecFingerprint(NewSparseMerkleTrie(simplemap.NewSimpleMap(), sha256.New(), WithValueHasher(nil)).Spec()), SpecFingerprint(spec))
+
+	_, err = VerifierSpecFromParams("keccak256", true, true, true)
+	require.ErrorIs(t, err, ErrUnknownHasher)
+}
+
+func TestSMST_Proof_VerifySumProofByLeafHash(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+
+	key := []byte("key7")
+	proof, err := smst.Prove(key)
+	require.NoError(t, err)
+	leafHash, err := SumLeafHash(key, key, 7, smst.Spec())
+	require.NoError(t, err)
+	path := smst.ph.Path(key)
+	for _, sum := range []uint64{7, 8} {
+		leafHash, err := SumLeafHash(key, key, sum, smst.Spec())
+		require.NoError(t, err)
+		valid, err := VerifySumProofByLeafHash(proof, root, leafHash, path, smst.Spec())
+		require.NoError(t, err)
+		expected, err := VerifySumProof(proof, root, key, key, sum, smst.Spec())
+		require.NoError(t, err)
+		require.Equal(t, expected, valid)
+		require.Equal(t, sum == 7, valid)
+	}
+
+	// The leaf hash must be for the path provided
+	valid, err := VerifySumProofByLeafHash(proof, root, leafHash, smst.ph.Path([]byte("key8")), smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	_, err = VerifySumProofByLeafHash(proof, root, leafHash[1:], path, smst.Spec())
+	require.Error(t, err)
+
+	// The placeholder proves the path ends in an empty subtrie
+	for i := 0; ; i++ {
+		key = []byte("absent" + strconv.Itoa(i))
+		proof, err = smst.Prove(key)
+		require.NoError(t, err)
+		if proof.Kind() != NonMembershipPlaceholder {
+			continue
+		}
+		valid, err = VerifySumProofByLeafHash(proof, root, placeholder(smst.Spec()), smst.ph.Path(key), smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+		break
+	}
+}
+
+func TestSMST_Proof_MaxProofSideNodes(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithMaxProofSideNodes(32))
+	for i := 0; i < 20; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+
+	// Proofs within the cap are verified
+	proof, err := smst.Prove([]byte("key1"))
+	require.NoError(t, err)
+	compactProof, err := CompactProof(proof, smst.Spec())
+	require.NoError(t, err)
+	valid, err := VerifyCompactSumProof(compactProof, root, []byte("key1"), []byte("key1"), 1, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// A proof claiming the maximum number of side nodes, all of which are
+	// placeholders so that it carries none, is rejected under the cap
+	crafted := &SparseCompactMerkleProof{
+		NumSideNodes: smst.Spec().depth(),
+		BitMask:      bytes.Repeat([]byte{0xff}, bitMaskLen(smst.Spec().depth())),
+	}
+	_, err = VerifyCompactSumProof(crafted, root, []byte("key1"), []byte("key1"), 1, smst.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+	_, err = DecompactProof(crafted, smst.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+
+	// Whereas it is decompacted without the cap
+	uncapped := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	decompacted, err := DecompactProof(crafted, uncapped.Spec())
+	require.NoError(t, err)
+	require.Len(t, decompacted.SideNodes, uncapped.Spec().depth())
+	_, err = VerifySumProof(decompacted, root, []byte("key1"), []byte("key1"), 1, smst.Spec())
+	require.ErrorIs(t, err, ErrBadProof)
+}
+
+func TestSMST_Proof_SumProofStepVerifier(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+	spec := smst.Spec()
+
+	// Stepping through the side nodes of a proof reaches the root
+	key := []byte("key3")
+	proof, err := smst.Prove(key)
+	require.NoError(t, err)
+	path := smst.ph.Path(key)
+	step := func(v *SumProofStepVerifier, sideNodes [][]byte) {
+		for i, sideNode := range sideNodes {
+			require.NoError(t, v.Step(sideNode, getPathBit(path, len(sideNodes)-1-i)))
+		}
+	}
+	leafDigest, err := SumLeafHash(key, key, 3, spec)
+	require.NoError(t, err)
+	v := NewSumProofStepVerifier(spec)
+	v.Init(spec.th.digestHash(leafDigest), 3)
+	step(v, proof.SideNodes)
+	got, err := v.Root()
+	require.NoError(t, err)
+	require.Equal(t, []byte(root), got)
+
+	// The wrong sum does not
+	v.Init(spec.th.digestHash(leafDigest), 4)
+	step(v, proof.SideNodes)
+	got, err = v.Root()
+	require.NoError(t, err)
+	require.NotEqual(t, []byte(root), got)
+
+	// Errors are retained
+	v = NewSumProofStepVerifier(spec)
+	require.Error(t, v.Step(proof.SideNodes[0], 0))
+	_, err = v.Root()
+	require.Error(t, err)
+	v.Init(spec.th.digestHash(leafDigest), 3)
+	require.ErrorIs(t, v.Step(proof.SideNodes[0][1:], 0), ErrBadProof)
+	require.ErrorIs(t, v.Step(proof.SideNodes[0], 0), ErrBadProof)
+	_, err = v.Root()
+	require.ErrorIs(t, err, ErrBadProof)
+	v.Init(spec.th.digestHash(leafDigest), 3)
+	require.Error(t, v.Step(proof.SideNodes[0], 2))
+	v.Init(leafDigest, 3)
+	_, err = v.Root()
+	require.ErrorIs(t, err, ErrBadProof)
+}
+
+func TestSMST_Proof_VerifySumProofs(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 10; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i+1)))
+	}
+	root := smst.Root()
+
+	// A mix of membership and non-membership keys
+	keys := [][]byte{[]byte("key1"), []byte("absent1"), []byte("key5"), []byte("absent2")}
+	values := [][]byte{[]byte("key1"), nil, []byte("key5"), nil}
+	sums := []uint64{2, 0, 6, 0}
+	proofs := make([]*SparseMerkleProof, len(keys))
+	for i, key := range keys {
+		proof, err := smst.Prove(key)
+		require.NoError(t, err)
+		proofs[i] = proof
+	}
+	valid, err := VerifySumProofs(proofs, root, keys, values, sums, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Each key is verified against its own state: claiming the membership of
+	// an absent key, or the non-membership of a present one, fails
+	valid, err = VerifySumProofs(proofs, root, keys, [][]byte{[]byte("key1"), []byte("absent1"), []byte("key5"), nil}, []uint64{2, 1, 6, 0}, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = VerifySumProofs(proofs, root, keys, [][]byte{nil, nil, []byte("key5"), nil}, []uint64{0, 0, 6, 0}, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// A key appearing twice is rejected, whether it is present or absent
+	for _, i := range []int{0, 1} {
+		dupKeys := append(append([][]byte{}, keys...), keys[i])
+		dupValues := append(append([][]byte{}, values...), values[i])
+		dupSums := append(append([]uint64{}, sums...), sums[i])
+		dupProofs := append(append([]*SparseMerkleProof{}, proofs...), proofs[i])
+		_, err = VerifySumProofs(dupProofs, root, dupKeys, dupValues, dupSums, smst.Spec())
+		require.ErrorIs(t, err, ErrDuplicateKey)
+	}
+
+	// As are distinct keys whose paths collide
+	weak := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithPathHasher(firstBytePathHasher{}))
+	require.NoError(t, weak.Update([]byte("foo"), []byte("foo"), 1))
+	proof, err := weak.Prove([]byte("foo"))
+	require.NoError(t, err)
+	_, err = VerifySumProofs(
+		[]*SparseMerkleProof{proof, proof}, weak.Root(),
+		[][]byte{[]byte("foo"), []byte("fizz")}, [][]byte{[]byte("foo"), []byte("foo")}, []uint64{1, 1},
+		weak.Spec(),
+	)
+	require.ErrorIs(t, err, ErrDuplicateKey)
+
+	// The slices must be of the same length
+	_, err = VerifySumProofs(proofs, root, keys, values, sums[1:], smst.Spec())
+	require.Error(t, err)
+}
+
+func TestSMST_Proof_HashSize(t *testing.T) {
+	full := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	// A size of 24 makes roots 32 bytes long, the length of a full sha256 digest
+	for _, size := range []int{16, 20, 24} {
+		smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithHashSize(size))
+		for i := 0; i < 20; i++ {
+			key := []byte("key" + strconv.Itoa(i))
+			require.NoError(t, smst.Update(key, key, uint64(i)))
+			require.NoError(t, full.Update(key, key, uint64(i)))
+		}
+		require.NoError(t, smst.Commit())
+		root := smst.Root()
+		require.Len(t, root, size+sumSize)
+		require.Equal(t, full.Sum(), smst.Sum())
+
+		// Side nodes are truncated, while paths are not
+		proof, err := smst.Prove([]byte("key1"))
+		require.NoError(t, err)
+		require.NotEmpty(t, proof.SideNodes)
+		for _, sideNode := range proof.SideNodes {
+			require.Len(t, sideNode, size+sumSize)
+		}
+		absent, err := smst.Prove([]byte("absent"))
+		require.NoError(t, err)
+		if absent.NonMembershipLeafData != nil {
+			path, _ := parseLeaf(absent.NonMembershipLeafData, smst.ph)
+			require.Len(t, path, sha256.Size)
+		}
+
+		valid, err := VerifySumProof(proof, root, []byte("key1"), []byte("key1"), 1, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+		valid, err = VerifySumProof(absent, root, []byte("absent"), nil, 0, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+		compactProof, err := CompactProof(proof, smst.Spec())
+		require.NoError(t, err)
+		valid, err = VerifyCompactSumProof(compactProof, root, []byte("key1"), []byte("key1"), 1, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+
+		// Proofs only verify under the same truncation
+		valid, err = VerifySumProof(proof, full.Root(), []byte("key1"), []byte("key1"), 1, full.Spec())
+		require.False(t, valid && err == nil)
+		other := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithHashSize(size+4))
+		valid, err = VerifySumProof(proof, root, []byte("key1"), []byte("key1"), 1, other.Spec())
+		require.False(t, valid && err == nil)
+		require.NotEqual(t, SpecFingerprint(smst.Spec()), SpecFingerprint(other.Spec()))
+	}
+
+	// Sizes below the minimum or above the hasher's size are rejected
+	for _, size := range []int{minHashSize - 1, sha256.Size + 1} {
+		func() {
+			defer func() {
+				err, ok := recover().(error)
+				require.True(t, ok)
+				require.ErrorIs(t, err, ErrUnsupportedHashSize)
+			}()
+			NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithHashSize(size))
+		}()
+	}
+}
+
+func TestSMST_Proof_ZeroSumLeafVersusEmptySlot(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+
+	// A single live leaf with a zero sum is not an empty trie
+	require.NoError(t, smst.Update([]byte("zero"), []byte("value"), 0))
+	require.Zero(t, smst.Sum())
+	require.NotEqual(t, placeholder(smst.Spec()), []byte(smst.Root()))
+	proof, err := smst.Prove([]byte("zero"))
+	require.NoError(t, err)
+	require.Equal(t, Membership, proof.Kind())
+	valid, err := VerifySumProof(proof, smst.Root(), []byte("zero"), []byte("value"), 0, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySumProof(proof, smst.Root(), []byte("zero"), nil, 0, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	require.NoError(t, smst.Update([]byte("nil"), nil, 0))
+	for i := 0; i < 10; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+
+	// A live leaf with a zero sum is proven as a member, not as an empty slot
+	proof, err = smst.Prove([]byte("zero"))
+	require.NoError(t, err)
+	require.False(t, proof.IsNonMembership())
+	valid, err = VerifySumProof(proof, root, []byte("zero"), []byte("value"), 0, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySumProof(proof, root, []byte("zero"), nil, 0, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// An empty slot is proven absent, and cannot be proven to hold a zero sum
+	var absent []byte
+	for i := 0; absent == nil; i++ {
+		key := []byte("absent" + strconv.Itoa(i))
+		proof, err = smst.Prove(key)
+		require.NoError(t, err)
+		if proof.Kind() == NonMembershipPlaceholder {
+			absent = key
+		}
+	}
+	require.True(t, proof.IsNonMembership())
+	valid, err = VerifySumProof(proof, root, absent, nil, 0, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySumProof(proof, root, absent, []byte("value"), 0, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = VerifySumProofMembership(proof, root, absent, nil, 0, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// A live leaf with a nil value and zero sum is not taken for an empty slot
+	// by VerifySumProof, and its membership is proven explicitly
+	proof, err = smst.Prove([]byte("nil"))
+	require.NoError(t, err)
+	require.Equal(t, Membership, proof.Kind())
+	valid, err = VerifySumProof(proof, root, []byte("nil"), nil, 0, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = VerifySumProofMembership(proof, root, []byte("nil"), nil, 0, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySumProofMembership(proof, root, []byte("nil"), nil, 1, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+}
+
+func TestSMST_Proof_ProveClosestWeighted(t *testing.T) {
+	ph := dummyPathHasher{32}
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithPathHasher(ph))
+	newPath := func(first byte) []byte {
+		path := make([]byte, ph.PathSize())
+		path[0] = first
+		return path
+	}
+	// Both keys share no bits with the path, so are equally close to it
+	path := newPath(0b00000000)
+	light := newPath(0b11000000)
+	heavy := newPath(0b11100000)
+	other := newPath(0b10000000)
+	require.NoError(t, smst.Update(light, []byte("light"), 1))
+	require.NoError(t, smst.Update(heavy, []byte("heavy"), 10))
+	require.NoError(t, smst.Update(other, []byte("other"), 100))
+	root := smst.Root()
+	higherSum := func(a, b ClosestCandidate) bool {
+		require.Equal(t, 0, a.CommonPrefix)
+		require.Equal(t, b.CommonPrefix, a.CommonPrefix)
+		return a.Sum > b.Sum
+	}
+
+	// Pure LCP picks the leaf with the most bits in common after the prefix
+	closest, err := smst.ProveClosest(path)
+	require.NoError(t, err)
+	require.Equal(t, other, closest.ClosestPath)
+	for _, prefer := range []func(a, b ClosestCandidate) bool{
+		nil,
+		func(ClosestCandidate, ClosestCandidate) bool { return false },
+	} {
+		proof, err := smst.ProveClosestWeighted(path, prefer)
+		require.NoError(t, err)
+		require.Equal(t, closest.ClosestPath, proof.ClosestPath)
+	}
+
+	// The tie is broken by the higher sum, with a proof that verifies
+	proof, err := smst.ProveClosestWeighted(path, higherSum)
+	require.NoError(t, err)
+	require.Equal(t, other, proof.ClosestPath)
+	valid, err := VerifyClosestProof(proof, root, NoPrehashSpec(sha256.New(), true))
+	require.NoError(t, err)
+	require.True(t, valid)
+	smst = NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithPathHasher(ph))
+	require.NoError(t, smst.Update(light, []byte("light"), 1))
+	require.NoError(t, smst.Update(heavy, []byte("heavy"), 10))
+	root = smst.Root()
+	closest, err = smst.ProveClosest(path)
+	require.NoError(t, err)
+	require.Equal(t, light, closest.ClosestPath)
+	proof, err = smst.ProveClosestWeighted(path, higherSum)
+	require.NoError(t, err)
+	require.Equal(t, heavy, proof.ClosestPath)
+	valid, err = VerifyClosestProof(proof, root, NoPrehashSpec(sha256.New(), true))
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Leaves with a longer common prefix are not ties, whatever their sum
+	require.NoError(t, smst.Update(newPath(0b00100000), []byte("near"), 0))
+	proof, err = smst.ProveClosestWeighted(path, higherSum)
+	require.NoError(t, err)
+	require.Equal(t, newPath(0b00100000), proof.ClosestPath)
+	valid, err = VerifyClosestProof(proof, smst.Root(), NoPrehashSpec(sha256.New(), true))
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// An empty trie has no closest leaf
+	empty := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithPathHasher(ph))
+	proof, err = empty.ProveClosestWeighted(path, higherSum)
+	require.NoError(t, err)
+	require.Nil(t, proof.ClosestValueHash)
+}
+
+func TestSMST_Proof_ProveDelta(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	root := smst.Root()
+	key := []byte("42")
+
+	// The client caches every other side node of the proof, and other nodes
+	proof, err := smst.Prove(key)
+	require.NoError(t, err)
+	knownNodes := map[string]bool{
+		string(sha256.New().Sum([]byte("unrelated"))): true,
+	}
+	for i := 0; i < len(proof.SideNodes); i += 2 {
+		knownNodes[string(proof.SideNodes[i])] = true
+	}
+	delta, err := smst.ProveDelta(key, knownNodes)
+	require.NoError(t, err)
+	require.Less(t, len(delta.SideNodes), len(proof.SideNodes))
+
+	// The full proof is restored from the cache and verifies
+	full, err := delta.Expand(knownNodes)
+	require.NoError(t, err)
+	require.Equal(t, proof, full)
+	valid, err := VerifyDeltaSumProof(delta, knownNodes, root, key, key, 42, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifyDeltaSumProof(delta, knownNodes, root, key, key, 41, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// The proof survives serialisation
+	bz, err := delta.Marshal()
+	require.NoError(t, err)
+	decoded := new(DeltaProof)
+	require.NoError(t, decoded.Unmarshal(bz))
+	valid, err = VerifyDeltaSumProof(decoded, knownNodes, root, key, key, 42, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// A cache missing the referenced nodes cannot expand the proof
+	_, err = delta.Expand(map[string]bool{})
+	require.ErrorIs(t, err, ErrBadProof)
+	delta.SideNodes = delta.SideNodes[1:]
+	_, err = delta.Expand(knownNodes)
+	require.ErrorIs(t, err, ErrBadProof)
+
+	// Nothing is omitted for a client knowing no nodes
+	delta, err = smst.ProveDelta(key, nil)
+	require.NoError(t, err)
+	require.Equal(t, proof.SideNodes, delta.SideNodes)
+}
+
+func TestSMST_Proof_VerifyAgainstCheckpoint(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 5))
+	require.NoError(t, smst.Commit())
+	first := smst.Root()
+	proof, err := smst.Prove([]byte("foo"))
+	require.NoError(t, err)
+	require.NoError(t, smst.Update([]byte("baz"), []byte("qux"), 7))
+	require.NoError(t, smst.Commit())
+	second := smst.Root()
+
+	// A proof against a checkpointed root verifies as it would on its own
+	checkpoints := [][]byte{second, first}
+	valid, err := VerifyAgainstCheckpoint(proof, checkpoints, first, []byte("foo"), []byte("bar"), 5, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifyAgainstCheckpoint(proof, checkpoints, first, []byte("foo"), []byte("bar"), 6, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = VerifyAgainstCheckpoint(proof, checkpoints, second, []byte("foo"), []byte("bar"), 5, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// A valid proof is rejected if its root is not checkpointed
+	valid, err = VerifyAgainstCheckpoint(proof, [][]byte{second}, first, []byte("foo"), []byte("bar"), 5, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = VerifyAgainstCheckpoint(proof, nil, first, []byte("foo"), []byte("bar"), 5, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+}
+
+func TestSMST_Proof_VerifySumProofValueIn(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("status"), []byte("active"), 3))
+	require.NoError(t, smst.Update([]byte("other"), []byte("pending"), 5))
+	root := smst.Root()
+	proof, err := smst.Prove([]byte("status"))
+	require.NoError(t, err)
+
+	// The value in the set is returned
+	allowed := [][]byte{[]byte("pending"), []byte("active"), []byte("closed")}
+	matched, ok, err := VerifySumProofValueIn(proof, root, []byte("status"), allowed, 3, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("active"), matched)
+
+	// A value not in the set, or the wrong sum, does not match
+	matched, ok, err = VerifySumProofValueIn(proof, root, []byte("status"), allowed[:1], 3, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Nil(t, matched)
+	_, ok, err = VerifySumProofValueIn(proof, root, []byte("status"), allowed, 4, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, ok, err = VerifySumProofValueIn(proof, root, []byte("status"), nil, 3, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// An absent key matches no value
+	proof, err = smst.Prove([]byte("absent"))
+	require.NoError(t, err)
+	_, ok, err = VerifySumProofValueIn(proof, root, []byte("absent"), append(allowed, nil), 0, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestSMST_Proof_TracingStore(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New())
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+
+	// Prove a key through the tracing store, loading every node from it
+	store, trace := tracing.NewTracingStore(snm)
+	trie := ImportSparseMerkleSumTrie(store, sha256.New(), root)
+	key := []byte("42")
+	proof, err := trie.Prove(key)
+	require.NoError(t, err)
+	traced := trace()
+	require.Equal(t, []byte(root), traced[0])
+
+	// The nodes read are those along the path of the key, from the root to its
+	// leaf, and the leaf's sibling, whose data the proof carries
+	valueHash, err := sumValueHash(key, 42, trie.Spec())
+	require.NoError(t, err)
+	valid, updates, err := verifyProofWithUpdates(proof, root, key, valueHash, sumProofSpec(trie.Spec()))
+	require.NoError(t, err)
+	require.True(t, valid)
+	touched := map[string]bool{string(root): true}
+	for _, update := range updates {
+		touched[string(update[0])] = true
+	}
+	touched[string(hashPreimage(trie.Spec(), proof.SiblingData))] = true
+	leafHash, err := SumLeafHash(key, key, 42, trie.Spec())
+	require.NoError(t, err)
+	require.Contains(t, traced, leafHash)
+	for _, hash := range traced {
+		require.True(t, touched[string(hash)], "unexpected node %x", hash)
+	}
+
+	// Shipping only the nodes traced is enough to repeat the proof
+	shipped := simplemap.NewSimpleMap()
+	for _, hash := range traced {
+		node, err := snm.Get(hash)
+		require.NoError(t, err)
+		require.NoError(t, shipped.Set(hash, node))
+	}
+	require.Less(t, shipped.Len(), snm.Len())
+	reproven, err := ImportSparseMerkleSumTrie(shipped, sha256.New(), root).Prove(key)
+	require.NoError(t, err)
+	require.Equal(t, proof, reproven)
+}
+
+func TestSMST_Proof_VerifySumProofSumBytes(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 0x0102))
+	require.NoError(t, smst.Update([]byte("baz"), []byte("qux"), 7))
+	root := smst.Root()
+	proof, err := smst.Prove([]byte("foo"))
+	require.NoError(t, err)
+
+	// The sum verifies with or without its leading zero bytes
+	for _, sumBytes := range [][]byte{
+		{0x01, 0x02},
+		{0x00, 0x01, 0x02},
+		{0, 0, 0, 0, 0, 0, 0x01, 0x02},
+	} {
+		sum, err := NormalizeSumBytes(sumBytes)
+		require.NoError(t, err)
+		require.Equal(t, [sumSize]byte{0, 0, 0, 0, 0, 0, 0x01, 0x02}, sum)
+		valid, err := VerifySumProofSumBytes(proof, root, []byte("foo"), []byte("bar"), sumBytes, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid, "sum bytes %x", sumBytes)
+	}
+	valid, err := VerifySumProofSumBytes(proof, root, []byte("foo"), []byte("bar"), []byte{0x01, 0x03}, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// No bytes are a zero sum, proving the absence of a key
+	proof, err = smst.Prove([]byte("absent"))
+	require.NoError(t, err)
+	valid, err = VerifySumProofSumBytes(proof, root, []byte("absent"), nil, nil, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// More bytes than a sum are rejected, even if leading zeros
+	_, err = NormalizeSumBytes(make([]byte, sumSize+1))
+	require.ErrorIs(t, err, ErrMalformedSum)
+	_, err = VerifySumProofSumBytes(proof, root, []byte("absent"), nil, make([]byte, sumSize+1), smst.Spec())
+	require.ErrorIs(t, err, ErrMalformedSum)
+}
+
+func TestSMST_Proof_LintSumProof(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+	spec := smst.Spec()
+
+	// Valid proofs have no issues
+	for _, key := range [][]byte{[]byte("5"), []byte("absent")} {
+		proof, err := smst.Prove(key)
+		require.NoError(t, err)
+		require.NotEmpty(t, proof.SiblingData)
+		require.Empty(t, LintSumProof(proof, spec))
+	}
+	require.Len(t, LintSumProof(nil, spec), 1)
+
+	// Every issue is reported
+	proof, err := smst.Prove([]byte("5"))
+	require.NoError(t, err)
+	proof.SideNodes[1] = proof.SideNodes[1][1:]
+	proof.SideNodes[2] = append(proof.SideNodes[2], 0)
+	proof.NonMembershipLeafData = append([]byte{1}, make([]byte, sha256.Size)...)
+	proof.SiblingData[len(proof.SiblingData)-sumSize-1]++
+	issues := LintSumProof(proof, spec)
+	require.Len(t, issues, 4)
+	require.Contains(t, issues[0].Error(), "side node 1")
+	require.Contains(t, issues[1].Error(), "side node 2")
+	require.ErrorIs(t, issues[2], ErrMalformedLeafData)
+	require.Contains(t, issues[3].Error(), "sibling data hash")
+	proof.SideNodes = make([][]byte, spec.depth()+1)
+	require.Contains(t, LintSumProof(proof, spec)[0].Error(), "too many side nodes")
+
+	// Arbitrary proofs do not panic, and those without issues pass the checks
+	// made before verification
+	rng := rand.New(rand.NewSource(1))
+	randomBytes := func() []byte {
+		bz := make([]byte, rng.Intn(2*hashSize(spec)+sumSize))
+		rng.Read(bz)
+		if len(bz) > 0 {
+			bz[0] = byte(rng.Intn(4))
+		}
+		return bz
+	}
+	for i := 0; i < 1000; i++ {
+		proof := &SparseMerkleProof{SiblingData: randomBytes()}
+		if rng.Intn(2) == 0 {
+			proof.NonMembershipLeafData = randomBytes()
+		}
+		for j := rng.Intn(3); j > 0; j-- {
+			proof.SideNodes = append(proof.SideNodes, randomBytes())
+		}
+		issues := LintSumProof(proof, spec)
+		if len(issues) > 0 {
+			continue
+		}
+		require.NoError(t, proof.validateBasic(spec))
+	}
+}
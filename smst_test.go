@@ -1,11 +1,16 @@
 package smt
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
+	"runtime"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -220,6 +225,32 @@ func TestSMST_TrieDeleteBasic(t *testing.T) {
 	require.Equal(t, root1, smst.Root(), "re-inserting key after deletion")
 }
 
+// Test the storage-backed trie with options applied to its spec
+func TestSMST_TrieWithStorageOptions(t *testing.T) {
+	smn := simplemap.NewSimpleMap()
+	smv := simplemap.NewSimpleMap()
+	smst := NewSMSTWithStorage(smn, smv, sha256.New(), WithValueHasher(nil))
+
+	require.NoError(t, smst.Update([]byte("testKey"), []byte("testValue"), 5))
+	require.NoError(t, smst.Update([]byte("otherKey"), []byte("otherValue"), 7))
+
+	// Values are stored unhashed in both the trie and the value store
+	leafValue, sum, err := smst.Get([]byte("testKey"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("testValue"), leafValue)
+	require.Equal(t, uint64(5), sum)
+	value, sum, err := smst.GetValueSum([]byte("testKey"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("testValue"), value)
+	require.Equal(t, uint64(5), sum)
+
+	proof, err := smst.Prove([]byte("testKey"))
+	require.NoError(t, err)
+	valid, err := VerifySumProof(proof, smst.Root(), []byte("testKey"), []byte("testValue"), 5, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+}
+
 // Test trie ops with known paths
 func TestSMST_TrieKnownPath(t *testing.T) {
 	ph := dummyPathHasher{32}
@@ -340,6 +371,25 @@ func TestSMST_TrieMaxHeightCase(t *testing.T) {
 	require.Equal(t, 256, len(proof.SideNodes), "unexpected proof size")
 }
 
+// Test that keys with colliding paths share a leaf, as keys are not retained
+func TestSMST_TriePathCollision(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithPathHasher(firstBytePathHasher{}))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 2))
+
+	// The second key replaced the leaf of the first
+	require.Equal(t, uint64(2), smst.Sum())
+	value, sum, err := smst.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, smst.digestValue([]byte("value2")), value)
+	require.Equal(t, uint64(2), sum)
+	proof, err := smst.Prove([]byte("key1"))
+	require.NoError(t, err)
+	valid, err := VerifySumProof(proof, smst.Root(), []byte("key1"), []byte("value2"), 2, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+}
+
 func TestSMST_OrphanRemoval(t *testing.T) {
 	var smn, smv kvstore.MapStore
 	var impl *SMST
@@ -550,3 +600,1518 @@ func TestSMST_Retrieval(t *testing.T) {
 	sum = lazy.Sum()
 	require.Equal(t, sum, uint64(15))
 }
+
+func TestSMST_GetLeafData(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New())
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 5))
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 10))
+
+	// The leaf data matches the serialisation produced when digesting the leaf
+	var sumBz [sumSize]byte
+	binary.BigEndian.PutUint64(sumBz[:], 5)
+	valueHash := smst.digestValue([]byte("value1"))
+	valueHash = append(valueHash, sumBz[:]...)
+	_, expected := smst.th.digestSumLeaf(smst.ph.Path([]byte("key1")), valueHash)
+
+	leafData, err := smst.GetLeafData([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, expected, leafData)
+
+	// The leaf data is unchanged when read back from the node store
+	require.NoError(t, smst.Commit())
+	lazy := ImportSparseMerkleSumTrie(snm, sha256.New(), smst.Root())
+	leafData, err = lazy.GetLeafData([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, expected, leafData)
+
+	// The leaf data of a key can be used as the non-membership leaf data of a
+	// proof for a key not in the trie where that key's leaf is encountered
+	proof, err := lazy.Prove([]byte("key3"))
+	require.NoError(t, err)
+	if proof.NonMembershipLeafData != nil {
+		path, _ := parseLeaf(proof.NonMembershipLeafData, lazy.ph)
+		for _, key := range []string{"key1", "key2"} {
+			if bytes.Equal(path, lazy.ph.Path([]byte(key))) {
+				leafData, err = lazy.GetLeafData([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, proof.NonMembershipLeafData, leafData)
+			}
+		}
+	}
+
+	// Absent keys return an error
+	_, err = lazy.GetLeafData([]byte("key3"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestSMST_SingleLeaf(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New())
+
+	// Empty trie
+	proof, err := smst.Prove([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, &SparseMerkleProof{EmptyLeaf: true}, proof)
+
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 5))
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+
+	check := func(t *testing.T, trie *SMST) {
+		t.Helper()
+		value, sum, err := trie.Get([]byte("key1"))
+		require.NoError(t, err)
+		require.Equal(t, trie.digestValue([]byte("value1")), value)
+		require.Equal(t, uint64(5), sum)
+
+		value, sum, err = trie.Get([]byte("key2"))
+		require.NoError(t, err)
+		require.Equal(t, defaultValue, value)
+		require.Equal(t, uint64(0), sum)
+
+		// Membership proofs of the only leaf have no side nodes
+		proof, err := trie.Prove([]byte("key1"))
+		require.NoError(t, err)
+		require.Equal(t, &SparseMerkleProof{}, proof)
+		valid, err := VerifySumProof(proof, root, []byte("key1"), []byte("value1"), 5, trie.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+
+		// Non-membership proofs contain the only leaf's data
+		proof, err = trie.Prove([]byte("key2"))
+		require.NoError(t, err)
+		leafData, err := trie.GetLeafData([]byte("key1"))
+		require.NoError(t, err)
+		require.Equal(t, &SparseMerkleProof{NonMembershipLeafData: leafData}, proof)
+		valid, err = VerifySumProof(proof, root, []byte("key2"), defaultValue, 0, trie.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+
+		// The closest proof of the only leaf is unchanged
+		closestProof, err := trie.ProveClosest(trie.ph.Path([]byte("key2")))
+		require.NoError(t, err)
+		require.Equal(t, &SparseMerkleProof{}, closestProof.ClosestProof)
+	}
+	check(t, smst)
+	check(t, ImportSparseMerkleSumTrie(snm, sha256.New(), root))
+}
+
+func TestSMST_ValueCodec(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	codec := prefixCodec{prefix: 0x01}
+	smst := NewSparseMerkleSumTrie(snm, sha256.New(), WithValueCodec(codec))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 5))
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 10))
+
+	// Values that cannot be encoded are rejected
+	require.Error(t, smst.Update([]byte("key3"), []byte{}, 1))
+
+	// Get returns the original value rather than its digest
+	value, sum, err := smst.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), value)
+	require.Equal(t, uint64(5), sum)
+	value, sum, err = smst.Get([]byte("key3"))
+	require.NoError(t, err)
+	require.Equal(t, defaultValue, value)
+	require.Equal(t, uint64(0), sum)
+
+	// The leaf stores the encoded value
+	leafData, err := smst.GetLeafData([]byte("key1"))
+	require.NoError(t, err)
+	_, valueHash := parseLeaf(leafData, smst.ph)
+	require.Equal(t, []byte("\x01value1"), valueHash[:len(valueHash)-sumSize])
+
+	// Proofs verify with the codec
+	root := smst.Root()
+	proof, err := smst.Prove([]byte("key2"))
+	require.NoError(t, err)
+	valid, err := VerifySumProof(proof, root, []byte("key2"), []byte("value2"), 10, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySumProof(proof, root, []byte("key2"), []byte("value1"), 10, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	proof, err = smst.Prove([]byte("key3"))
+	require.NoError(t, err)
+	valid, err = VerifySumProof(proof, root, []byte("key3"), defaultValue, 0, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Values are decoded after importing the trie
+	require.NoError(t, smst.Commit())
+	lazy := ImportSparseMerkleSumTrie(snm, sha256.New(), smst.Root(), WithValueCodec(codec))
+	value, sum, err = lazy.Get([]byte("key2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), value)
+	require.Equal(t, uint64(10), sum)
+
+	// Decoding with a different codec fails
+	lazy = ImportSparseMerkleSumTrie(snm, sha256.New(), smst.Root(), WithValueCodec(prefixCodec{prefix: 0x02}))
+	_, _, err = lazy.Get([]byte("key2"))
+	require.Error(t, err)
+}
+
+func TestSMST_ValueResolver(t *testing.T) {
+	// blobs is an external store of values keyed by their hash
+	blobs := make(map[string][]byte)
+	store := func(value []byte) {
+		digest := sha256.Sum256(value)
+		blobs[string(digest[:])] = value
+	}
+	resolve := func(valueHash []byte) ([]byte, error) {
+		value, ok := blobs[string(valueHash)]
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+		return value, nil
+	}
+
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithValueResolver(resolve))
+	store([]byte("value1"))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 5))
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 10))
+
+	// Get returns the resolved original value
+	value, sum, err := smst.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), value)
+	require.Equal(t, uint64(5), sum)
+
+	// Values missing from the store fail to resolve
+	_, _, err = smst.Get([]byte("key2"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	// Empty keys are not resolved
+	value, sum, err = smst.Get([]byte("key3"))
+	require.NoError(t, err)
+	require.Equal(t, defaultValue, value)
+	require.Equal(t, uint64(0), sum)
+
+	// The trie only stores the value hash, so it has the same root as a trie
+	// without a resolver
+	plain := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, plain.Update([]byte("key1"), []byte("value1"), 5))
+	require.NoError(t, plain.Update([]byte("key2"), []byte("value2"), 10))
+	require.Equal(t, plain.Root(), smst.Root())
+	leafData, err := smst.GetLeafData([]byte("key1"))
+	require.NoError(t, err)
+	_, valueHash := parseLeaf(leafData, smst.ph)
+	digest := sha256.Sum256([]byte("value1"))
+	require.Equal(t, digest[:], valueHash[:len(valueHash)-sumSize])
+}
+
+func TestSMST_CommonPrefixLen(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithPathHasher(dummyPathHasher{2}))
+
+	tests := []struct {
+		keyA, keyB []byte
+		prefix     int
+	}{
+		{[]byte{0b00000000, 0}, []byte{0b10000000, 0}, 0},
+		{[]byte{0b01010000, 0}, []byte{0b01000000, 0}, 3},
+		{[]byte{0xff, 0b11110000}, []byte{0xff, 0b11100000}, 11},
+		{[]byte{0xab, 0xcd}, []byte{0xab, 0xcd}, 16},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.prefix, smst.CommonPrefixLen(tt.keyA, tt.keyB))
+		require.Equal(t, tt.prefix, smst.CommonPrefixLen(tt.keyB, tt.keyA))
+		require.Equal(t, 16-tt.prefix, PathDistance(tt.keyA, tt.keyB))
+	}
+
+	// The path hasher is applied to the keys
+	smst = NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	pathA := sha256.Sum256([]byte("foo"))
+	pathB := sha256.Sum256([]byte("bar"))
+	prefix := smst.CommonPrefixLen([]byte("foo"), []byte("bar"))
+	require.Equal(t, 256-PathDistance(pathA[:], pathB[:]), prefix)
+	require.Equal(t, 256, smst.CommonPrefixLen([]byte("foo"), []byte("foo")))
+
+	// Only the bits of the shorter path are compared
+	require.Equal(t, 0, PathDistance([]byte{0xff}, []byte{0xff, 0x00}))
+	require.Equal(t, 1, PathDistance([]byte{0xff, 0x00}, []byte{0xfe}))
+}
+
+func TestSMST_VerifyFullTree(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	entries := make([]Entry, 100)
+	for i := range entries {
+		key := []byte(fmt.Sprintf("key%d", i))
+		entries[i] = Entry{Key: key, Value: []byte(fmt.Sprintf("value%d", i)), Sum: uint64(i)}
+		require.NoError(t, smst.Update(entries[i].Key, entries[i].Value, entries[i].Sum))
+	}
+	root, sum := smst.Root(), smst.Sum()
+
+	valid, err := VerifyFullTree(entries, root, sum, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// The claimed sum must match
+	valid, err = VerifyFullTree(entries, root, sum+1, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// A tampered sum is detected
+	tampered := make([]Entry, len(entries))
+	copy(tampered, entries)
+	tampered[10].Sum++
+	valid, err = VerifyFullTree(tampered, root, sum, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// A missing entry is detected
+	valid, err = VerifyFullTree(entries[1:], root, sum, smst.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// Duplicate entries are rejected
+	valid, err = VerifyFullTree(append(entries, entries[0]), root, sum, smst.Spec())
+	require.Error(t, err)
+	require.False(t, valid)
+}
+
+func TestSMST_DirtySize(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New())
+	nodes, size := smst.DirtySize()
+	require.Zero(t, nodes)
+	require.Zero(t, size)
+
+	// A single leaf
+	require.NoError(t, smst.Update([]byte("key0"), []byte("value0"), 1))
+	nodes, size = smst.DirtySize()
+	require.Equal(t, 1, nodes)
+	require.Greater(t, size, 0)
+
+	// The dirty set grows with every update
+	prevNodes, prevSize := nodes, size
+	for i := 1; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+		nodes, size = smst.DirtySize()
+		require.Greater(t, nodes, prevNodes)
+		require.Greater(t, size, prevSize)
+		prevNodes, prevSize = nodes, size
+	}
+
+	// Committing empties the dirty set
+	require.NoError(t, smst.Commit())
+	nodes, size = smst.DirtySize()
+	require.Zero(t, nodes)
+	require.Zero(t, size)
+
+	// Updating a single key only dirties the nodes along its path
+	require.NoError(t, smst.Update([]byte("key7"), []byte("value7"), 7))
+	nodes, _ = smst.DirtySize()
+	proof, err := smst.Prove([]byte("key7"))
+	require.NoError(t, err)
+	require.Greater(t, nodes, 1)
+	require.LessOrEqual(t, nodes, 2*len(proof.SideNodes)+1)
+
+	// Deleted nodes are no longer counted
+	require.NoError(t, smst.Delete([]byte("key7")))
+	nodes, _ = smst.DirtySize()
+	require.LessOrEqual(t, nodes, 2*len(proof.SideNodes))
+}
+
+func TestSMST_DirtySize_Incremental(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithoutExtensionNodes()}} {
+		smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), opts...)
+		// The counts maintained as the trie is modified match a walk of the
+		// dirty nodes after every operation, across commits
+		for i := 0; i < 400; i++ {
+			key := []byte(strconv.Itoa(i % 60))
+			var err error
+			switch i % 7 {
+			case 3, 5:
+				err = smst.Delete(key)
+			case 6:
+				err = smst.Rekey(key, []byte(strconv.Itoa(i)))
+			default:
+				err = smst.Update(key, key, uint64(i))
+			}
+			if err != nil {
+				require.True(t, errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrKeyExists), err)
+			}
+			nodes, size := smst.DirtySize()
+			walkedNodes, walkedSize := walkDirtySize(smst.Spec(), smst.trie)
+			require.Equal(t, walkedNodes, nodes, "operation %d", i)
+			require.Equal(t, walkedSize, size, "operation %d", i)
+			if i%50 == 49 {
+				require.NoError(t, smst.Commit())
+			}
+		}
+	}
+}
+
+// walkDirtySize counts the uncommitted nodes beneath the node provided by
+// walking them, to check the counts DirtySize maintains
+func walkDirtySize(spec *TrieSpec, node trieNode) (nodes int, approxBytes int) {
+	if node == nil || node.Persisted() {
+		return 0, 0
+	}
+	nodes, approxBytes = 1, dirtyNodeSize(spec, node)
+	var children []trieNode
+	switch n := node.(type) {
+	case *extensionNode:
+		children = []trieNode{n.child}
+	case *innerNode:
+		children = []trieNode{n.leftChild, n.rightChild}
+	}
+	for _, child := range children {
+		childNodes, childBytes := walkDirtySize(spec, child)
+		nodes, approxBytes = nodes+childNodes, approxBytes+childBytes
+	}
+	return nodes, approxBytes
+}
+
+// writeCountingStore wraps a MapStore counting the writes made to it
+type writeCountingStore struct {
+	kvstore.MapStore
+	writes int
+}
+
+func (s *writeCountingStore) Set(key, value []byte) error {
+	s.writes++
+	return s.MapStore.Set(key, value)
+}
+
+func (s *writeCountingStore) Delete(key []byte) error {
+	s.writes++
+	return s.MapStore.Delete(key)
+}
+
+func TestSMST_CommitRoot(t *testing.T) {
+	store := &writeCountingStore{MapStore: simplemap.NewSimpleMap()}
+	smst := NewSparseMerkleSumTrie(store, sha256.New())
+
+	// Committing an empty trie writes nothing
+	root, err := smst.CommitRoot()
+	require.NoError(t, err)
+	require.Equal(t, smst.Root(), root)
+	require.Zero(t, store.writes)
+
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 2))
+	root, err = smst.CommitRoot()
+	require.NoError(t, err)
+	require.Equal(t, smst.Root(), root)
+	require.Equal(t, uint64(3), root.Sum())
+	writes := store.writes
+	require.NotZero(t, writes)
+
+	// Committing an unchanged trie returns the same root without any writes
+	again, err := smst.CommitRoot()
+	require.NoError(t, err)
+	require.Equal(t, root, again)
+	require.Equal(t, writes, store.writes)
+
+	// Including after it has been imported
+	imported := ImportSparseMerkleSumTrie(store, sha256.New(), root)
+	again, err = imported.CommitRoot()
+	require.NoError(t, err)
+	require.Equal(t, root, again)
+	require.Equal(t, writes, store.writes)
+
+	// Changes are committed and the new root returned
+	require.NoError(t, smst.Delete([]byte("key1")))
+	root, err = smst.CommitRoot()
+	require.NoError(t, err)
+	require.Equal(t, smst.Root(), root)
+	require.Equal(t, uint64(2), root.Sum())
+	require.Greater(t, store.writes, writes)
+}
+
+func TestSMST_CommitIfDirty(t *testing.T) {
+	store := &writeCountingStore{MapStore: simplemap.NewSimpleMap()}
+	smst := NewSparseMerkleSumTrie(store, sha256.New())
+
+	committed, err := smst.CommitIfDirty()
+	require.NoError(t, err)
+	require.False(t, committed)
+
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+	committed, err = smst.CommitIfDirty()
+	require.NoError(t, err)
+	require.True(t, committed)
+	writes := store.writes
+	require.NotZero(t, writes)
+
+	// Nothing has changed since the last commit
+	committed, err = smst.CommitIfDirty()
+	require.NoError(t, err)
+	require.False(t, committed)
+	require.Equal(t, writes, store.writes)
+
+	// Deletes are committed too
+	require.NoError(t, smst.Delete([]byte("key1")))
+	committed, err = smst.CommitIfDirty()
+	require.NoError(t, err)
+	require.True(t, committed)
+	require.Greater(t, store.writes, writes)
+}
+
+// failingBatchStore is a BatchStore whose batches fail while fail is set
+type failingBatchStore struct {
+	kvstore.MapStore
+	fail bool
+}
+
+func (s *failingBatchStore) Batch(ops []kvstore.BatchOp) error {
+	if s.fail {
+		return errors.New("batch failed")
+	}
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = s.MapStore.Delete(op.Key)
+		} else {
+			err = s.MapStore.Set(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSMST_Commit_FailedBatch(t *testing.T) {
+	store := &failingBatchStore{MapStore: simplemap.NewSimpleMap()}
+	smst := NewSparseMerkleSumTrie(store, sha256.New())
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+	}
+
+	// A failed batch leaves the nodes dirty, so the next commit writes them
+	store.fail = true
+	require.Error(t, smst.Commit())
+	require.Zero(t, store.Len())
+	dirtyNodes, _ := smst.DirtySize()
+	require.NotZero(t, dirtyNodes)
+	store.fail = false
+	require.NoError(t, smst.Commit())
+	require.Equal(t, dirtyNodes, store.Len())
+
+	imported := ImportSparseMerkleSumTrie(store, sha256.New(), smst.Root())
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		value, sum, err := imported.Get(key)
+		require.NoError(t, err)
+		expected, _, err := smst.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, expected, value)
+		require.Equal(t, uint64(i), sum)
+	}
+
+	// Orphans are deleted by the commit retrying a failed batch
+	require.NoError(t, smst.Delete([]byte("key0")))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+	store.fail = true
+	require.Error(t, smst.Commit())
+	store.fail = false
+	require.NoError(t, smst.Commit())
+	nodeCount, _, err := smst.StorageSize()
+	require.NoError(t, err)
+	require.Equal(t, nodeCount, store.Len())
+}
+
+// readCountingStore wraps a MapStore counting the reads made of each key
+type readCountingStore struct {
+	kvstore.MapStore
+	reads map[string]int
+}
+
+func (s *readCountingStore) Get(key []byte) ([]byte, error) {
+	s.reads[string(key)]++
+	return s.MapStore.Get(key)
+}
+
+func TestSMST_GetMany(t *testing.T) {
+	store := &readCountingStore{MapStore: simplemap.NewSimpleMap(), reads: make(map[string]int)}
+	smst := NewSparseMerkleSumTrie(store, sha256.New())
+	keys := make([][]byte, 0, 21)
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, smst.Update(key, []byte(fmt.Sprintf("value%d", i)), uint64(i)))
+		keys = append(keys, key)
+	}
+	keys = append(keys, []byte("absent"))
+
+	// Values match those returned by Get, including for uncommitted tries
+	values, sums, err := smst.GetMany(keys)
+	require.NoError(t, err)
+	require.Len(t, values, len(keys))
+	require.Len(t, sums, len(keys))
+	for i, key := range keys {
+		value, sum, err := smst.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, value, values[i])
+		require.Equal(t, sum, sums[i])
+	}
+	require.Equal(t, defaultValue, values[20])
+	require.Equal(t, uint64(0), sums[20])
+
+	// Each persisted node is read from the store at most once
+	require.NoError(t, smst.Commit())
+	imported := ImportSparseMerkleSumTrie(store, sha256.New(), smst.Root())
+	importedValues, importedSums, err := imported.GetMany(keys)
+	require.NoError(t, err)
+	require.Equal(t, values, importedValues)
+	require.Equal(t, sums, importedSums)
+	require.NotEmpty(t, store.reads)
+	for _, count := range store.reads {
+		require.Equal(t, 1, count)
+	}
+
+	values, sums, err = smst.GetMany(nil)
+	require.NoError(t, err)
+	require.Empty(t, values)
+	require.Empty(t, sums)
+}
+
+func TestSMST_EvictBelow(t *testing.T) {
+	// Keys are used as paths so that leaves are ordered by timestamp
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(),
+		WithPathHasher(newNilPathHasher(sha256.Size)))
+	timestampKey := func(ts uint64) []byte {
+		key := make([]byte, sha256.Size)
+		binary.BigEndian.PutUint64(key[sha256.Size-8:], ts)
+		return key
+	}
+	for ts := uint64(1); ts <= 10; ts++ {
+		require.NoError(t, smst.Update(timestampKey(ts), []byte("value"), ts))
+	}
+	require.Equal(t, uint64(55), smst.Sum())
+
+	// Evicting the older half leaves only the newer half in the sum
+	evicted, err := smst.EvictBelow(timestampKey(6))
+	require.NoError(t, err)
+	require.Equal(t, 5, evicted)
+	require.Equal(t, uint64(6+7+8+9+10), smst.Sum())
+	for ts := uint64(1); ts <= 10; ts++ {
+		_, sum, err := smst.Get(timestampKey(ts))
+		require.NoError(t, err)
+		if ts < 6 {
+			require.Zero(t, sum)
+		} else {
+			require.Equal(t, ts, sum)
+		}
+	}
+
+	// The remaining leaves are committed and can be evicted after an import
+	require.NoError(t, smst.Commit())
+	imported := ImportSparseMerkleSumTrie(smst.nodes, sha256.New(), smst.Root(),
+		WithPathHasher(newNilPathHasher(sha256.Size)))
+	evicted, err = imported.EvictBelow(timestampKey(6))
+	require.NoError(t, err)
+	require.Zero(t, evicted)
+	evicted, err = imported.EvictBelow(timestampKey(100))
+	require.NoError(t, err)
+	require.Equal(t, 5, evicted)
+	require.Zero(t, imported.Sum())
+}
+
+func TestSMST_ProveCommittedOnly(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithProveCommittedOnly())
+
+	// Before the first commit the trie reads as empty
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+	_, sum, err := smst.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Zero(t, sum)
+
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 2))
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+	committedProof, err := smst.Prove([]byte("key1"))
+	require.NoError(t, err)
+	committedClosest, err := smst.ProveClosest(smst.ph.Path([]byte("key3")))
+	require.NoError(t, err)
+
+	// Uncommitted changes are not reflected by reads and proofs
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value3"), 3))
+	require.NoError(t, smst.Update([]byte("key3"), []byte("value3"), 3))
+	require.NotEqual(t, root, smst.Root())
+	value, sum, err := smst.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, smst.digestValue([]byte("value1")), value)
+	require.Equal(t, uint64(1), sum)
+	proof, err := smst.Prove([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, committedProof, proof)
+	valid, err := VerifySumProof(proof, root, []byte("key1"), []byte("value1"), 1, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	closest, err := smst.ProveClosest(smst.ph.Path([]byte("key3")))
+	require.NoError(t, err)
+	require.Equal(t, committedClosest, closest)
+	// The leftmost and rightmost leaves cannot both be the new or updated key
+	right, err := smst.ProveClosestRight(make([]byte, smst.ph.PathSize()))
+	require.NoError(t, err)
+	valid, err = VerifyClosestProof(right, root, NoPrehashSpec(sha256.New(), true))
+	require.NoError(t, err)
+	require.True(t, valid)
+	left, err := smst.ProveClosestLeft(bytes.Repeat([]byte{0xff}, smst.ph.PathSize()))
+	require.NoError(t, err)
+	valid, err = VerifyClosestProof(left, root, NoPrehashSpec(sha256.New(), true))
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// As are the other reads, so that ProveSumOf's total agrees with its proofs
+	values, sums, err := smst.GetMany([][]byte{[]byte("key1"), []byte("key3")})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{smst.digestValue([]byte("value1")), defaultValue}, values)
+	require.Equal(t, []uint64{1, 0}, sums)
+	sum, ok, err := smst.GetVerified([]byte("key1"), []byte("value1"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), sum)
+	leafData, err := smst.GetLeafData([]byte("key1"))
+	require.NoError(t, err)
+	valid, err = VerifySumProofByLeafHash(committedProof, root, hashPreimage(smst.Spec(), leafData), smst.ph.Path([]byte("key1")), smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	subRoot, subSum, err := smst.SubtreeRoot(nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte(root), subRoot)
+	require.Equal(t, uint64(3), subSum)
+	total, proofs, err := smst.ProveSumOf([][]byte{[]byte("key1"), []byte("key2")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), total)
+	valid, err = VerifySetSum(
+		[][]byte{[]byte("key1"), []byte("key2")},
+		[][]byte{[]byte("value1"), []byte("value2")},
+		[]uint64{1, 2}, total, proofs, root, smst.Spec(),
+	)
+	require.NoError(t, err)
+	require.True(t, valid)
+	_, _, err = smst.ProveSumOf([][]byte{[]byte("key3")})
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	// Once committed they are
+	require.NoError(t, smst.Commit())
+	proof, err = smst.Prove([]byte("key1"))
+	require.NoError(t, err)
+	valid, err = VerifySumProof(proof, smst.Root(), []byte("key1"), []byte("value3"), 3, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// By default uncommitted changes are reflected
+	smst = NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+	_, sum, err = smst.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), sum)
+}
+
+func TestSMST_Rekey(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	expected := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, smst.Update(key, key, uint64(i+1)))
+		require.NoError(t, expected.Update(key, key, uint64(i+1)))
+	}
+	require.NoError(t, smst.Commit())
+
+	require.NoError(t, smst.Rekey([]byte("key3"), []byte("renamed")))
+	require.NoError(t, expected.Delete([]byte("key3")))
+	require.NoError(t, expected.Update([]byte("renamed"), []byte("key3"), 4))
+	require.Equal(t, expected.Root(), smst.Root())
+
+	// The value and sum are preserved under the new key only
+	value, sum, err := smst.Get([]byte("renamed"))
+	require.NoError(t, err)
+	require.Equal(t, smst.digestValue([]byte("key3")), value)
+	require.Equal(t, uint64(4), sum)
+	_, sum, err = smst.Get([]byte("key3"))
+	require.NoError(t, err)
+	require.Zero(t, sum)
+	require.Equal(t, expected.Sum(), smst.Sum())
+
+	// The orphans of the operation are removed on commit
+	require.NoError(t, smst.Commit())
+	imported := ImportSparseMerkleSumTrie(smst.nodes, sha256.New(), smst.Root())
+	_, sum, err = imported.Get([]byte("renamed"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), sum)
+
+	root := smst.Root()
+	require.ErrorIs(t, smst.Rekey([]byte("key3"), []byte("other")), ErrKeyNotFound)
+	require.ErrorIs(t, smst.Rekey([]byte("key4"), []byte("key5")), ErrKeyExists)
+	require.ErrorIs(t, smst.Rekey([]byte("key4"), []byte("key4")), ErrKeyExists)
+	require.Equal(t, root, smst.Root())
+}
+
+func TestSMST_RejectZeroSum(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithRejectZeroSum())
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+	root := smst.Root()
+
+	// Zeroing a leaf is rejected and leaves the trie unchanged
+	require.ErrorIs(t, smst.Update([]byte("key1"), []byte("value1"), 0), ErrZeroSumNotAllowed)
+	require.ErrorIs(t, smst.Update([]byte("key2"), []byte("value2"), 0), ErrZeroSumNotAllowed)
+	require.Equal(t, root, smst.Root())
+
+	// The leaf is removed with a delete instead
+	require.NoError(t, smst.Delete([]byte("key1")))
+	require.Zero(t, smst.Sum())
+
+	// Zero sums are allowed by default
+	smst = NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 0))
+}
+
+func TestSMST_AppendOnly(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithAppendOnly())
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+	root := smst.Root()
+
+	// The key can be neither overwritten nor removed
+	require.ErrorIs(t, smst.Update([]byte("key1"), []byte("value2"), 1), ErrKeyImmutable)
+	require.ErrorIs(t, smst.Update([]byte("key1"), []byte("value1"), 1), ErrKeyImmutable)
+	require.ErrorIs(t, smst.Delete([]byte("key1")), ErrDeleteForbidden)
+	_, err := smst.EvictBelow([]byte("key2"))
+	require.ErrorIs(t, err, ErrDeleteForbidden)
+	require.ErrorIs(t, smst.Rekey([]byte("key1"), []byte("key3")), ErrDeleteForbidden)
+	require.Equal(t, root, smst.Root())
+
+	// Neither can it through the embedded SMT
+	require.ErrorIs(t, smst.SMT.Update([]byte("key1"), []byte("value2")), ErrKeyImmutable)
+	require.ErrorIs(t, smst.SMT.Delete([]byte("key1")), ErrDeleteForbidden)
+	require.ErrorIs(t, smst.SMT.Rekey([]byte("key1"), []byte("key3")), ErrDeleteForbidden)
+	require.Equal(t, root, smst.Root())
+
+	// New keys are added
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 2))
+	require.Equal(t, uint64(3), smst.Sum())
+	value, sum, err := smst.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), sum)
+	require.Equal(t, smst.digestValue([]byte("value1")), value)
+}
+
+func TestSMST_MonotonicSums(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithMonotonicSums())
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 5))
+
+	// The sum of a key can increase, or stay the same with a new value
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 8))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value2"), 8))
+	root := smst.Root()
+
+	// A decrease is rejected and leaves the trie unchanged
+	require.ErrorIs(t, smst.Update([]byte("key1"), []byte("value3"), 7), ErrSumDecrease)
+	require.Equal(t, root, smst.Root())
+	value, sum, err := smst.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), sum)
+	require.Equal(t, smst.digestValue([]byte("value2")), value)
+
+	// New keys may have any sum, and keys may be deleted
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 0))
+	require.NoError(t, smst.Delete([]byte("key1")))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+
+	// Decreases are allowed by default
+	smst = NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 5))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 4))
+}
+
+func TestSMST_SubtreeRoot(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	keys := make([][]byte, 20)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, smst.Update(keys[i], keys[i], uint64(i+1)))
+	}
+
+	root, sum, err := smst.SubtreeRoot(nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte(smst.Root()), root)
+	require.Equal(t, smst.Sum(), sum)
+
+	for i, key := range keys {
+		path := smst.ph.Path(key)
+		proof, err := smst.Prove(key)
+		require.NoError(t, err)
+		for prefixBits := 0; prefixBits <= smst.depth(); prefixBits++ {
+			root, sum, err := smst.SubtreeRoot(path, prefixBits)
+			require.NoError(t, err)
+
+			// The sum is that of all leaves whose paths start with the prefix
+			var expectedSum uint64
+			for j, other := range keys {
+				if countCommonPrefixBits(path, smst.ph.Path(other), 0) >= prefixBits {
+					expectedSum += uint64(j + 1)
+				}
+			}
+			require.Equal(t, expectedSum, sum)
+
+			// The leaf is a member of the subtrie, including where the prefix
+			// ends inside of an extension node or below the leaf
+			subtreeDepth := len(proof.SideNodes) - prefixBits
+			if subtreeDepth < 0 {
+				subtreeDepth = 0
+			}
+			valid, err := VerifyLeafInSubtree(proof, root, key, key, uint64(i+1), subtreeDepth, smst.Spec())
+			require.NoError(t, err)
+			require.True(t, valid)
+
+			// The sibling subtrie at the same depth is empty or has another sum
+			if prefixBits > 0 {
+				sibling := bytes.Clone(path)
+				sibling[(prefixBits-1)/8] ^= 1 << (7 - uint(prefixBits-1)%8)
+				_, siblingSum, err := smst.SubtreeRoot(sibling, prefixBits)
+				require.NoError(t, err)
+				expectedSum = 0
+				for j, other := range keys {
+					if countCommonPrefixBits(sibling, smst.ph.Path(other), 0) >= prefixBits {
+						expectedSum += uint64(j + 1)
+					}
+				}
+				require.Equal(t, expectedSum, siblingSum)
+			}
+		}
+	}
+
+	// Empty subtries have the placeholder digest
+	empty := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	root, sum, err = empty.SubtreeRoot([]byte{0xff}, 4)
+	require.NoError(t, err)
+	require.Equal(t, placeholder(empty.Spec()), root)
+	require.Zero(t, sum)
+
+	_, _, err = smst.SubtreeRoot([]byte{0xff}, 9)
+	require.Error(t, err)
+	_, _, err = smst.SubtreeRoot(nil, -1)
+	require.Error(t, err)
+}
+
+func TestSMST_GetVerified(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 5))
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 7))
+
+	sum, ok, err := smst.GetVerified([]byte("key1"), []byte("value1"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(5), sum)
+
+	// A different value than the one stored is reported as a mismatch
+	sum, ok, err = smst.GetVerified([]byte("key1"), []byte("value2"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, uint64(5), sum)
+
+	sum, ok, err = smst.GetVerified([]byte("key3"), []byte("value1"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Zero(t, sum)
+
+	// Values stored with a codec are compared in their encoded form
+	smst = NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithValueCodec(prefixCodec{prefix: 0x01}))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 5))
+	_, ok, err = smst.GetVerified([]byte("key1"), []byte("value1"))
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestSMST_MigrateSMSTHasher(t *testing.T) {
+	src := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, src.Update(key, []byte(fmt.Sprintf("value%d", i)), uint64(i)))
+	}
+	require.NoError(t, src.Commit())
+
+	dstNodes := simplemap.NewSimpleMap()
+	dst, err := MigrateSMSTHasher(src, dstNodes, sha512.New())
+	require.NoError(t, err)
+	require.Equal(t, src.Sum(), dst.Sum())
+	require.NotEqual(t, src.Root(), dst.Root())
+	require.Len(t, dst.Root(), sha512.Size+sumSize)
+
+	// The migrated trie is committed and can be imported from its root
+	imported := ImportSparseMerkleSumTrie(dstNodes, sha512.New(), dst.Root(),
+		WithPathHasher(src.ph), WithValueHasher(src.vh))
+	for i := 0; i < 55; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		value, sum, err := src.Get(key)
+		require.NoError(t, err)
+		migratedValue, migratedSum, err := imported.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, value, migratedValue)
+		require.Equal(t, sum, migratedSum)
+
+		proof, err := dst.Prove(key)
+		require.NoError(t, err)
+		valid, err := VerifySumProof(proof, dst.Root(), key, []byte(fmt.Sprintf("value%d", i)), sum, dst.Spec())
+		require.NoError(t, err)
+		require.Equal(t, i < 50, valid)
+	}
+
+	// Options not affecting hashing are not carried over
+	hooked := 0
+	hook := func([]LeafChange) error { hooked++; return nil }
+	src = NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(),
+		WithCommitHook(hook), WithAppendOnly(), WithRejectZeroSum())
+	require.NoError(t, src.Update([]byte("key"), []byte("value"), 1))
+	require.NoError(t, src.Commit())
+	require.Equal(t, 1, hooked)
+	dst, err = MigrateSMSTHasher(src, simplemap.NewSimpleMap(), sha512.New())
+	require.NoError(t, err)
+	require.Equal(t, 1, hooked)
+	require.NoError(t, dst.Update([]byte("key"), []byte("value"), 0))
+	require.NoError(t, dst.Commit())
+	require.Equal(t, 1, hooked)
+
+	// Hashers of unsupported sizes are rejected rather than panicking
+	for _, size := range []int{minHashSize - 1, maxHashSize + 1} {
+		hasher := truncatedHasher{Hash: sha512.New(), size: size}
+		_, err := MigrateSMSTHasher(src, simplemap.NewSimpleMap(), hasher)
+		require.ErrorIs(t, err, ErrUnsupportedHashSize)
+	}
+}
+
+func TestSMST_UpdateUnchanged(t *testing.T) {
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, smst.Update(key, key, uint64(i+1)))
+	}
+	require.NoError(t, smst.Commit())
+	root := smst.Root()
+
+	// Updating a key to its current value and weight leaves nothing dirty
+	require.NoError(t, smst.Update([]byte("key3"), []byte("key3"), 4))
+	require.Equal(t, root, smst.Root())
+	nodes, _ := smst.DirtySize()
+	require.Zero(t, nodes)
+	require.Empty(t, smst.orphans)
+
+	// A change to either the value or the weight is applied
+	require.NoError(t, smst.Update([]byte("key3"), []byte("key3"), 5))
+	require.NotEqual(t, root, smst.Root())
+	nodes, _ = smst.DirtySize()
+	require.NotZero(t, nodes)
+	require.NoError(t, smst.Update([]byte("key3"), []byte("other"), 5))
+	_, sum, err := smst.Get([]byte("key3"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), sum)
+}
+
+func TestSMST_UnsupportedHashSize(t *testing.T) {
+	for _, size := range []int{4, minHashSize - 1, maxHashSize + 1} {
+		hasher := truncatedHasher{Hash: sha512.New(), size: size}
+		if size > sha512.Size {
+			hasher = truncatedHasher{Hash: sha256.New(), size: size}
+		}
+		for _, newTrie := range []func(){
+			func() { NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), hasher) },
+			func() { NewSparseMerkleTrie(simplemap.NewSimpleMap(), hasher) },
+		} {
+			func() {
+				defer func() {
+					err, ok := recover().(error)
+					require.True(t, ok, "size %d", size)
+					require.ErrorIs(t, err, ErrUnsupportedHashSize)
+				}()
+				newTrie()
+			}()
+		}
+	}
+
+	// Sizes within the bounds are supported
+	for _, size := range []int{minHashSize, sha256.Size, maxHashSize} {
+		smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), truncatedHasher{Hash: sha512.New(), size: size})
+		require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 5))
+		require.Len(t, smst.Root(), size+sumSize)
+		proof, err := smst.Prove([]byte("foo"))
+		require.NoError(t, err)
+		valid, err := VerifySumProof(proof, smst.Root(), []byte("foo"), []byte("bar"), 5, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+}
+
+func TestSMST_MultiValue(t *testing.T) {
+	concat := func(existing, incoming []byte) []byte {
+		return append(append([]byte{}, existing...), incoming...)
+	}
+	add := func(a, b uint64) uint64 { return a + b }
+	var wal bytes.Buffer
+	smst := NewSparseMerkleSumTrie(
+		simplemap.NewSimpleMap(), sha256.New(),
+		WithValueHasher(nil), WithMultiValue(concat, add), WithWAL(&wal),
+	)
+
+	// Repeated updates of a key accumulate its value and sum
+	require.NoError(t, smst.Update([]byte("key"), []byte("a"), 1))
+	require.NoError(t, smst.Update([]byte("key"), []byte("b"), 2))
+	require.NoError(t, smst.Update([]byte("key"), []byte("c"), 3))
+	require.NoError(t, smst.Update([]byte("other"), []byte("x"), 10))
+	value, sum, err := smst.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), value)
+	require.Equal(t, uint64(6), sum)
+	require.Equal(t, uint64(16), smst.Sum())
+
+	// The leaf stores the combined value and sum
+	proof, err := smst.Prove([]byte("key"))
+	require.NoError(t, err)
+	valid, err := VerifySumProof(proof, smst.Root(), []byte("key"), []byte("abc"), 6, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Deleting a key resets its accumulation
+	require.NoError(t, smst.Delete([]byte("key")))
+	require.NoError(t, smst.Update([]byte("key"), []byte("d"), 4))
+	value, sum, err = smst.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("d"), value)
+	require.Equal(t, uint64(4), sum)
+
+	// Replaying the WAL reproduces the combined leaves
+	replayed := NewSparseMerkleSumTrie(
+		simplemap.NewSimpleMap(), sha256.New(),
+		WithValueHasher(nil), WithMultiValue(concat, add),
+	)
+	require.NoError(t, ReplayWAL(&wal, replayed))
+	require.Equal(t, smst.Root(), replayed.Root())
+
+	// A nil function falls back to replacing existing leaves
+	for _, opt := range []Option{WithMultiValue(nil, add), WithMultiValue(concat, nil)} {
+		overwriting := NewSparseMerkleSumTrie(
+			simplemap.NewSimpleMap(), sha256.New(), WithValueHasher(nil), opt,
+		)
+		require.NoError(t, overwriting.Update([]byte("key"), []byte("a"), 1))
+		require.NoError(t, overwriting.Update([]byte("key"), []byte("b"), 2))
+		value, sum, err = overwriting.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("b"), value)
+		require.Equal(t, uint64(2), sum)
+	}
+}
+
+func TestSMST_UpdateEntries(t *testing.T) {
+	entries := make([]KeyValueSum, 0, 20)
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		entries = append(entries, KeyValueSum{Key: key, Value: key, Sum: uint64(i)})
+	}
+	// A later entry for a key replaces an earlier one
+	entries = append(entries, KeyValueSum{Key: []byte("key3"), Value: []byte("new"), Sum: 30})
+
+	batched := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, batched.UpdateEntries(entries))
+	sequential := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for _, entry := range entries {
+		require.NoError(t, sequential.Update(entry.Key, entry.Value, entry.Sum))
+	}
+	require.Equal(t, sequential.Root(), batched.Root())
+	require.NoError(t, batched.UpdateEntries(nil))
+	require.Equal(t, sequential.Root(), batched.Root())
+
+	// Entries can be verified against the root
+	proven := []KeyValueSum{entries[0], entries[20], {Key: []byte("absent")}}
+	proofs := make([]*SparseMerkleProof, len(proven))
+	for i, entry := range proven {
+		proof, err := batched.Prove(entry.Key)
+		require.NoError(t, err)
+		proofs[i] = proof
+	}
+	valid, err := VerifyEntryProofs(proofs, batched.Root(), proven, batched.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifyEntryProofs(proofs, batched.Root(), []KeyValueSum{entries[0], entries[3], proven[2]}, batched.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// The first failing update is returned, with the entries before it applied
+	rejecting := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithRejectZeroSum())
+	err = rejecting.UpdateEntries([]KeyValueSum{entries[1], entries[0], entries[2]})
+	require.ErrorIs(t, err, ErrZeroSumNotAllowed)
+	_, sum, err := rejecting.Get(entries[1].Key)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), sum)
+	require.Equal(t, uint64(1), rejecting.Sum())
+}
+
+// preallocateRecordingStore records the hints given to the
+// kvstore.PreallocatingStore it wraps
+type preallocateRecordingStore struct {
+	kvstore.PreallocatingStore
+	hints []int
+}
+
+func (s *preallocateRecordingStore) Preallocate(expectedKeys int) {
+	s.hints = append(s.hints, expectedKeys)
+	s.PreallocatingStore.Preallocate(expectedKeys)
+}
+
+func TestSMST_Commit_Preallocate(t *testing.T) {
+	store := &preallocateRecordingStore{
+		PreallocatingStore: simplemap.NewSimpleMap().(kvstore.PreallocatingStore),
+	}
+	smst := NewSparseMerkleSumTrie(store, sha256.New())
+	entries := make([]KeyValueSum, 0, 100)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		entries = append(entries, KeyValueSum{Key: key, Value: key, Sum: uint64(i)})
+	}
+
+	// The store is hinted on commit with the number of nodes written, rather
+	// than before the updates, which do not write to the store
+	require.NoError(t, smst.UpdateEntries(entries))
+	require.Empty(t, store.hints)
+	dirtyNodes, _ := smst.DirtySize()
+	require.NoError(t, smst.Commit())
+	require.Equal(t, []int{dirtyNodes}, store.hints)
+	require.Equal(t, dirtyNodes, store.Len())
+
+	// Stores not implementing the interface are unaffected
+	plain := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, plain.UpdateEntries(entries))
+	require.Equal(t, smst.Root(), plain.Root())
+
+	// Every commit writing nodes hints the store, while one with nothing to
+	// write does not
+	require.NoError(t, smst.Update([]byte("foo"), []byte("bar"), 1))
+	dirtyNodes, _ = smst.DirtySize()
+	require.NoError(t, smst.Commit())
+	require.Equal(t, dirtyNodes, store.hints[1])
+	require.NoError(t, smst.Commit())
+	require.Len(t, store.hints, 2)
+}
+
+func TestSMST_ProveFirstDifference(t *testing.T) {
+	mine := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	theirs := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	keys := make(map[string][]byte)
+	for i := 0; i < 30; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		keys[string(mine.ph.Path(key))] = key
+		require.NoError(t, mine.Update(key, key, uint64(i)))
+		require.NoError(t, theirs.Update(key, key, uint64(i)))
+	}
+	require.NoError(t, theirs.Commit())
+	calls := 0
+	fetch := func(path []byte, depth int) ([]byte, error) {
+		calls++
+		root, _, err := theirs.SubtreeRoot(path, depth)
+		return root, err
+	}
+
+	// Identical tries have no difference
+	diffPath, proof, err := mine.ProveFirstDifference(theirs.Root(), fetch)
+	require.NoError(t, err)
+	require.Nil(t, diffPath)
+	require.Nil(t, proof)
+	require.Zero(t, calls)
+
+	// firstDifference returns the lowest path of the keys provided
+	firstDifference := func(diffKeys ...string) []byte {
+		var first []byte
+		for _, key := range diffKeys {
+			path := mine.ph.Path([]byte(key))
+			keys[string(path)] = []byte(key)
+			if first == nil || bytes.Compare(path, first) < 0 {
+				first = path
+			}
+		}
+		return first
+	}
+
+	// A leaf added by the peer, one removed and one changed
+	require.NoError(t, theirs.Update([]byte("extra"), []byte("extra"), 5))
+	require.NoError(t, theirs.Delete([]byte("key3")))
+	require.NoError(t, theirs.Update([]byte("key7"), []byte("changed"), 7))
+	expected := firstDifference("extra", "key3", "key7")
+	for len(expected) > 0 {
+		diffPath, proof, err = mine.ProveFirstDifference(theirs.Root(), fetch)
+		require.NoError(t, err)
+
+		// The first difference is in the subtrie proven, which the peer is
+		// only queried on the way to
+		depth := len(proof.SideNodes)
+		require.GreaterOrEqual(t, countCommonPrefixBits(diffPath, expected, 0), depth)
+		require.LessOrEqual(t, calls, 2*depth+1)
+		calls = 0
+
+		// The proof is of the leaf at the path in this trie, if any
+		leaf, err := mine.getLeaf(diffPath)
+		require.NoError(t, err)
+		leafHash := placeholder(mine.Spec())
+		if leaf != nil {
+			leafHash = hashNode(mine.Spec(), leaf)
+		}
+		valid, err := VerifySumProofByLeafHash(proof, mine.Root(), leafHash, diffPath, mine.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+
+		// Reconcile the first difference to find the next
+		key := keys[string(expected)]
+		switch string(key) {
+		case "extra":
+			require.NoError(t, mine.Update(key, key, 5))
+		case "key3":
+			require.NoError(t, mine.Delete(key))
+		case "key7":
+			require.NoError(t, mine.Update(key, []byte("changed"), 7))
+		}
+		var remaining []string
+		for _, k := range []string{"extra", "key3", "key7"} {
+			if path := mine.ph.Path([]byte(k)); bytes.Compare(path, expected) > 0 {
+				remaining = append(remaining, k)
+			}
+		}
+		expected = firstDifference(remaining...)
+	}
+	require.Equal(t, theirs.Root(), mine.Root())
+
+	// Errors from the callback are returned
+	require.NoError(t, theirs.Update([]byte("another"), []byte("another"), 1))
+	errFetch := errors.New("fetch failed")
+	_, _, err = mine.ProveFirstDifference(theirs.Root(), func([]byte, int) ([]byte, error) {
+		return nil, errFetch
+	})
+	require.ErrorIs(t, err, errFetch)
+
+	// Tries of a single leaf each are compared without querying the peer
+	mine = NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	theirs = NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	require.NoError(t, mine.Update([]byte("key"), []byte("value"), 1))
+	require.NoError(t, theirs.Update([]byte("key"), []byte("value"), 2))
+	diffPath, proof, err = mine.ProveFirstDifference(theirs.Root(), fetch)
+	require.NoError(t, err)
+	require.Equal(t, mine.ph.Path([]byte("key")), diffPath)
+	require.Empty(t, proof.SideNodes)
+	require.Zero(t, calls)
+}
+
+func TestSMST_DeleteReinsertUncommitted(t *testing.T) {
+	// checkMatches asserts the trie has the leaves provided, by comparing it to
+	// a trie built from them alone
+	checkMatches := func(t *testing.T, smst *SMST, leaves map[string]uint64) {
+		expected := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+		for key, sum := range leaves {
+			require.NoError(t, expected.Update([]byte(key), []byte(key+strconv.Itoa(int(sum))), sum))
+		}
+		require.Equal(t, expected.Root(), smst.Root())
+		for _, key := range []string{"a", "b", "c", "d"} {
+			sum, ok := leaves[key]
+			value, gotSum, err := smst.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, sum, gotSum)
+			proof, err := smst.Prove([]byte(key))
+			require.NoError(t, err)
+			var valid bool
+			if ok {
+				require.Equal(t, smst.digestValue([]byte(key+strconv.Itoa(int(sum)))), value)
+				valid, err = VerifySumProof(proof, smst.Root(), []byte(key), []byte(key+strconv.Itoa(int(sum))), sum, smst.Spec())
+			} else {
+				require.Equal(t, defaultValue, value)
+				valid, err = VerifySumProof(proof, smst.Root(), []byte(key), nil, 0, smst.Spec())
+			}
+			require.NoError(t, err)
+			require.True(t, valid, "key %s", key)
+		}
+	}
+	update := func(t *testing.T, smst *SMST, key string, sum uint64) {
+		require.NoError(t, smst.Update([]byte(key), []byte(key+strconv.Itoa(int(sum))), sum))
+	}
+
+	for _, committed := range []bool{false, true} {
+		snm := simplemap.NewSimpleMap()
+		smst := NewSparseMerkleSumTrie(snm, sha256.New())
+		update(t, smst, "a", 1)
+		update(t, smst, "b", 2)
+		update(t, smst, "c", 3)
+		if committed {
+			require.NoError(t, smst.Commit())
+		}
+
+		// Delete then reinsert with a different value, in one uncommitted window
+		require.NoError(t, smst.Delete([]byte("a")))
+		update(t, smst, "a", 10)
+		checkMatches(t, smst, map[string]uint64{"a": 10, "b": 2, "c": 3})
+
+		// Reinsert then delete, twice over
+		update(t, smst, "b", 20)
+		require.NoError(t, smst.Delete([]byte("b")))
+		update(t, smst, "b", 21)
+		require.NoError(t, smst.Delete([]byte("b")))
+		checkMatches(t, smst, map[string]uint64{"a": 10, "c": 3})
+
+		// Insert then delete a key that was never committed
+		update(t, smst, "d", 4)
+		require.NoError(t, smst.Delete([]byte("d")))
+		checkMatches(t, smst, map[string]uint64{"a": 10, "c": 3})
+
+		// Delete then reinsert with the original value
+		require.NoError(t, smst.Delete([]byte("c")))
+		update(t, smst, "c", 3)
+		checkMatches(t, smst, map[string]uint64{"a": 10, "c": 3})
+
+		// The committed state is consistent, with no stale nodes left behind
+		require.NoError(t, smst.Commit())
+		checkMatches(t, smst, map[string]uint64{"a": 10, "c": 3})
+		imported := ImportSparseMerkleSumTrie(snm, sha256.New(), smst.Root())
+		checkMatches(t, imported, map[string]uint64{"a": 10, "c": 3})
+		nodes, _, err := smst.StorageSize()
+		require.NoError(t, err)
+		require.Equal(t, nodes, snm.Len())
+
+		// As it is after a further window over the committed leaves
+		require.NoError(t, smst.Delete([]byte("a")))
+		update(t, smst, "a", 11)
+		require.NoError(t, smst.Delete([]byte("c")))
+		require.NoError(t, smst.Commit())
+		checkMatches(t, smst, map[string]uint64{"a": 11})
+		nodes, _, err = smst.StorageSize()
+		require.NoError(t, err)
+		require.Equal(t, nodes, snm.Len())
+	}
+}
+
+// countExtensionNodes returns the number of extension nodes in the trie,
+// resolving any nodes not yet loaded from its node store
+func countExtensionNodes(t *testing.T, smt *SMT, node trieNode) int {
+	node, err := smt.resolveLazy(node)
+	require.NoError(t, err)
+	switch n := node.(type) {
+	case *innerNode:
+		return countExtensionNodes(t, smt, n.leftChild) + countExtensionNodes(t, smt, n.rightChild)
+	case *extensionNode:
+		return 1 + countExtensionNodes(t, smt, n.child)
+	}
+	return 0
+}
+
+func TestSMST_WithoutExtensionNodes(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New(), WithoutExtensionNodes())
+	compressed := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+		require.NoError(t, compressed.Update(key, key, uint64(i)))
+	}
+	for i := 0; i < 100; i += 3 {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Delete(key))
+		require.NoError(t, compressed.Delete(key))
+	}
+	require.NoError(t, smst.Commit())
+
+	// The trie has no extension nodes but the same root as one with them
+	require.Zero(t, countExtensionNodes(t, smst.SMT, smst.trie))
+	require.Positive(t, countExtensionNodes(t, compressed.SMT, compressed.trie))
+	require.Equal(t, compressed.Root(), smst.Root())
+	imported := ImportSparseMerkleSumTrie(snm, sha256.New(), smst.Root(), WithoutExtensionNodes())
+	require.Zero(t, countExtensionNodes(t, imported.SMT, imported.trie))
+
+	// Proofs have the same side nodes, with no extension as their sibling data,
+	// and verify
+	root := smst.Root()
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+		proof, err := imported.Prove(key)
+		require.NoError(t, err)
+		expected, err := compressed.Prove(key)
+		require.NoError(t, err)
+		require.Equal(t, expected.SideNodes, proof.SideNodes)
+		require.False(t, isExtension(proof.SiblingData))
+		value, sum := key, uint64(i)
+		if i%3 == 0 {
+			value, sum = nil, 0
+		}
+		valid, err := VerifySumProof(proof, root, key, value, sum, smst.Spec())
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+	closest, err := imported.ProveClosest(smst.ph.Path([]byte("closest")))
+	require.NoError(t, err)
+	valid, err := VerifyClosestProof(closest, root, NoPrehashSpec(sha256.New(), true))
+	require.NoError(t, err)
+	require.True(t, valid)
+}
+
+func TestSMST_LowMemoryCommit(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	smst := NewSparseMerkleSumTrie(snm, sha256.New(), WithLowMemoryCommit())
+	normal := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New())
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+		require.NoError(t, smst.Update(key, key, uint64(i)))
+		require.NoError(t, normal.Update(key, key, uint64(i)))
+	}
+	require.NoError(t, normal.Commit())
+
+	// The root is that of a normal commit, with the trie held as its root alone
+	require.NoError(t, smst.Commit())
+	require.Equal(t, normal.Root(), smst.Root())
+	require.IsType(t, &lazyNode{}, smst.trie)
+	require.Equal(t, normal.nodes.Len(), snm.Len())
+
+	// The trie is loaded from the node store as it is read and updated again
+	value, sum, err := smst.Get([]byte("42"))
+	require.NoError(t, err)
+	require.Equal(t, smst.digestValue([]byte("42")), value)
+	require.Equal(t, uint64(42), sum)
+	require.NoError(t, smst.Delete([]byte("42")))
+	require.NoError(t, normal.Delete([]byte("42")))
+	require.NoError(t, smst.Update([]byte("new"), []byte("new"), 1))
+	require.NoError(t, normal.Update([]byte("new"), []byte("new"), 1))
+	require.NoError(t, smst.Commit())
+	require.NoError(t, normal.Commit())
+	require.Equal(t, normal.Root(), smst.Root())
+	require.Equal(t, normal.nodes.Len(), snm.Len())
+	proof, err := smst.Prove([]byte("7"))
+	require.NoError(t, err)
+	valid, err := VerifySumProof(proof, smst.Root(), []byte("7"), []byte("7"), 7, smst.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+}
+
+// BenchmarkSMST_Commit reports the growth of the heap across the commit of a
+// trie of 10k leaves, with and without WithLowMemoryCommit. Both write every
+// node to the node store, but the low-memory commit frees the trie's nodes as
+// it writes them.
+func BenchmarkSMST_Commit(b *testing.B) {
+	cases := []struct {
+		name    string
+		options []Option
+	}{
+		{"normal", nil},
+		{"low-memory", []Option{WithLowMemoryCommit()}},
+	}
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var growth uint64
+			for i := 0; i < b.N; i++ {
+				smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), tc.options...)
+				for j := 0; j < 10000; j++ {
+					key := []byte(strconv.Itoa(j))
+					require.NoError(b, smst.Update(key, key, uint64(j)))
+				}
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				require.NoError(b, smst.Commit())
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				runtime.KeepAlive(smst)
+				if after.HeapAlloc > before.HeapAlloc {
+					growth += after.HeapAlloc - before.HeapAlloc
+				}
+			}
+			b.ReportMetric(float64(growth)/float64(b.N), "heap-growth-B/op")
+		})
+	}
+}
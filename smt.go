@@ -2,7 +2,11 @@ package smt
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"hash"
+	"time"
+	"unsafe"
 
 	"github.com/pokt-network/smt/kvstore"
 )
@@ -62,13 +66,18 @@ type SMT struct {
 	trie trieNode
 	// Lists of per-operation orphan sets
 	orphans []orphanNodes
+	// Orphans retained for recent roots, see WithRetainOrphansFor
+	history *rootHistory
+	// Number and estimated size of the uncommitted nodes, see DirtySize
+	dirtyNodes, dirtyBytes int
 }
 
 // Hashes of persisted nodes deleted from trie
 type orphanNodes = [][]byte
 
 // NewSparseMerkleTrie returns a new pointer to an SMT struct, and applies any
-// options provided
+// options provided. It panics with ErrUnsupportedHashSize if the output size of
+// the hasher is below 16 or above 64 bytes.
 func NewSparseMerkleTrie(
 	nodes kvstore.MapStore,
 	hasher hash.Hash,
@@ -98,11 +107,33 @@ func ImportSparseMerkleTrie(
 	return smt
 }
 
-// Get returns the digest of the value stored at the given key
+// Get returns the digest of the value stored at the given key, or the value
+// itself if a ValueCodec is set
 func (smt *SMT) Get(key []byte) ([]byte, error) {
-	path := smt.ph.Path(key)
-	var leaf *leafNode
-	var err error
+	leaf, err := smt.readView().getLeaf(smt.ph.Path(key))
+	if err != nil {
+		return nil, err
+	}
+	if leaf == nil {
+		return defaultValue, nil
+	}
+	return smt.decodeValue(leaf.valueHash)
+}
+
+// getLeaf descends the trie along the path provided and returns the leaf node
+// stored at it, or nil if there is no leaf with the given path
+func (smt *SMT) getLeaf(path []byte) (*leafNode, error) {
+	// Fast path for tries with a single leaf
+	leaf, err := smt.singleLeaf()
+	if err != nil {
+		return nil, err
+	}
+	if leaf != nil {
+		if !bytes.Equal(path, leaf.path) {
+			return nil, nil
+		}
+		return leaf, nil
+	}
 	for node, depth := &smt.trie, 0; ; depth++ {
 		*node, err = smt.resolveLazy(*node)
 		if err != nil {
@@ -135,16 +166,193 @@ func (smt *SMT) Get(key []byte) ([]byte, error) {
 			node = &inner.rightChild
 		}
 	}
-	if leaf == nil {
-		return defaultValue, nil
+	return leaf, nil
+}
+
+// SubtreeBounds returns the interval of path bits [lowBit, highBit) spanned by
+// the deepest extension node on the path of the key provided: the bits shared
+// by every leaf beneath the extension, at none of which another leaf branches
+// off. Flipping any of these bits of the key's path leaves its closest leaf
+// beneath the same extension. If no extension node is above the key's leaf the
+// interval is empty, with both bounds the depth of the leaf. ErrKeyNotFound is
+// returned if the key is not in the trie.
+func (smt *SMT) SubtreeBounds(key []byte) (lowBit, highBit int, err error) {
+	view := smt.readView()
+	path := smt.ph.Path(key)
+	node := view.trie
+	for depth := 0; ; depth++ {
+		if node, err = view.resolveLazy(node); err != nil {
+			return 0, 0, err
+		}
+		switch n := node.(type) {
+		case nil:
+			return 0, 0, ErrKeyNotFound
+		case *leafNode:
+			if !bytes.Equal(path, n.path) {
+				return 0, 0, ErrKeyNotFound
+			}
+			if highBit == 0 {
+				lowBit, highBit = depth, depth
+			}
+			return lowBit, highBit, nil
+		case *extensionNode:
+			if _, match := n.match(path, depth); !match {
+				return 0, 0, ErrKeyNotFound
+			}
+			lowBit, highBit = n.pathStart(), n.pathEnd()
+			// The loop increments the depth past the end of the extension
+			depth = n.pathEnd() - 1
+			node = n.child
+		case *innerNode:
+			if getPathBit(path, depth) == left {
+				node = n.leftChild
+			} else {
+				node = n.rightChild
+			}
+		}
+	}
+}
+
+// getLeaves descends the trie along all of the paths provided at once and
+// returns the leaf node stored at each of them, or nil where there is no leaf
+// with the given path. Nodes along shared prefixes are only resolved once.
+func (smt *SMT) getLeaves(paths [][]byte) ([]*leafNode, error) {
+	leaves := make([]*leafNode, len(paths))
+	indices := make([]int, len(paths))
+	for i := range indices {
+		indices[i] = i
+	}
+	if err := smt.collectLeaves(&smt.trie, 0, paths, indices, leaves); err != nil {
+		return nil, err
+	}
+	return leaves, nil
+}
+
+// collectLeaves resolves the subtrie rooted at node and stores the leaf found
+// at each of the paths selected by indices into leaves, partitioning the
+// indices in place between the children of every inner node on the way down
+func (smt *SMT) collectLeaves(node *trieNode, depth int, paths [][]byte, indices []int, leaves []*leafNode,
+) (err error) {
+	if len(indices) == 0 {
+		return nil
+	}
+	*node, err = smt.resolveLazy(*node)
+	if err != nil {
+		return err
+	}
+	switch n := (*node).(type) {
+	case nil:
+		return nil
+	case *leafNode:
+		for _, i := range indices {
+			if bytes.Equal(paths[i], n.path) {
+				leaves[i] = n
+			}
+		}
+		return nil
+	case *extensionNode:
+		matched := 0
+		for _, i := range indices {
+			if _, match := n.match(paths[i], depth); match {
+				indices[matched] = i
+				matched++
+			}
+		}
+		return smt.collectLeaves(&n.child, depth+n.length(), paths, indices[:matched], leaves)
+	}
+	inner := (*node).(*innerNode)
+	// Partition the indices in place, those going left first
+	lefts := 0
+	for j, i := range indices {
+		if getPathBit(paths[i], depth) == left {
+			indices[j], indices[lefts] = indices[lefts], i
+			lefts++
+		}
+	}
+	if err = smt.collectLeaves(&inner.leftChild, depth+1, paths, indices[:lefts], leaves); err != nil {
+		return err
+	}
+	return smt.collectLeaves(&inner.rightChild, depth+1, paths, indices[lefts:], leaves)
+}
+
+// subtreeRoot descends the trie along the first prefixBits bits of the prefix
+// provided and returns the digest of the subtrie rooted at that depth. A leaf
+// found above that depth whose path starts with the prefix is the only leaf in
+// the subtrie, so its digest is returned. The prefix may end inside of an
+// extension node, in which case the digest of the remainder of the extension
+// is returned, as the extension stands in for a chain of inner nodes each with
+// a single child.
+func (smt *SMT) subtreeRoot(prefix []byte, prefixBits int) ([]byte, error) {
+	maxBits := smt.depth()
+	if len(prefix)*8 < maxBits {
+		maxBits = len(prefix) * 8
+	}
+	if prefixBits < 0 || prefixBits > maxBits {
+		return nil, fmt.Errorf("prefix bits %d out of range [0, %d]", prefixBits, maxBits)
+	}
+	var err error
+	node := &smt.trie
+	for depth := 0; ; depth++ {
+		*node, err = smt.resolveLazy(*node)
+		if err != nil {
+			return nil, err
+		}
+		if *node == nil || depth == prefixBits {
+			return hashNode(smt.Spec(), *node), nil
+		}
+		switch n := (*node).(type) {
+		case *leafNode:
+			if countCommonPrefixBits(prefix, n.path, depth) < prefixBits {
+				return hashNode(smt.Spec(), nil), nil
+			}
+			return hashNode(smt.Spec(), n), nil
+		case *extensionNode:
+			if prefixBits < n.pathEnd() {
+				if countCommonPrefixBits(prefix, n.path, depth) < prefixBits {
+					return hashNode(smt.Spec(), nil), nil
+				}
+				rest := &extensionNode{path: n.path, pathBounds: [2]byte{byte(prefixBits), n.pathBounds[1]}, child: n.child}
+				return hashNode(smt.Spec(), rest), nil
+			}
+			if _, match := n.match(prefix, depth); !match {
+				return hashNode(smt.Spec(), nil), nil
+			}
+			// The loop increments the depth past the end of the extension
+			depth = n.pathEnd() - 1
+			node = &n.child
+			continue
+		}
+		inner := (*node).(*innerNode)
+		if getPathBit(prefix, depth) == left {
+			node = &inner.leftChild
+		} else {
+			node = &inner.rightChild
+		}
 	}
-	return leaf.valueHash, nil
 }
 
 // Update sets the value for the given key, to the digest of the provided value
 func (smt *SMT) Update(key []byte, value []byte) error {
+	if smt.appendOnly {
+		leaf, err := smt.getLeaf(smt.ph.Path(key))
+		if err != nil {
+			return err
+		}
+		if leaf != nil {
+			return ErrKeyImmutable
+		}
+	}
+	return smt.set(key, value)
+}
+
+// set sets the value for the given key as Update does, whether or not the
+// trie is append-only
+func (smt *SMT) set(key []byte, value []byte) error {
 	path := smt.ph.Path(key)
-	valueHash := smt.digestValue(value)
+	valueHash, err := smt.encodeValue(value)
+	if err != nil {
+		return err
+	}
 	var orphans orphanNodes
 	trie, err := smt.update(smt.trie, 0, path, valueHash, &orphans)
 	if err != nil {
@@ -168,12 +376,15 @@ func (smt *SMT) update(
 	newLeaf := &leafNode{path: path, valueHash: value}
 	// Empty subtrie is always replaced by a single leaf
 	if node == nil {
+		smt.trackDirty(newLeaf, 1)
 		return newLeaf, nil
 	}
 	if leaf, ok := node.(*leafNode); ok {
 		prefixlen := countCommonPrefixBits(path, leaf.path, depth)
 		if prefixlen == smt.depth() { // replace leaf if paths are equal
 			smt.addOrphan(orphans, node)
+			smt.dropped(leaf)
+			smt.trackDirty(newLeaf, 1)
 			return newLeaf, nil
 		}
 		// We insert an "extension" representing multiple single-branch inner nodes
@@ -187,10 +398,19 @@ func (smt *SMT) update(
 			*last = &ext
 			last = &ext.child
 		}
+		inner := &innerNode{leftChild: leaf, rightChild: newLeaf}
 		if getPathBit(path, prefixlen) == left {
-			*last = &innerNode{leftChild: newLeaf, rightChild: leaf}
-		} else {
-			*last = &innerNode{leftChild: leaf, rightChild: newLeaf}
+			inner.leftChild, inner.rightChild = newLeaf, leaf
+		}
+		*last = inner
+		smt.trackDirty(newLeaf, 1)
+		smt.trackDirty(inner, 1)
+		if ext, ok := node.(*extensionNode); ok {
+			if smt.withoutExtensions {
+				smt.trackDirty(inner, ext.length())
+				return ext.expand(), nil
+			}
+			smt.trackDirty(ext, 1)
 		}
 		return node, nil
 	}
@@ -199,7 +419,27 @@ func (smt *SMT) update(
 
 	if ext, ok := node.(*extensionNode); ok {
 		var branch *trieNode
+		pathEnd := ext.pathEnd()
 		node, branch, depth = ext.split(path, depth)
+		kept := true
+		if depth < pathEnd {
+			// The extension was split by a new branch, and possibly a new
+			// extension below it, or shrunk away entirely
+			inner := (*branch).(*innerNode)
+			smt.trackDirty(inner, 1)
+			for _, tail := range []trieNode{inner.leftChild, inner.rightChild} {
+				if tailExt, ok := tail.(*extensionNode); ok && tailExt != ext {
+					smt.trackDirty(tailExt, 1)
+				}
+			}
+			if node != trieNode(ext) && ext.length() == 0 {
+				smt.dropped(ext)
+				kept = false
+			}
+		}
+		if kept {
+			smt.dirtied(ext)
+		}
 		*branch, err = smt.update(*branch, depth, path, value, orphans)
 		if err != nil {
 			return node, err
@@ -219,12 +459,16 @@ func (smt *SMT) update(
 	if err != nil {
 		return node, err
 	}
+	smt.dirtied(inner)
 	inner.setDirty()
 	return node, nil
 }
 
 // Delete removes the node at the path corresponding to the given key
 func (smt *SMT) Delete(key []byte) error {
+	if smt.appendOnly {
+		return ErrDeleteForbidden
+	}
 	path := smt.ph.Path(key)
 	var orphans orphanNodes
 	trie, err := smt.delete(smt.trie, 0, path, &orphans)
@@ -238,6 +482,79 @@ func (smt *SMT) Delete(key []byte) error {
 	return nil
 }
 
+// Rekey moves the leaf of the old key provided to the path of the new key,
+// preserving its value, as a single operation equivalent to deleting the old
+// key and updating the new key with its value. ErrKeyNotFound is returned if
+// the old key is absent and ErrKeyExists if the new key is already present.
+func (smt *SMT) Rekey(oldKey, newKey []byte) error {
+	if smt.appendOnly {
+		return ErrDeleteForbidden
+	}
+	return smt.rekey(smt.ph.Path(oldKey), smt.ph.Path(newKey))
+}
+
+func (smt *SMT) rekey(oldPath, newPath []byte) error {
+	leaf, err := smt.getLeaf(oldPath)
+	if err != nil {
+		return err
+	}
+	if leaf == nil {
+		return ErrKeyNotFound
+	}
+	existing, err := smt.getLeaf(newPath)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return ErrKeyExists
+	}
+	var orphans orphanNodes
+	trie, err := smt.delete(smt.trie, 0, oldPath, &orphans)
+	if err != nil {
+		return err
+	}
+	trie, err = smt.update(trie, 0, newPath, leaf.valueHash, &orphans)
+	if err != nil {
+		return err
+	}
+	smt.trie = trie
+	if len(orphans) > 0 {
+		smt.orphans = append(smt.orphans, orphans)
+	}
+	return nil
+}
+
+// evictBelow deletes every leaf whose path sorts below the bound provided and
+// returns the number of leaves deleted
+func (smt *SMT) evictBelow(bound []byte) (int, error) {
+	if smt.appendOnly {
+		return 0, ErrDeleteForbidden
+	}
+	it, err := smt.NewLeafIterator(IteratorOptions{Order: PathAsc})
+	if err != nil {
+		return 0, err
+	}
+	var paths [][]byte
+	for it.Next() && bytes.Compare(it.Path(), bound) < 0 {
+		paths = append(paths, it.Path())
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	var orphans orphanNodes
+	for _, path := range paths {
+		trie, err := smt.delete(smt.trie, 0, path, &orphans)
+		if err != nil {
+			return 0, err
+		}
+		smt.trie = trie
+	}
+	if len(orphans) > 0 {
+		smt.orphans = append(smt.orphans, orphans)
+	}
+	return len(paths), nil
+}
+
 func (smt *SMT) delete(node trieNode, depth int, path []byte, orphans *orphanNodes,
 ) (trieNode, error) {
 	node, err := smt.resolveLazy(node)
@@ -253,6 +570,7 @@ func (smt *SMT) delete(node trieNode, depth int, path []byte, orphans *orphanNod
 			return node, ErrKeyNotFound
 		}
 		smt.addOrphan(orphans, node)
+		smt.dropped(leaf)
 		return nil, nil
 	}
 
@@ -268,13 +586,18 @@ func (smt *SMT) delete(node trieNode, depth int, path []byte, orphans *orphanNod
 		}
 		switch n := ext.child.(type) {
 		case *leafNode:
+			smt.dropped(ext)
 			return n, nil
 		case *extensionNode:
 			// Join this extension with the child
 			smt.addOrphan(orphans, n)
+			smt.dropped(ext)
 			n.pathBounds[0] = ext.pathBounds[0]
-			node = n
+			smt.dirtied(n)
+			n.setDirty()
+			return n, nil
 		}
+		smt.dirtied(ext)
 		ext.setDirty()
 		return node, nil
 	}
@@ -301,31 +624,124 @@ func (smt *SMT) delete(node trieNode, depth int, path []byte, orphans *orphanNod
 		if *children[i] == nil {
 			switch n := (*children[1-i]).(type) {
 			case *leafNode:
+				smt.dropped(inner)
 				return n, nil
 			case *extensionNode:
 				// "Absorb" this node into the extension by prepending
 				smt.addOrphan(orphans, n)
+				smt.dropped(inner)
 				n.pathBounds[0]--
+				smt.dirtied(n)
 				n.setDirty()
 				return n, nil
 			}
 		}
 	}
+	smt.dirtied(inner)
 	inner.setDirty()
 	return node, nil
 }
 
+// readView returns the trie read by Get, Prove and ProveClosest: the trie
+// itself or, if it has uncommitted changes and was created with
+// WithProveCommittedOnly, a read-only view of its last committed root
+func (smt *SMT) readView() *SMT {
+	if !smt.proveCommittedOnly || !smt.dirty() {
+		return smt
+	}
+	view := &SMT{TrieSpec: smt.TrieSpec, nodes: smt.nodes, savedRoot: smt.savedRoot}
+	if smt.savedRoot != nil {
+		view.trie = &lazyNode{smt.savedRoot}
+	}
+	return view
+}
+
 // Prove generates a SparseMerkleProof for the given key
 func (smt *SMT) Prove(key []byte) (proof *SparseMerkleProof, err error) {
-	path := smt.ph.Path(key)
-	var siblings []trieNode
-	var sib trieNode
+	if proof, err = smt.readView().prove(smt.ph.Path(key)); err != nil {
+		return nil, err
+	}
+	if smt.fingerprint {
+		fingerprint := SpecFingerprint(smt.Spec())
+		proof.SpecFingerprint = fingerprint[:]
+	}
+	return proof, nil
+}
 
-	node := smt.trie
+// ProveTimed generates a SparseMerkleProof for the given key, as Prove does,
+// and returns the wall-clock time spent generating it
+func (smt *SMT) ProveTimed(key []byte) (*SparseMerkleProof, time.Duration, error) {
+	start := time.Now()
+	proof, err := smt.Prove(key)
+	return proof, time.Since(start), err
+}
+
+// prove generates a SparseMerkleProof for the given path
+func (smt *SMT) prove(path []byte) (proof *SparseMerkleProof, err error) {
+	// Fast path for tries with a single leaf: the proof has no side nodes
+	leaf, err := smt.singleLeaf()
+	if err != nil {
+		return nil, err
+	}
+	if leaf != nil {
+		proof = &SparseMerkleProof{}
+		if !bytes.Equal(leaf.path, path) {
+			proof.NonMembershipLeafData = encodeLeaf(leaf.path, leaf.valueHash)
+		}
+		return proof, nil
+	}
+
+	node, siblings, err := smt.descend(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deal with non-membership proofs. If there is no leaf on this path,
+	// we do not need to add anything else to the proof.
+	var leafData []byte
+	emptyLeaf := node == nil
+	if node != nil {
+		leaf := node.(*leafNode)
+		if !bytes.Equal(leaf.path, path) {
+			// This is a non-membership proof that involves showing a different leaf.
+			// Add the leaf data to the proof.
+			leafData = encodeLeaf(leaf.path, leaf.valueHash)
+		}
+	}
+	// Hash siblings from bottom up.
+	var sideNodes [][]byte
+	for i := range siblings {
+		var sideNode []byte
+		sibling := siblings[len(siblings)-i-1]
+		sideNode = hashNode(smt.Spec(), sibling)
+		sideNodes = append(sideNodes, sideNode)
+	}
+
+	proof = &SparseMerkleProof{
+		SideNodes:             sideNodes,
+		NonMembershipLeafData: leafData,
+		EmptyLeaf:             emptyLeaf,
+	}
+	if len(siblings) > 0 && siblings[len(siblings)-1] != nil {
+		sib, err := smt.resolveLazy(siblings[len(siblings)-1])
+		if err != nil {
+			return nil, err
+		}
+		proof.SiblingData = serialize(smt.Spec(), sib)
+	}
+	return proof, nil
+}
+
+// descend walks the trie along the path provided and returns the node found at
+// its end, either a leaf or nil, and the siblings of the nodes along the way
+// from the root downwards, with nil siblings for the levels of extensions
+func (smt *SMT) descend(path []byte) (node trieNode, siblings []trieNode, err error) {
+	var sib trieNode
+	node = smt.trie
 	for depth := 0; depth < smt.depth(); depth++ {
 		node, err = smt.resolveLazy(node)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if node == nil {
 			break
@@ -343,7 +759,7 @@ func (smt *SMT) Prove(key []byte) (proof *SparseMerkleProof, err error) {
 				node = ext.child
 				node, err = smt.resolveLazy(node)
 				if err != nil {
-					return nil, err
+					return nil, nil, err
 				}
 			} else {
 				node = ext.expand()
@@ -357,39 +773,28 @@ func (smt *SMT) Prove(key []byte) (proof *SparseMerkleProof, err error) {
 		}
 		siblings = append(siblings, sib)
 	}
+	return node, siblings, nil
+}
 
-	// Deal with non-membership proofs. If there is no leaf on this path,
-	// we do not need to add anything else to the proof.
-	var leafData []byte
-	if node != nil {
-		leaf := node.(*leafNode)
-		if !bytes.Equal(leaf.path, path) {
-			// This is a non-membership proof that involves showing a different leaf.
-			// Add the leaf data to the proof.
-			leafData = encodeLeaf(leaf.path, leaf.valueHash)
-		}
+// siblingHash returns the digest of the sibling of the node at the end of the
+// path provided, the first side node of a proof for the path, or the
+// placeholder if the proof would have no side nodes
+func (smt *SMT) siblingHash(path []byte) ([]byte, error) {
+	leaf, err := smt.singleLeaf()
+	if err != nil {
+		return nil, err
 	}
-	// Hash siblings from bottom up.
-	var sideNodes [][]byte
-	for i := range siblings {
-		var sideNode []byte
-		sibling := siblings[len(siblings)-i-1]
-		sideNode = hashNode(smt.Spec(), sibling)
-		sideNodes = append(sideNodes, sideNode)
+	if leaf != nil {
+		return hashNode(smt.Spec(), nil), nil
 	}
-
-	proof = &SparseMerkleProof{
-		SideNodes:             sideNodes,
-		NonMembershipLeafData: leafData,
+	_, siblings, err := smt.descend(path)
+	if err != nil {
+		return nil, err
 	}
-	if sib != nil {
-		sib, err = smt.resolveLazy(sib)
-		if err != nil {
-			return nil, err
-		}
-		proof.SiblingData = serialize(smt.Spec(), sib)
+	if len(siblings) == 0 {
+		return hashNode(smt.Spec(), nil), nil
 	}
-	return proof, nil
+	return hashNode(smt.Spec(), siblings[len(siblings)-1]), nil
 }
 
 // ProveClosest generates a SparseMerkleProof of inclusion for the first
@@ -407,6 +812,9 @@ func (smt *SMT) ProveClosest(path []byte) (
 	proof *SparseMerkleClosestProof, // proof of the key-value pair found
 	err error, // the error value encountered
 ) {
+	if view := smt.readView(); view != smt {
+		return view.ProveClosest(path)
+	}
 	workingPath := make([]byte, len(path))
 	copy(workingPath, path)
 	var siblings []trieNode
@@ -531,6 +939,224 @@ func (smt *SMT) ProveClosest(path []byte) (
 	return proof, nil
 }
 
+// closestCandidates returns the leaves whose paths share the longest common
+// prefix with the path provided, in path order, and the length of that prefix.
+// These are the leaves of the subtrie the path diverges into, or the single
+// leaf at its end, and none if the trie is empty.
+func (smt *SMT) closestCandidates(path []byte) ([]*leafNode, int, error) {
+	var err error
+	node := smt.trie
+	for depth := 0; ; depth++ {
+		node, err = smt.resolveLazy(node)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch n := node.(type) {
+		case nil:
+			return nil, 0, nil
+		case *leafNode:
+			return []*leafNode{n}, countCommonPrefixBits(path, n.path, 0), nil
+		case *extensionNode:
+			length, match := n.match(path, depth)
+			if !match {
+				leaves, err := smt.subtrieLeaves(n.child)
+				return leaves, depth + length, err
+			}
+			depth += length
+			if node, err = smt.resolveLazy(n.child); err != nil {
+				return nil, 0, err
+			}
+		}
+		inner := node.(*innerNode)
+		child, sibling := inner.leftChild, inner.rightChild
+		if getPathBit(path, depth) != left {
+			child, sibling = sibling, child
+		}
+		if child == nil {
+			leaves, err := smt.subtrieLeaves(sibling)
+			return leaves, depth, err
+		}
+		node = child
+	}
+}
+
+// singleLeaf returns the root node of the trie if the trie consists of a
+// single leaf, or nil otherwise
+func (smt *SMT) singleLeaf() (*leafNode, error) {
+	root, err := smt.resolveLazy(smt.trie)
+	if err != nil {
+		return nil, err
+	}
+	smt.trie = root
+	leaf, _ := root.(*leafNode)
+	return leaf, nil
+}
+
+// ProveClosestRight generates a SparseMerkleClosestProof of inclusion for the
+// leaf with the smallest path strictly greater than the path provided, ie. its
+// nearest neighbour to the right. If there is no leaf to the right of the path
+// a nil proof is returned.
+//
+// Unlike ProveClosest the leaf chosen never depends on the number of bits in
+// common with the path. Where the path diverges from the trie, either at an
+// empty child of an inner node or at an unmatched bit of an extension node,
+// the subtrie at the point of divergence is only descended into if its bit is
+// greater than that of the path, in which case its leftmost leaf is chosen.
+// Otherwise the traversal backtracks to the deepest inner node where the path
+// went left and picks the leftmost leaf of its right child.
+func (smt *SMT) ProveClosestRight(path []byte) (*SparseMerkleClosestProof, error) {
+	view := smt.readView()
+	leaf, err := view.nearestLeaf(view.trie, 0, path, true)
+	if err != nil || leaf == nil {
+		return nil, err
+	}
+	return view.closestProof(path, leaf)
+}
+
+// ProveClosestLeft generates a SparseMerkleClosestProof of inclusion for the
+// leaf with the greatest path strictly smaller than the path provided, ie. its
+// nearest neighbour to the left. If there is no leaf to the left of the path a
+// nil proof is returned.
+//
+// The divergence rule mirrors ProveClosestRight: a subtrie the path diverges
+// from is only descended into if its bit is smaller than that of the path, in
+// which case its rightmost leaf is chosen, otherwise the traversal backtracks
+// to the deepest inner node where the path went right and picks the rightmost
+// leaf of its left child.
+func (smt *SMT) ProveClosestLeft(path []byte) (*SparseMerkleClosestProof, error) {
+	view := smt.readView()
+	leaf, err := view.nearestLeaf(view.trie, 0, path, false)
+	if err != nil || leaf == nil {
+		return nil, err
+	}
+	return view.closestProof(path, leaf)
+}
+
+// ProveCloserThan generates a SparseMerkleClosestProof of inclusion for a
+// leaf whose path shares a longer common prefix with the path provided than
+// the path of the claimed key, disproving the claim that it is the closest
+// key to the path, and returns the path of that leaf. If the claimed key is
+// (one of) the closest, or the trie is empty, ErrNoCloserLeaf is returned.
+//
+// The claim is refuted by verifying the proof with VerifyClosestProof and
+// checking that the common prefix of its Path and ClosestPath is longer than
+// that of the path and the claimed key's path.
+func (smt *SMT) ProveCloserThan(path, claimedKey []byte) (
+	betterPath []byte,
+	proof *SparseMerkleClosestProof,
+	err error,
+) {
+	proof, err = smt.ProveClosest(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proof.ClosestValueHash == nil {
+		return nil, nil, ErrNoCloserLeaf
+	}
+	claimedPrefix := countCommonPrefixBits(path, smt.ph.Path(claimedKey), 0)
+	if countCommonPrefixBits(path, proof.ClosestPath, 0) <= claimedPrefix {
+		return nil, nil, ErrNoCloserLeaf
+	}
+	return proof.ClosestPath, proof, nil
+}
+
+// nearestLeaf returns the leaf in the subtrie of the node provided (at the
+// given depth) whose path is nearest to the path provided, strictly to its
+// right (greater) or left (smaller). If there is no such leaf nil is returned.
+func (smt *SMT) nearestLeaf(node trieNode, depth int, path []byte, right bool) (*leafNode, error) {
+	node, err := smt.resolveLazy(node)
+	if err != nil {
+		return nil, err
+	}
+	switch n := node.(type) {
+	case nil:
+		return nil, nil
+	case *leafNode:
+		if cmp := bytes.Compare(n.path, path); (right && cmp > 0) || (!right && cmp < 0) {
+			return n, nil
+		}
+		return nil, nil
+	case *extensionNode:
+		length, match := n.match(path, depth)
+		if match {
+			return smt.nearestLeaf(n.child, depth+length, path, right)
+		}
+		// The path diverges from the extension, so all of the leaves in its
+		// subtrie are on the same side of the path
+		i := depth + length
+		if (getPathBit(n.path, i) > getPathBit(path, i)) == right {
+			return smt.edgeLeaf(n.child, right)
+		}
+		return nil, nil
+	}
+	inner := node.(*innerNode)
+	near, far := inner.leftChild, inner.rightChild
+	if getPathBit(path, depth) != left {
+		near, far = far, near
+	}
+	leaf, err := smt.nearestLeaf(near, depth+1, path, right)
+	if err != nil || leaf != nil {
+		return leaf, err
+	}
+	// The far child is only on the requested side of the path if the path
+	// goes left and we are looking right, or vice versa
+	if (getPathBit(path, depth) == left) == right {
+		return smt.edgeLeaf(far, right)
+	}
+	return nil, nil
+}
+
+// edgeLeaf returns the leftmost (or rightmost) leaf of the node provided
+func (smt *SMT) edgeLeaf(node trieNode, leftmost bool) (*leafNode, error) {
+	var err error
+	for {
+		node, err = smt.resolveLazy(node)
+		if err != nil {
+			return nil, err
+		}
+		switch n := node.(type) {
+		case nil:
+			return nil, nil
+		case *leafNode:
+			return n, nil
+		case *extensionNode:
+			node = n.child
+		case *innerNode:
+			first, second := n.leftChild, n.rightChild
+			if !leftmost {
+				first, second = second, first
+			}
+			if first == nil {
+				first = second
+			}
+			node = first
+		}
+	}
+}
+
+// closestProof generates a SparseMerkleClosestProof for the path provided
+// proving the inclusion of the given leaf
+func (smt *SMT) closestProof(path []byte, leaf *leafNode) (*SparseMerkleClosestProof, error) {
+	closestProof, err := smt.prove(leaf.path)
+	if err != nil {
+		return nil, err
+	}
+	proof := &SparseMerkleClosestProof{
+		Path:             path,
+		FlippedBits:      make([]int, 0),
+		Depth:            len(closestProof.SideNodes),
+		ClosestPath:      leaf.path,
+		ClosestValueHash: leaf.valueHash,
+		ClosestProof:     closestProof,
+	}
+	for i := 0; i < proof.Depth; i++ {
+		if getPathBit(path, i) != getPathBit(leaf.path, i) {
+			proof.FlippedBits = append(proof.FlippedBits, i)
+		}
+	}
+	return proof, nil
+}
+
 //nolint:unused
 func (smt *SMT) recursiveLoad(hash []byte) (trieNode, error) {
 	return smt.resolve(hash, smt.recursiveLoad)
@@ -542,7 +1168,13 @@ func (smt *SMT) resolveLazy(node trieNode) (trieNode, error) {
 	if !ok {
 		return node, nil
 	}
+	// Empty children are left nil, as they are in memory, rather than
+	// deferred as the placeholder digest
+	empty := placeholder(smt.Spec())
 	resolver := func(hash []byte) (trieNode, error) {
+		if bytes.Equal(empty, hash) {
+			return nil, nil
+		}
 		return &lazyNode{hash}, nil
 	}
 	ret, err := resolve(smt, stub.digest, resolver)
@@ -552,12 +1184,29 @@ func (smt *SMT) resolveLazy(node trieNode) (trieNode, error) {
 	return ret, nil
 }
 
+// getNode returns the preimage of the node with the digest provided from the
+// node store, returning ErrMissingNode with the digest if the store does not
+// hold it. Other errors of the store are returned as they are.
+func (smt *SMT) getNode(hash []byte) ([]byte, error) {
+	data, err := smt.nodes.Get(hash)
+	if errors.Is(err, kvstore.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %x: %w", ErrMissingNode, hash, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%w: %x", ErrMissingNode, hash)
+	}
+	return data, nil
+}
+
 func (smt *SMT) resolve(hash []byte, resolver func([]byte) (trieNode, error),
 ) (ret trieNode, err error) {
 	if bytes.Equal(smt.th.placeholder(), hash) {
 		return
 	}
-	data, err := smt.nodes.Get(hash)
+	data, err := smt.getNode(hash)
 	if err != nil {
 		return
 	}
@@ -595,7 +1244,7 @@ func (smt *SMT) resolveSum(hash []byte, resolver func([]byte) (trieNode, error),
 	if bytes.Equal(placeholder(smt.Spec()), hash) {
 		return
 	}
-	data, err := smt.nodes.Get(hash)
+	data, err := smt.getNode(hash)
 	if err != nil {
 		return nil, err
 	}
@@ -631,47 +1280,188 @@ func (smt *SMT) resolveSum(hash []byte, resolver func([]byte) (trieNode, error),
 // Commit persists all dirty nodes in the trie, deletes all orphaned
 // nodes from the database and then computes and saves the root hash
 func (smt *SMT) Commit() (err error) {
+	if !smt.dirty() {
+		smt.savedRoot = smt.Root()
+		return
+	}
 	// All orphans are persisted and have cached digests, so we don't need to check for null
-	for _, orphans := range smt.orphans {
+	orphans := smt.orphans
+	if smt.retainOrphans > 0 {
+		orphans = smt.expiredOrphans(smt.orphans)
+	}
+	if store, ok := smt.nodes.(kvstore.PreallocatingStore); ok {
+		// Every dirty node is written by the commit
+		store.Preallocate(smt.dirtyNodes)
+	}
+	w := newCommitWriter(smt.nodes)
+	if smt.lowMemoryCommit {
+		// Writes are not buffered, so that each node can be freed once written
+		w.batch = nil
+	}
+	for _, orphans := range orphans {
 		for _, hash := range orphans {
-			if err = smt.nodes.Delete(hash); err != nil {
+			if err = w.delete(hash); err != nil {
 				return
 			}
 		}
 	}
-	smt.orphans = nil
-	if err = smt.commit(smt.trie); err != nil {
+	if err = smt.commit(smt.trie, w); err != nil {
+		return
+	}
+	if err = w.flush(); err != nil {
 		return
 	}
+	for _, node := range w.written {
+		smt.markPersisted(node)
+	}
+	// The orphans and the history are only changed once the commit has
+	// succeeded, so that a failed commit can be retried
+	if smt.retainOrphans > 0 && smt.savedRoot != nil {
+		smt.retainOrphanSets(smt.orphans)
+		for _, hash := range w.rewritten {
+			smt.history.unorphan(hash)
+		}
+	}
+	smt.orphans = nil
 	smt.savedRoot = smt.Root()
+	smt.dirtyNodes, smt.dirtyBytes = 0, 0
+	if smt.lowMemoryCommit {
+		smt.trie = smt.unload(smt.trie)
+	}
 	return
 }
 
-func (smt *SMT) commit(node trieNode) error {
+// CommitIfDirty commits the trie, as Commit does, if it has been modified
+// since the last commit and reports whether it did. If nothing has changed it
+// returns false without accessing the node store.
+func (smt *SMT) CommitIfDirty() (committed bool, err error) {
+	if !smt.dirty() {
+		return false, nil
+	}
+	return true, smt.Commit()
+}
+
+// dirty returns whether the trie has nodes to persist or orphans to delete
+func (smt *SMT) dirty() bool {
+	return len(smt.orphans) > 0 || (smt.trie != nil && !smt.trie.Persisted())
+}
+
+// CommitRoot persists all dirty nodes in the trie, as Commit does, and returns
+// the root hash that was committed. If there is nothing to commit the current
+// root is returned without accessing the node store.
+func (smt *SMT) CommitRoot() (MerkleRoot, error) {
+	if err := smt.Commit(); err != nil {
+		return nil, err
+	}
+	return smt.savedRoot, nil
+}
+
+func (smt *SMT) commit(node trieNode, w *commitWriter) error {
 	if node != nil && node.Persisted() {
 		return nil
 	}
 	switch n := node.(type) {
 	case *leafNode:
-		n.persisted = true
 	case *innerNode:
-		n.persisted = true
-		if err := smt.commit(n.leftChild); err != nil {
+		if err := smt.commit(n.leftChild, w); err != nil {
 			return err
 		}
-		if err := smt.commit(n.rightChild); err != nil {
+		if err := smt.commit(n.rightChild, w); err != nil {
 			return err
 		}
+		if smt.lowMemoryCommit {
+			n.leftChild, n.rightChild = smt.unload(n.leftChild), smt.unload(n.rightChild)
+		}
 	case *extensionNode:
-		n.persisted = true
-		if err := smt.commit(n.child); err != nil {
+		if err := smt.commit(n.child, w); err != nil {
 			return err
 		}
+		if smt.lowMemoryCommit {
+			n.child = smt.unload(n.child)
+		}
 	default:
 		return nil
 	}
 	preimage := serialize(smt.Spec(), node)
-	return smt.nodes.Set(hashNode(smt.Spec(), node), preimage)
+	hash := hashNode(smt.Spec(), node)
+	if err := w.set(hash, preimage); err != nil {
+		return err
+	}
+	if smt.retainOrphans > 0 {
+		// Retained orphans persisted again are no longer orphans
+		w.rewritten = append(w.rewritten, hash)
+	}
+	// Nodes are only marked persisted once written, so that a failed commit
+	// writes them again when retried
+	if w.batch == nil {
+		smt.markPersisted(node)
+	} else {
+		w.written = append(w.written, node)
+	}
+	return nil
+}
+
+// markPersisted marks the node provided as persisted in the node store
+func (smt *SMT) markPersisted(node trieNode) {
+	switch n := node.(type) {
+	case *leafNode:
+		n.persisted = true
+	case *innerNode:
+		n.persisted = true
+	case *extensionNode:
+		n.persisted = true
+	}
+}
+
+// unload returns a lazy node standing in for the persisted node provided, so
+// that the node and its descendants can be freed from memory
+func (smt *SMT) unload(node trieNode) trieNode {
+	switch node.(type) {
+	case nil, *lazyNode:
+		return node
+	}
+	return &lazyNode{hashNode(smt.Spec(), node)}
+}
+
+// commitWriter applies the writes of a commit to a node store, buffering them
+// to be applied in a single batch if the store is a kvstore.BatchStore
+type commitWriter struct {
+	nodes kvstore.MapStore
+	batch kvstore.BatchStore
+	ops   []kvstore.BatchOp
+	// nodes set in the batch, to be marked persisted once it is flushed
+	written []trieNode
+	// digests of the nodes set, to be unorphaned once the commit succeeds
+	rewritten [][]byte
+}
+
+func newCommitWriter(nodes kvstore.MapStore) *commitWriter {
+	batch, _ := nodes.(kvstore.BatchStore)
+	return &commitWriter{nodes: nodes, batch: batch}
+}
+
+func (w *commitWriter) set(key, value []byte) error {
+	if w.batch == nil {
+		return w.nodes.Set(key, value)
+	}
+	w.ops = append(w.ops, kvstore.BatchOp{Key: key, Value: value})
+	return nil
+}
+
+func (w *commitWriter) delete(key []byte) error {
+	if w.batch == nil {
+		return w.nodes.Delete(key)
+	}
+	w.ops = append(w.ops, kvstore.BatchOp{Key: key, Delete: true})
+	return nil
+}
+
+// flush applies the buffered writes, if any, in a single batch
+func (w *commitWriter) flush() error {
+	if len(w.ops) == 0 {
+		return nil
+	}
+	return w.batch.Batch(w.ops)
 }
 
 // Root returns the root hash of the trie
@@ -679,6 +1469,51 @@ func (smt *SMT) Root() MerkleRoot {
 	return hashNode(smt.Spec(), smt.trie)
 }
 
+// DirtySize returns the number of uncommitted (dirty) nodes held in memory
+// and an estimate of the number of bytes they occupy, including their paths,
+// values and digests. The counts are maintained as the trie is modified and
+// reset on commit, so this is cheap enough to poll after every update.
+func (smt *SMT) DirtySize() (nodes int, approxBytes int) {
+	return smt.dirtyNodes, smt.dirtyBytes
+}
+
+// trackDirty adds n times the node provided to the counts of uncommitted nodes
+// reported by DirtySize, removing it if n is negative
+func (smt *SMT) trackDirty(node trieNode, n int) {
+	smt.dirtyNodes += n
+	smt.dirtyBytes += n * dirtyNodeSize(smt.Spec(), node)
+}
+
+// dirtied counts the node provided as uncommitted if it is persisted, before
+// it is modified
+func (smt *SMT) dirtied(node trieNode) {
+	if node.Persisted() {
+		smt.trackDirty(node, 1)
+	}
+}
+
+// dropped stops counting the node provided as uncommitted if it is not
+// persisted, as it is removed from the trie
+func (smt *SMT) dropped(node trieNode) {
+	if !node.Persisted() {
+		smt.trackDirty(node, -1)
+	}
+}
+
+// dirtyNodeSize returns the estimated number of bytes an uncommitted node
+// occupies in memory, including the digest it caches once hashed
+func dirtyNodeSize(spec *TrieSpec, node trieNode) int {
+	switch n := node.(type) {
+	case *leafNode:
+		return int(unsafe.Sizeof(*n)) + len(n.path) + len(n.valueHash) + hashSize(spec)
+	case *extensionNode:
+		return int(unsafe.Sizeof(*n)) + len(n.path) + hashSize(spec)
+	case *innerNode:
+		return int(unsafe.Sizeof(*n)) + hashSize(spec)
+	}
+	return 0
+}
+
 func (smt *SMT) addOrphan(orphans *[][]byte, node trieNode) {
 	if node.Persisted() {
 		*orphans = append(*orphans, node.CachedDigest())
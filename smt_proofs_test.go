@@ -404,3 +404,41 @@ func TestSMT_ProveClosest_Proof(t *testing.T) {
 		checkClosestCompactEquivalence(t, proof512, smt512.Spec())
 	}
 }
+
+func TestSMT_Proof_PathSalt(t *testing.T) {
+	trieA := NewSparseMerkleTrie(simplemap.NewSimpleMap(), sha256.New(), WithPathSalt([]byte("salt A")))
+	trieB := NewSparseMerkleTrie(simplemap.NewSimpleMap(), sha256.New(), WithPathSalt([]byte("salt B")))
+	unsalted := NewSparseMerkleTrie(simplemap.NewSimpleMap(), sha256.New())
+	key, value := []byte("key"), []byte("value")
+
+	// The same key is placed at a different path under each salt
+	require.NotEqual(t, trieA.ph.Path(key), trieB.ph.Path(key))
+	require.NotEqual(t, trieA.ph.Path(key), unsalted.ph.Path(key))
+	require.Equal(t, trieA.depth(), unsalted.depth())
+
+	for _, trie := range []*SMT{trieA, trieB} {
+		require.NoError(t, trie.Update(key, value))
+		require.NoError(t, trie.Update([]byte("other key"), []byte("other value")))
+		got, err := trie.Get(key)
+		require.NoError(t, err)
+		valueHash := sha256.Sum256(value)
+		require.Equal(t, valueHash[:], got)
+	}
+	require.NotEqual(t, trieA.Root(), trieB.Root())
+
+	// Proofs only verify with the salt they were generated with
+	proof, err := trieA.Prove(key)
+	require.NoError(t, err)
+	valid, err := VerifyProof(proof, trieA.Root(), key, value, trieA.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifyProof(proof, trieA.Root(), key, value, trieB.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = VerifyProof(proof, trieA.Root(), key, value, unsalted.Spec())
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// The salt is part of the spec's fingerprint
+	require.NotEqual(t, SpecFingerprint(trieA.Spec()), SpecFingerprint(trieB.Spec()))
+}
@@ -3,6 +3,8 @@ package smt
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"hash"
 	"testing"
 
@@ -397,3 +399,96 @@ func TestSMT_OrphanRemoval(t *testing.T) {
 		}
 	})
 }
+
+func TestSMT_ValueCodec(t *testing.T) {
+	smn := simplemap.NewSimpleMap()
+	smt := NewSparseMerkleTrie(smn, sha256.New(), WithValueCodec(prefixCodec{prefix: 0x01}))
+	require.NoError(t, smt.Update([]byte("key1"), []byte("value1")))
+	require.NoError(t, smt.Update([]byte("key2"), []byte("value2")))
+
+	value, err := smt.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), value)
+
+	root := smt.Root()
+	proof, err := smt.Prove([]byte("key1"))
+	require.NoError(t, err)
+	valid, err := VerifyProof(proof, root, []byte("key1"), []byte("value1"), smt.Spec())
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// The codec is replaced by a subsequent value hasher
+	smt = NewSparseMerkleTrie(smn, sha256.New(), WithValueCodec(prefixCodec{prefix: 0x01}), WithValueHasher(nil))
+	require.NoError(t, smt.Update([]byte("key1"), []byte("value1")))
+	leaf, err := smt.getLeaf(smt.ph.Path([]byte("key1")))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), leaf.valueHash)
+}
+
+func TestSMT_ProveMissingNode(t *testing.T) {
+	smn := simplemap.NewSimpleMap()
+	smt := NewSparseMerkleTrie(smn, sha256.New())
+	require.NoError(t, smt.Update([]byte("key1"), []byte("value1")))
+	require.NoError(t, smt.Update([]byte("key2"), []byte("value2")))
+	require.NoError(t, smt.Commit())
+
+	// Remove the persisted inner root node and reload the trie from its root
+	root := smt.Root()
+	require.NoError(t, smn.Delete(root))
+	smt = ImportSparseMerkleTrie(smn, sha256.New(), root)
+
+	_, err := smt.Prove([]byte("key1"))
+	require.ErrorIs(t, err, ErrMissingNode)
+	require.Contains(t, err.Error(), hex.EncodeToString(root))
+
+	// Other errors of the node store are not reported as missing nodes
+	errStore := errors.New("store unavailable")
+	smt = ImportSparseMerkleTrie(&failingGetStore{MapStore: smn, err: errStore}, sha256.New(), root)
+	_, err = smt.Prove([]byte("key1"))
+	require.ErrorIs(t, err, errStore)
+	require.NotErrorIs(t, err, ErrMissingNode)
+}
+
+// failingGetStore is a MapStore whose reads fail with the error provided
+type failingGetStore struct {
+	kvstore.MapStore
+	err error
+}
+
+func (s *failingGetStore) Get([]byte) ([]byte, error) { return nil, s.err }
+
+func TestSMT_SharePrefix(t *testing.T) {
+	smt := NewSparseMerkleTrie(simplemap.NewSimpleMap(), sha256.New())
+	spec := smt.Spec()
+	// sharePrefix compares the bits of the paths one at a time
+	sharePrefix := func(a, b []byte, bits int) bool {
+		pathA, pathB := spec.ph.Path(a), spec.ph.Path(b)
+		for i := 0; i < bits; i++ {
+			if i >= len(pathA)*8 || (pathA[i/8]>>(7-i%8))&1 != (pathB[i/8]>>(7-i%8))&1 {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 50; i++ {
+		keyA, keyB := make([]byte, 8), make([]byte, 8)
+		_, err := rand.Read(keyA)
+		require.NoError(t, err)
+		_, err = rand.Read(keyB)
+		require.NoError(t, err)
+		for _, bits := range []int{0, 1, 2, 3, 4, 8, 9, spec.depth()} {
+			require.Equal(t, sharePrefix(keyA, keyB, bits), SharePrefix(keyA, keyB, bits, spec), "bits %d", bits)
+		}
+	}
+
+	// A key shares its whole path with itself, but nothing beyond it
+	require.True(t, SharePrefix([]byte("foo"), []byte("foo"), spec.depth(), spec))
+	require.False(t, SharePrefix([]byte("foo"), []byte("foo"), spec.depth()+1, spec))
+	require.True(t, SharePrefix([]byte("foo"), []byte("bar"), 0, spec))
+
+	// Keys are in the same subtrie at the depth of their shared prefix
+	pathFoo, pathBar := spec.ph.Path([]byte("foo")), spec.ph.Path([]byte("bar"))
+	common := countCommonPrefixBits(pathFoo, pathBar, 0)
+	require.True(t, SharePrefix([]byte("foo"), []byte("bar"), common, spec))
+	require.False(t, SharePrefix([]byte("foo"), []byte("bar"), common+1, spec))
+}
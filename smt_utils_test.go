@@ -2,7 +2,9 @@ package smt
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
+	"hash"
 
 	"github.com/pokt-network/smt/kvstore"
 )
@@ -86,3 +88,66 @@ func (h dummyPathHasher) Path(key []byte) []byte {
 }
 
 func (h dummyPathHasher) PathSize() int { return h.size }
+
+// firstBytePathHasher is a weak PathHasher for tests, that hashes only the
+// first byte of a key so that keys sharing it have colliding paths.
+type firstBytePathHasher struct{}
+
+func (firstBytePathHasher) Path(key []byte) []byte {
+	path := sha256.Sum256(key[:1])
+	return path[:]
+}
+
+func (firstBytePathHasher) PathSize() int { return sha256.Size }
+
+// truncatedHasher is a hash.Hash for tests, that truncates the digests of the
+// hasher it wraps to the size provided.
+type truncatedHasher struct {
+	hash.Hash
+	size int
+}
+
+func (h truncatedHasher) Sum(b []byte) []byte {
+	return h.Hash.Sum(b)[:len(b)+h.size]
+}
+
+func (h truncatedHasher) Size() int { return h.size }
+
+// fieldAlignedSerializer is a NodeSerializer for tests, that splits the
+// canonical encoding of a node into 31 byte chunks each left padded to 32
+// bytes, so that every chunk fits in a 254 bit field element.
+type fieldAlignedSerializer struct{}
+
+func (fieldAlignedSerializer) SerializeNode(encoding []byte) []byte {
+	data := make([]byte, 0, (len(encoding)+30)/31*32)
+	for len(encoding) > 0 {
+		n := len(encoding)
+		if n > 31 {
+			n = 31
+		}
+		data = append(data, make([]byte, 32-n)...)
+		data = append(data, encoding[:n]...)
+		encoding = encoding[n:]
+	}
+	return data
+}
+
+// prefixCodec is a reversible ValueCodec for tests, that prefixes values with
+// a fixed byte when encoding and strips it when decoding.
+type prefixCodec struct {
+	prefix byte
+}
+
+func (c prefixCodec) Encode(value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return append([]byte{c.prefix}, value...), nil
+}
+
+func (c prefixCodec) Decode(leafData []byte) ([]byte, error) {
+	if len(leafData) == 0 || leafData[0] != c.prefix {
+		return nil, errors.New("invalid prefix")
+	}
+	return leafData[1:], nil
+}
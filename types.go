@@ -1,8 +1,11 @@
 package smt
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 	"hash"
+	"io"
 )
 
 const (
@@ -20,7 +23,9 @@ type MerkleRoot []byte
 
 // Sum returns the uint64 sum of the merkle root, it checks the length of the
 // merkle root and if it is no the same as the size of the SMST's expected
-// root hash it will panic.
+// root hash it will panic. The root's layout is guessed from its length, so
+// SMST.Sum must be used for tries with a truncated hash size or the legacy
+// node layout.
 func (r MerkleRoot) Sum() uint64 {
 	if len(r)%32 == 0 {
 		panic("roo#sum: not a merkle sum trie")
@@ -30,6 +35,40 @@ func (r MerkleRoot) Sum() uint64 {
 	return binary.BigEndian.Uint64(sumbz[:])
 }
 
+// Entry is a key-value pair, with its sum, stored in a sparse merkle sum trie
+type Entry struct {
+	Key   []byte
+	Value []byte
+	Sum   uint64
+}
+
+// KeyValueSum is the canonical key, value and sum of a sum trie leaf, passed to
+// batch operations in place of parallel slices of keys, values and sums. It is
+// an alias of Entry, so the two are interchangeable.
+type KeyValueSum = Entry
+
+// LeafChange is a leaf added, updated or removed by the commit of a sum trie, as
+// passed to the hook set with WithCommitHook.
+type LeafChange = ChangedKey
+
+// ParseSumRoot splits the root of a sparse merkle sum trie with the spec
+// provided into its digest and the uint64 sum stored with it, according to the
+// spec's hash size and node layout. ErrMalformedRoot is returned if the root is
+// not of the length of the spec's roots or the spec is not of a sum trie.
+func ParseSumRoot(root []byte, spec *TrieSpec) (hash []byte, sum uint64, err error) {
+	if !spec.sumTrie {
+		return nil, 0, fmt.Errorf("%w: spec is not of a sum trie", ErrMalformedRoot)
+	}
+	if len(root) != hashSize(spec) {
+		return nil, 0, fmt.Errorf("%w: invalid sum root length %d, expected %d", ErrMalformedRoot, len(root), hashSize(spec))
+	}
+	sum = binary.BigEndian.Uint64(spec.th.digestSum(root))
+	if spec.th.sumFirst {
+		return root[sumSize:], sum, nil
+	}
+	return root[:len(root)-sumSize], sum, nil
+}
+
 // SparseMerkleTrie represents a Sparse Merkle Trie.
 type SparseMerkleTrie interface {
 	// Update inserts a value into the SMT.
@@ -85,20 +124,147 @@ type TrieSpec struct {
 	ph      PathHasher
 	vh      ValueHasher
 	sumTrie bool
+	// vc, when set, replaces the ValueHasher with a reversible encoding
+	vc ValueCodec
+	// vr, when set, resolves the value hashes stored in leaves to the values
+	// they were computed from
+	vr func(valueHash []byte) ([]byte, error)
+	// wal, when set, records the operations applied to a sum trie before
+	// they are applied in memory
+	wal io.Writer
+	// fingerprint, when set, attaches the fingerprint of the spec to proofs
+	fingerprint bool
+	// retainOrphans is the number of commits whose orphans are retained
+	retainOrphans int
+	// rejectZeroSum, when set, rejects updates of a sum trie with a zero sum
+	rejectZeroSum bool
+	// monotonicSums, when set, rejects updates of existing keys of a sum trie
+	// that decrease their sum
+	monotonicSums bool
+	// appendOnly, when set, rejects updates of existing keys of a trie and
+	// the removal of any of its leaves
+	appendOnly bool
+	// combineValue and combineSum, when set, combine the value and sum of an
+	// existing leaf of a sum trie with those of an update to its key
+	combineValue func(existing, incoming []byte) []byte
+	combineSum   func(a, b uint64) uint64
+	// withoutExtensions, when set, makes updates insert chains of inner nodes
+	// in place of extension nodes
+	withoutExtensions bool
+	// commitHook, when set, is called by the commit of a sum trie with the
+	// leaves changed since the last commit
+	commitHook func(changes []LeafChange) error
+	// lowMemoryCommit, when set, frees each node from memory once committed
+	lowMemoryCommit bool
+	// proveCommittedOnly, when set, makes reads and proofs reflect the last
+	// committed root rather than any uncommitted changes
+	proveCommittedOnly bool
+	// maxProofSideNodes, when positive, caps the number of side nodes
+	// accepted in proofs below the depth of the trie
+	maxProofSideNodes int
+	// maxDepth caches the path size in bits (the maximum number of side
+	// nodes in a proof) as it is read on every proof operation
+	maxDepth int
 }
 
 func newTrieSpec(hasher hash.Hash, sumTrie bool) TrieSpec {
-	spec := TrieSpec{th: *newTrieHasher(hasher)}
-	spec.ph = &pathHasher{spec.th}
+	return newTrieSpecFromHasher(newTrieHasher(hasher), sumTrie)
+}
+
+func newTrieSpecFromHasher(th *trieHasher, sumTrie bool) TrieSpec {
+	spec := TrieSpec{th: *th}
+	spec.setPathHasher(&pathHasher{spec.th})
 	spec.vh = &valueHasher{spec.th}
 	spec.sumTrie = sumTrie
 	return spec
 }
 
+// specFingerprintProbe is the input hashed by each of a spec's hashers to
+// capture their behaviour in its fingerprint
+var specFingerprintProbe = []byte("smt spec fingerprint")
+
+// SpecFingerprint returns a digest identifying the behaviour of the spec
+// provided, covering its hasher and any truncation of its digests, path hasher,
+// value hasher or codec, whether it is for a sum trie, its node layout and node
+// serializer. Specs that produce
+// the same fingerprint hash nodes, paths and values identically. The hashers
+// and serializer are identified by their output for a fixed input rather than
+// their types.
+func SpecFingerprint(spec *TrieSpec) [32]byte {
+	var data []byte
+	appendField := func(field []byte) {
+		data = binary.AppendUvarint(data, uint64(len(field)))
+		data = append(data, field...)
+	}
+	appendField(spec.th.truncate(spec.th.digest(specFingerprintProbe)))
+	probePath := make([]byte, spec.ph.PathSize())
+	copy(probePath, specFingerprintProbe)
+	appendField(spec.ph.Path(probePath))
+	switch {
+	case spec.vc != nil:
+		encoded, err := spec.vc.Encode(specFingerprintProbe)
+		if err != nil {
+			encoded = []byte(err.Error())
+		}
+		appendField(append([]byte("codec"), encoded...))
+	case spec.vh != nil:
+		appendField(append([]byte("hasher"), spec.vh.HashValue(specFingerprintProbe)...))
+	default:
+		appendField(nil)
+	}
+	if spec.th.ns != nil {
+		probeNode := encodeInner(spec.th.placeholder(), spec.th.placeholder())
+		if spec.sumTrie {
+			probeNode = spec.th.encodeSumInner(placeholder(spec), placeholder(spec))
+		}
+		appendField(append([]byte("serializer"), spec.th.ns.SerializeNode(probeNode)...))
+	}
+	var flags byte
+	if spec.sumTrie {
+		flags |= 1
+	}
+	if spec.th.sumFirst {
+		flags |= 2
+	}
+	data = append(data, flags)
+	return sha256.Sum256(data)
+}
+
+// SharePrefix returns whether the paths of the keys provided, as hashed by the
+// spec's PathHasher, agree on their first bits, in which case the keys are in
+// the same subtrie at that depth. Any two keys share a prefix of 0 bits, while
+// no keys share a prefix longer than their paths.
+func SharePrefix(keyA, keyB []byte, bits int, spec *TrieSpec) bool {
+	if bits <= 0 {
+		return true
+	}
+	if bits > spec.depth() {
+		return false
+	}
+	return countCommonPrefixBits(spec.ph.Path(keyA), spec.ph.Path(keyB), 0) >= bits
+}
+
+// setPathHasher sets the PathHasher and recomputes the depth dependent
+// constants of the spec
+func (spec *TrieSpec) setPathHasher(ph PathHasher) {
+	spec.ph = ph
+	spec.maxDepth = ph.PathSize() * 8
+}
+
 // Spec returns the TrieSpec associated with the given trie
 func (spec *TrieSpec) Spec() *TrieSpec { return spec }
 
-func (spec *TrieSpec) depth() int { return spec.ph.PathSize() * 8 }
+func (spec *TrieSpec) depth() int { return spec.maxDepth }
+
+// maxSideNodes returns the maximum number of side nodes accepted in a proof,
+// which is the depth of the trie unless capped by WithMaxProofSideNodes
+func (spec *TrieSpec) maxSideNodes() int {
+	if spec.maxProofSideNodes > 0 && spec.maxProofSideNodes < spec.depth() {
+		return spec.maxProofSideNodes
+	}
+	return spec.depth()
+}
+
 func (spec *TrieSpec) digestValue(data []byte) []byte {
 	if spec.vh == nil {
 		return data
@@ -106,6 +272,28 @@ func (spec *TrieSpec) digestValue(data []byte) []byte {
 	return spec.vh.HashValue(data)
 }
 
+// encodeValue returns the data stored in a leaf for the value provided, using
+// the ValueCodec if one is set and the ValueHasher otherwise
+func (spec *TrieSpec) encodeValue(data []byte) ([]byte, error) {
+	if spec.vc == nil {
+		return spec.digestValue(data), nil
+	}
+	return spec.vc.Encode(data)
+}
+
+// decodeValue returns the value of the data stored in a leaf, using the
+// ValueCodec or value resolver if either is set, otherwise the data is
+// returned as-is
+func (spec *TrieSpec) decodeValue(data []byte) ([]byte, error) {
+	if spec.vc != nil {
+		return spec.vc.Decode(data)
+	}
+	if spec.vr != nil {
+		return spec.vr(data)
+	}
+	return data, nil
+}
+
 func (spec *TrieSpec) serialize(node trieNode) (data []byte) {
 	switch n := node.(type) {
 	case *lazyNode:
@@ -142,7 +330,7 @@ func (spec *TrieSpec) hashNode(node trieNode) []byte {
 		return n.digest
 	}
 	if *cache == nil {
-		*cache = spec.th.digest(spec.serialize(node))
+		*cache = spec.th.nodeDigest(spec.serialize(node))
 	}
 	return *cache
 }
@@ -158,11 +346,11 @@ func (spec *TrieSpec) sumSerialize(node trieNode) (preimage []byte) {
 	case *innerNode:
 		lchild := spec.hashSumNode(n.leftChild)
 		rchild := spec.hashSumNode(n.rightChild)
-		preimage = encodeSumInner(lchild, rchild)
+		preimage = spec.th.encodeSumInner(lchild, rchild)
 		return preimage
 	case *extensionNode:
 		child := spec.hashSumNode(n.child)
-		return encodeSumExtension(n.pathBounds, n.path, child)
+		return spec.th.encodeSumExtension(n.pathBounds, n.path, child)
 	}
 	return nil
 }
@@ -189,8 +377,7 @@ func (spec *TrieSpec) hashSumNode(node trieNode) []byte {
 	}
 	if *cache == nil {
 		preimage := spec.sumSerialize(node)
-		*cache = spec.th.digest(preimage)
-		*cache = append(*cache, preimage[len(preimage)-sumSize:]...)
+		*cache = spec.th.sumDigest(spec.th.nodeDigest(preimage), preimage[len(preimage)-sumSize:])
 	}
 	return *cache
 }
@@ -2,6 +2,7 @@ package smt
 
 import (
 	"encoding/binary"
+	"math/bits"
 )
 
 type nilPathHasher struct {
@@ -55,15 +56,17 @@ func flipPathBit(data []byte, position int) {
 func countSetBits(data []byte) int {
 	count := 0
 	for _, b := range data {
-		// Kernighan’s Method of counting set bits in a byte
-		for b != 0 {
-			b = b & (b - 1) // unset the rightmost set bit
-			count++
-		}
+		count += bits.OnesCount8(b)
 	}
 	return count
 }
 
+// bitMaskLen returns the number of bytes required for a bit mask covering the
+// number of side nodes provided, ie. ceil(numSideNodes/8)
+func bitMaskLen(numSideNodes int) int {
+	return (numSideNodes + 7) / 8
+}
+
 // countCommonPrefixBits counts common bits in each path, starting from some position
 func countCommonPrefixBits(data1, data2 []byte, from int) int {
 	count := 0
@@ -77,6 +80,17 @@ func countCommonPrefixBits(data1, data2 []byte, from int) int {
 	return count + from
 }
 
+// PathDistance returns the number of bits following the longest common prefix
+// of the two paths provided, ie. the height of the smallest subtrie that both
+// paths belong to. Identical paths have a distance of 0. If the paths differ in
+// length only the bits of the shorter path are considered.
+func PathDistance(pathA, pathB []byte) int {
+	if len(pathB) < len(pathA) {
+		pathA, pathB = pathB, pathA
+	}
+	return len(pathA)*8 - countCommonPrefixBits(pathA, pathB, 0)
+}
+
 // equalPrefixBits checks if the bits from n to m (inclusive) in the two paths are equal
 func equalPrefixBits(data1, data2 []byte, n, m int) (bool, int) {
 	for i := n; i < m; i++ {
@@ -120,9 +134,7 @@ func bytesToInt(bz []byte) int {
 // placeholder returns the default placeholder value depending on the trie type
 func placeholder(spec *TrieSpec) []byte {
 	if spec.sumTrie {
-		placeholder := spec.th.placeholder()
-		placeholder = append(placeholder, defaultSum[:]...)
-		return placeholder
+		return spec.th.sumPlaceholder()
 	}
 	return spec.th.placeholder()
 }
@@ -183,7 +195,7 @@ func hashSerialization(smt *TrieSpec, data []byte) []byte {
 		copy(ext.pathBounds[:], pathBounds)
 		return smt.hashNode(&ext)
 	}
-	return smt.th.digest(data)
+	return smt.th.nodeDigest(data)
 }
 
 // Used for verification of serialized proof data for sum trie nodes
@@ -194,9 +206,7 @@ func hashSumSerialization(smt *TrieSpec, data []byte) []byte {
 		copy(ext.pathBounds[:], pathBounds)
 		return smt.hashSumNode(&ext)
 	}
-	digest := smt.th.digest(data)
-	digest = append(digest, data[len(data)-sumSize:]...)
-	return digest
+	return smt.th.sumDigest(smt.th.nodeDigest(data), data[len(data)-sumSize:])
 }
 
 // resolve resolves a lazy node depending on the trie type
@@ -0,0 +1,150 @@
+package smt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// walOp is the type of operation recorded in a write-ahead log entry
+type walOp byte
+
+const (
+	walUpdate walOp = iota + 1
+	walDelete
+	walEvictBelow
+	// walRekey entries hold the new key in place of a value
+	walRekey
+)
+
+// maxWALBytesLen bounds the length of the keys and values in a write-ahead
+// log, guarding against allocations for corrupted lengths when it is read
+const maxWALBytesLen = 16 << 20
+
+// walTruncater is implemented by write-ahead logs that can be emptied once
+// their operations have been committed, such as *os.File
+type walTruncater interface {
+	Truncate(size int64) error
+}
+
+// writeWAL appends an entry for the operation to the write-ahead log, if one
+// is set. Each entry is written with a single call to Write and is encoded as:
+// [op]+[uvarint key length]+[key]+[uvarint value length]+[value]+[sum]
+func (smst *SMST) writeWAL(op walOp, key, value []byte, sum uint64) error {
+	if smst.wal == nil {
+		return nil
+	}
+	if len(key) > maxWALBytesLen || len(value) > maxWALBytesLen {
+		// The entry could not be replayed
+		return fmt.Errorf("%w: entry length exceeds %d bytes", ErrMalformedWAL, maxWALBytesLen)
+	}
+	entry := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(key)+len(value)+sumSize)
+	entry = append(entry, byte(op))
+	entry = binary.AppendUvarint(entry, uint64(len(key)))
+	entry = append(entry, key...)
+	entry = binary.AppendUvarint(entry, uint64(len(value)))
+	entry = append(entry, value...)
+	entry = binary.BigEndian.AppendUint64(entry, sum)
+	if _, err := smst.wal.Write(entry); err != nil {
+		return fmt.Errorf("writing to WAL: %w", err)
+	}
+	return nil
+}
+
+// truncateWAL empties the write-ahead log, if one is set and it supports
+// truncation, rewinding it to the start if it is also an io.Seeker
+func (smst *SMST) truncateWAL() error {
+	t, ok := smst.wal.(walTruncater)
+	if !ok {
+		return nil
+	}
+	if err := t.Truncate(0); err != nil {
+		return fmt.Errorf("truncating WAL: %w", err)
+	}
+	if s, ok := smst.wal.(io.Seeker); ok {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("truncating WAL: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReplayWAL reapplies the operations recorded in the write-ahead log read
+// from r to the trie provided, reconstructing the uncommitted state of a trie
+// after a restart. The trie should be in the state it was last committed in.
+// Replayed operations are not written to the trie's own write-ahead log.
+//
+// A partially written final entry, left by a crash while appending to the log,
+// is ignored as its operation was never applied. Deleting a key that is not in
+// the trie, or rekeying a key that is absent or to a key that is present, is
+// also ignored, as the original operation failed in the same way.
+func ReplayWAL(r io.Reader, smst *SMST) error {
+	br := bufio.NewReader(r)
+	for {
+		op, err := br.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key, err := readWALBytes(br)
+		if err != nil {
+			return walReadError(err)
+		}
+		value, err := readWALBytes(br)
+		if err != nil {
+			return walReadError(err)
+		}
+		var sumBz [sumSize]byte
+		if _, err := io.ReadFull(br, sumBz[:]); err != nil {
+			return walReadError(err)
+		}
+		switch walOp(op) {
+		case walUpdate:
+			err = smst.update(key, value, binary.BigEndian.Uint64(sumBz[:]))
+		case walDelete:
+			if err = smst.SMT.Delete(key); errors.Is(err, ErrKeyNotFound) {
+				err = nil
+			}
+		case walEvictBelow:
+			_, err = smst.SMT.evictBelow(smst.ph.Path(key))
+		case walRekey:
+			if err = smst.SMT.Rekey(key, value); errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrKeyExists) {
+				err = nil
+			}
+		default:
+			return fmt.Errorf("%w: unknown operation %d", ErrMalformedWAL, op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readWALBytes reads a length prefixed byte slice from a write-ahead log
+func readWALBytes(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxWALBytesLen {
+		return nil, fmt.Errorf("%w: entry length %d", ErrMalformedWAL, n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// walReadError returns nil for errors caused by a partially written final
+// entry, and the error provided otherwise
+func walReadError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
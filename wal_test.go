@@ -0,0 +1,101 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pokt-network/smt/kvstore/simplemap"
+)
+
+func TestSMST_WAL_Replay(t *testing.T) {
+	snm := simplemap.NewSimpleMap()
+	wal := new(bytes.Buffer)
+	smst := NewSparseMerkleSumTrie(snm, sha256.New(), WithWAL(wal))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+	require.NoError(t, smst.Commit())
+	committed := smst.Root()
+
+	// A bytes.Buffer cannot be truncated by the trie, so discard the
+	// committed operations manually
+	wal.Reset()
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 2))
+	require.NoError(t, smst.Update([]byte("key3"), []byte("value3"), 3))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value4"), 4))
+	require.NoError(t, smst.Delete([]byte("key2")))
+	require.ErrorIs(t, smst.Delete([]byte("key5")), ErrKeyNotFound)
+	require.NoError(t, smst.Rekey([]byte("key3"), []byte("key7")))
+	require.ErrorIs(t, smst.Rekey([]byte("key1"), []byte("key7")), ErrKeyExists)
+	require.NoError(t, smst.Update([]byte("key6"), nil, 0))
+	_, err := smst.EvictBelow(bytes.Repeat([]byte{0}, 32))
+	require.NoError(t, err)
+	uncommitted := smst.Root()
+
+	// Simulate a restart from the last committed state
+	restarted := ImportSparseMerkleSumTrie(snm, sha256.New(), committed, WithWAL(wal))
+	log := bytes.Clone(wal.Bytes())
+	require.NoError(t, ReplayWAL(bytes.NewReader(log), restarted))
+	require.Equal(t, uncommitted, restarted.Root())
+	value, sum, err := restarted.Get([]byte("key1"))
+	require.NoError(t, err)
+	valueHash := sha256.Sum256([]byte("value4"))
+	require.Equal(t, valueHash[:], value)
+	require.Equal(t, uint64(4), sum)
+
+	// Replaying does not append to the trie's own log
+	require.Equal(t, log, wal.Bytes())
+
+	// A partially written final entry is ignored
+	restarted = ImportSparseMerkleSumTrie(snm, sha256.New(), committed)
+	torn := append(bytes.Clone(log), byte(walUpdate), 4, 'k', 'e')
+	require.NoError(t, ReplayWAL(bytes.NewReader(torn), restarted))
+	require.Equal(t, uncommitted, restarted.Root())
+
+	// Unknown operations are rejected
+	restarted = ImportSparseMerkleSumTrie(snm, sha256.New(), committed)
+	corrupt := append(bytes.Clone(log), 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	require.ErrorIs(t, ReplayWAL(bytes.NewReader(corrupt), restarted), ErrMalformedWAL)
+
+	// Corrupted lengths are rejected before anything is allocated for them
+	restarted = ImportSparseMerkleSumTrie(snm, sha256.New(), committed)
+	corrupt = binary.AppendUvarint([]byte{byte(walUpdate)}, 1<<31)
+	require.ErrorIs(t, ReplayWAL(bytes.NewReader(corrupt), restarted), ErrMalformedWAL)
+
+	// Values too long to be replayed are not logged, nor applied
+	large := make([]byte, maxWALBytesLen+1)
+	require.ErrorIs(t, smst.Update([]byte("key8"), large, 8), ErrMalformedWAL)
+	require.Equal(t, log, wal.Bytes())
+	require.Equal(t, uncommitted, smst.Root())
+}
+
+func TestSMST_WAL_TruncateOnCommit(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "wal"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	smst := NewSparseMerkleSumTrie(simplemap.NewSimpleMap(), sha256.New(), WithWAL(f))
+	require.NoError(t, smst.Update([]byte("key1"), []byte("value1"), 1))
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.NotZero(t, info.Size())
+
+	require.NoError(t, smst.Commit())
+	info, err = f.Stat()
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	// Operations after the commit are written from the start of the log
+	require.NoError(t, smst.Update([]byte("key2"), []byte("value2"), 2))
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	log, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, byte(walUpdate), log[0])
+	require.Equal(t, []byte("key2"), log[2:6])
+}